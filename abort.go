@@ -0,0 +1,142 @@
+package bandwidth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Outcomes of a throttled transfer.
+const (
+	outcomeComplete = "complete"
+	// The client went away, e.g. it closed the connection or reset the
+	// stream while the response was waiting for tokens.
+	outcomeClientAbort = "client_abort"
+	// The transfer exceeded its time budget or deadline.
+	outcomeTimeout = "timeout"
+	// A chunk of the transfer could not get tokens within the wait
+	// timeout, see WaitTimeout.
+	outcomeWaitTimeout = "wait_timeout"
+	// The key spent its quota and grace while the transfer was in flight,
+	// see Overage.
+	outcomeQuotaExceeded = "quota_exceeded"
+	// The config serving the transfer was stopped, by a reload or because
+	// the server is shutting down.
+	outcomeShutdown = "server_shutdown"
+	// The client read the response far below its limit for too long and
+	// was evicted, see SlowClients.
+	outcomeSlowClient = "slow_client"
+	// The response ended short of its Content-Length without an abort,
+	// e.g. because the handler failed mid-stream.
+	outcomeIncomplete = "incomplete"
+)
+
+// abortError is returned by the response writer when a transfer ends
+// early, giving the underlying error, typically context.Canceled, the
+// context of why and how far into the transfer it happened.
+type abortError struct {
+	reason  string
+	written int64
+	size    int64 // -1 if unknown
+	err     error
+}
+
+func (e *abortError) Error() string {
+	size := "unknown"
+	if e.size >= 0 {
+		size = fmt.Sprint(e.size)
+	}
+	return fmt.Sprintf("throttled transfer ended early (%s) after %d of %s bytes: %v", e.reason, e.written, size, e.err)
+}
+
+func (e *abortError) Unwrap() error {
+	return e.err
+}
+
+// abortReason classifies why the transfer was cut off.
+func (l *limitedResponseWriter) abortReason() string {
+	switch {
+	case l.budgetErr != nil:
+		return outcomeTimeout
+	case l.shuttingDown():
+		return outcomeShutdown
+	}
+	// The limiter fails a wait early if it cannot finish before the
+	// request's deadline, so the context need not have expired yet
+	ctx := l.r.Context()
+	if _, ok := ctx.Deadline(); ok && !errors.Is(ctx.Err(), context.Canceled) {
+		return outcomeTimeout
+	}
+	return outcomeClientAbort
+}
+
+// shuttingDown reports whether the config serving the request was stopped
+// or the server is shutting down.
+func (l *limitedResponseWriter) shuttingDown() bool {
+	if caddy.Exiting() {
+		return true
+	}
+	if l.stopped != nil {
+		select {
+		case <-l.stopped:
+			return true
+		default:
+		}
+	}
+	if l.r.Context().Value(caddyhttp.ServerCtxKey) != nil {
+		repl, _ := l.r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if repl != nil {
+			if v, _ := repl.Get("http.shutting_down"); v == true {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// abort records that the transfer was cut off by err and wraps err with
+// the reason and progress of the transfer.
+func (l *limitedResponseWriter) abort(err error) error {
+	if l.abortedBy == "" {
+		l.abortedBy = l.abortReason()
+	}
+	return &abortError{reason: l.abortedBy, written: l.written, size: l.size(), err: err}
+}
+
+// size returns the Content-Length of the response, -1 if unknown.
+func (l *limitedResponseWriter) size() int64 {
+	if l.transfer == nil {
+		return -1
+	}
+	return l.transfer.size.Load()
+}
+
+// outcome returns how the transfer ended, once the handler returned.
+func (l *limitedResponseWriter) outcome() string {
+	if l.abortedBy != "" {
+		return l.abortedBy
+	}
+	if l.budgetErr != nil {
+		switch l.budgetErr.(type) {
+		case *WaitTimeoutError:
+			return outcomeWaitTimeout
+		case *QuotaExceededError:
+			return outcomeQuotaExceeded
+		}
+		return outcomeTimeout
+	}
+	// The handler may have given up on its own when the client went away,
+	// without the writer noticing
+	if l.r.Context().Err() != nil {
+		return l.abortReason()
+	}
+	bodyAllowed := l.r.Method != http.MethodHead && l.status != http.StatusNoContent && l.status != http.StatusNotModified
+	if size := l.size(); bodyAllowed && size >= 0 && l.written < size {
+		return outcomeIncomplete
+	}
+	return outcomeComplete
+}
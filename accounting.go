@@ -0,0 +1,368 @@
+package bandwidth
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// Accounting aggregates the bytes transferred per key over fixed intervals
+// and exports a record per key at the end of each interval, for billing
+// and usage reporting.
+type Accounting struct {
+	// Key is the placeholder identifying who is billed, e.g. a user,
+	// "{http.request.remote.host}" or "{http.request.host}". Defaults to
+	// the handler's key, or else the client IP.
+	Key string `json:"key,omitempty"`
+
+	// Interval over which usage is aggregated. Defaults to 5m.
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// File appends the records of each interval to this file.
+	File string `json:"file,omitempty"`
+
+	// Format of File: "json" (one record per line, the default) or "csv".
+	Format string `json:"format,omitempty"`
+
+	// Webhook receives the records of each interval as a JSON array in a
+	// POST request.
+	Webhook string `json:"webhook,omitempty"`
+
+	// Storage stores the records of each interval as a JSON array in the
+	// configured Caddy storage, under "bandwidth/accounting/".
+	Storage bool `json:"storage,omitempty"`
+
+	// IncludeExempt also records requests that are not throttled, such as
+	// unlimited tiers, in separate records flagged as exempt, so that
+	// capacity planning sees total egress and not just the shaped subset.
+	IncludeExempt bool `json:"include_exempt,omitempty"`
+}
+
+// Accounting file formats.
+const (
+	accountingJSON = "json"
+	accountingCSV  = "csv"
+)
+
+const defaultAccountingInterval = 5 * time.Minute
+
+// accountingStoragePrefix is the storage key prefix of exported records.
+const accountingStoragePrefix = "bandwidth/accounting"
+
+// maxWebhookBacklog bounds the records kept per webhook while it fails.
+const maxWebhookBacklog = 100000
+
+// webhookBacklog holds the records that could not be posted, by webhook,
+// so that the next export to the same webhook retries them, even after a
+// config reload replaced the accountant.
+var webhookBacklog = struct {
+	sync.Mutex
+	records map[string][]accountingRecord
+}{records: make(map[string][]accountingRecord)}
+
+func (a *Accounting) provision(handlerKey string) error {
+	if a.Key == "" {
+		a.Key = handlerKey
+	}
+	if a.Key == "" {
+		a.Key = "{http.request.remote.host}"
+	}
+	if a.Interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	if a.Interval == 0 {
+		a.Interval = caddy.Duration(defaultAccountingInterval)
+	}
+	switch a.Format {
+	case "":
+		a.Format = accountingJSON
+	case accountingJSON, accountingCSV:
+	default:
+		return fmt.Errorf("unknown format '%s'", a.Format)
+	}
+	if a.File == "" && a.Webhook == "" && !a.Storage {
+		return fmt.Errorf("at least one of file, webhook or storage is required")
+	}
+	return nil
+}
+
+// accountingKey returns the key the usage of a request is recorded under.
+// Accounting by the handler's key aggregates addresses by network like
+// the buckets do, so that usage and warm starts match the buckets' keys.
+func (m Middleware) accountingKey(repl *caddy.Replacer) string {
+	key := repl.ReplaceAll(m.Accounting.Key, "")
+	if m.Accounting.Key == m.Key {
+		key = m.aggregateKey(key)
+	}
+	return m.hashKey(key)
+}
+
+// accountingRecord is the usage of one key over one interval.
+type accountingRecord struct {
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	Policy        string    `json:"policy,omitempty"`
+	Key           string    `json:"key"`
+	Exempt        bool      `json:"exempt,omitempty"`
+	Requests      int64     `json:"requests"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+}
+
+type usage struct {
+	requests, sent, received int64
+}
+
+// usageKey separates the usage of exempt requests from that of throttled
+// requests by the same key.
+type usageKey struct {
+	key    string
+	exempt bool
+}
+
+// accountant aggregates usage for a handler and exports it periodically.
+// It lives in the handler's state, so that usage accumulates across config
+// reloads, and exports what is left when the state is destroyed.
+type accountant struct {
+	cfg     Accounting
+	policy  string
+	storage certmagic.Storage
+	logger  *zap.Logger
+	client  *http.Client
+
+	mu    sync.Mutex
+	start time.Time
+	usage map[usageKey]*usage
+
+	stop chan struct{}
+}
+
+func newAccountant(ctx caddy.Context, cfg Accounting, policy string) *accountant {
+	a := &accountant{
+		cfg:    cfg,
+		policy: policy,
+		logger: ctx.Logger().Named("accounting"),
+		client: &http.Client{Timeout: 30 * time.Second},
+		start:  time.Now(),
+		usage:  make(map[usageKey]*usage),
+		stop:   make(chan struct{}),
+	}
+	if cfg.Storage {
+		a.storage = ctx.Storage()
+	}
+	go a.run()
+	return a
+}
+
+// add records a request by key.
+func (a *accountant) add(key string, exempt bool, sent, received int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	uk := usageKey{key, exempt}
+	u, ok := a.usage[uk]
+	if !ok {
+		u = new(usage)
+		a.usage[uk] = u
+	}
+	u.requests++
+	u.sent += sent
+	u.received += received
+}
+
+func (a *accountant) run() {
+	ticker := time.NewTicker(time.Duration(a.cfg.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.flush()
+		case <-a.stop:
+			a.flush()
+			return
+		}
+	}
+}
+
+// close stops the accountant. The usage recorded so far is exported in
+// the background, so that unloading a config does not wait for slow
+// destinations.
+func (a *accountant) close() {
+	close(a.stop)
+}
+
+// flush exports the usage of the interval that just ended and starts a new
+// one.
+func (a *accountant) flush() {
+	a.mu.Lock()
+	start, end := a.start, time.Now()
+	current := a.usage
+	a.start, a.usage = end, make(map[usageKey]*usage)
+	a.mu.Unlock()
+
+	records := make([]accountingRecord, 0, len(current))
+	for uk, u := range current {
+		records = append(records, accountingRecord{
+			Start:         start.UTC(),
+			End:           end.UTC(),
+			Policy:        a.policy,
+			Key:           uk.key,
+			Exempt:        uk.exempt,
+			Requests:      u.requests,
+			BytesSent:     u.sent,
+			BytesReceived: u.received,
+		})
+	}
+	slices.SortFunc(records, func(x, y accountingRecord) int {
+		if c := cmp.Compare(x.Key, y.Key); c != 0 {
+			return c
+		}
+		return compareBool(x.Exempt, y.Exempt)
+	})
+	demand.observe(a.policy, records, start, end)
+	if len(records) == 0 {
+		return
+	}
+
+	if a.cfg.File != "" {
+		if err := a.writeFile(records); err != nil {
+			a.logger.Error("writing accounting file", zap.String("file", a.cfg.File), zap.Error(err))
+		}
+	}
+	if a.cfg.Webhook != "" {
+		if err := a.postWebhook(records); err != nil {
+			a.logger.Error("posting accounting records", zap.String("webhook", a.cfg.Webhook), zap.Error(err))
+		}
+	}
+	if a.storage != nil {
+		if err := a.store(records); err != nil {
+			a.logger.Error("storing accounting records", zap.Error(err))
+		}
+	}
+}
+
+// compareBool orders false before true.
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case !a:
+		return -1
+	}
+	return 1
+}
+
+func (a *accountant) writeFile(records []accountingRecord) error {
+	f, err := os.OpenFile(a.cfg.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	switch a.cfg.Format {
+	case accountingCSV:
+		w := csv.NewWriter(&buf)
+		if info.Size() == 0 {
+			w.Write([]string{"start", "end", "policy", "key", "exempt", "requests", "bytes_sent", "bytes_received"})
+		}
+		for _, r := range records {
+			w.Write([]string{
+				r.Start.Format(time.RFC3339Nano),
+				r.End.Format(time.RFC3339Nano),
+				r.Policy,
+				r.Key,
+				strconv.FormatBool(r.Exempt),
+				strconv.FormatInt(r.Requests, 10),
+				strconv.FormatInt(r.BytesSent, 10),
+				strconv.FormatInt(r.BytesReceived, 10),
+			})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+	default:
+		enc := json.NewEncoder(&buf)
+		for _, r := range records {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = f.Write(buf.Bytes())
+	return err
+}
+
+// postWebhook posts the records along with those that previous exports
+// failed to post. If that fails too, they are all kept for the next export.
+func (a *accountant) postWebhook(records []accountingRecord) error {
+	webhookBacklog.Lock()
+	records = append(webhookBacklog.records[a.cfg.Webhook], records...)
+	delete(webhookBacklog.records, a.cfg.Webhook)
+	webhookBacklog.Unlock()
+
+	err := a.post(records)
+	if err == nil {
+		return nil
+	}
+	webhookBacklog.Lock()
+	defer webhookBacklog.Unlock()
+	// Exports to the same webhook may have failed meanwhile
+	records = append(records, webhookBacklog.records[a.cfg.Webhook]...)
+	if dropped := len(records) - maxWebhookBacklog; dropped > 0 {
+		a.logger.Error("dropping accounting records of a failing webhook",
+			zap.String("webhook", a.cfg.Webhook), zap.Int("records", dropped))
+		records = records[dropped:]
+	}
+	webhookBacklog.records[a.cfg.Webhook] = records
+	return fmt.Errorf("%v; keeping %d records for the next export", err, len(records))
+}
+
+func (a *accountant) post(records []accountingRecord) error {
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Post(a.cfg.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+func (a *accountant) store(records []accountingRecord) error {
+	body, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	policy := a.policy
+	if policy == "" {
+		policy = "_"
+	}
+	key := path.Join(accountingStoragePrefix, policy, records[0].End.Format("20060102T150405.000000000Z")+".json")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return a.storage.Store(ctx, key, body)
+}
@@ -0,0 +1,84 @@
+package bandwidth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestAccountingWebhookRetry(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	var mu sync.Mutex
+	var posted []accountingRecord
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var records []accountingRecord
+		if err := json.NewDecoder(r.Body).Decode(&records); err != nil {
+			t.Error(err)
+		}
+		posted = append(posted, records...)
+	}))
+	defer srv.Close()
+
+	a := newAccountant(ctx, Accounting{Webhook: srv.URL, Interval: caddy.Duration(time.Hour)}, "retry")
+	a.add("alice", false, 1000, 0)
+	a.flush()
+
+	// The records of a failed interval go out with those of the next, even
+	// from the accountant of a reloaded config
+	a.close()
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	a = newAccountant(ctx, Accounting{Webhook: srv.URL, Interval: caddy.Duration(time.Hour)}, "retry")
+	defer a.close()
+	a.add("bob", false, 2000, 0)
+	a.flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	var keys []string
+	for _, r := range posted {
+		keys = append(keys, r.Key)
+	}
+	if len(keys) != 2 || keys[0] != "alice" || keys[1] != "bob" {
+		t.Errorf("webhook got records of %v, want [alice bob]", keys)
+	}
+}
+
+func TestAccountingCloseDoesNotWait(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	a := newAccountant(ctx, Accounting{Webhook: srv.URL, Interval: caddy.Duration(time.Hour)}, "close")
+	a.add("alice", false, 1000, 0)
+	closed := make(chan struct{})
+	go func() {
+		a.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close waited for a hung webhook")
+	}
+}
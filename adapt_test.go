@@ -0,0 +1,71 @@
+package bandwidth
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddytest"
+	_ "github.com/caddyserver/caddy/v2/modules/standard"
+)
+
+func TestCaddyfileAdapt(t *testing.T) {
+	caddytest.AssertAdapt(t, `:8080 {
+	route {
+		bandwidth {
+			limit 1MB
+			key {http.request.remote.host}
+			upload_limit 256KB
+			status_limits {
+				3xx off
+				206 512KB
+			}
+			trailers
+		}
+		bandwidth_test 10485760
+	}
+}
+`, "caddyfile", `{
+	"apps": {
+		"http": {
+			"servers": {
+				"srv0": {
+					"listen": [
+						":8080"
+					],
+					"routes": [
+						{
+							"handle": [
+								{
+									"handler": "subroute",
+									"routes": [
+										{
+											"handle": [
+												{
+													"handler": "bandwidth",
+													"key": "{http.request.remote.host}",
+													"limit": 1000000,
+													"status_limits": {
+														"206": 512000,
+														"3xx": 0
+													},
+													"trailers": {
+														"server_timing": true
+													},
+													"upload_limit": 256000
+												},
+												{
+													"handler": "bandwidth_test",
+													"size": 10485760
+												}
+											]
+										}
+									]
+								}
+							]
+						}
+					]
+				}
+			}
+		}
+	}
+}`)
+}
@@ -0,0 +1,162 @@
+package bandwidth
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// Adaptive lowers per-client limits while the server is under load, for
+// graceful degradation during traffic spikes. Load is measured by the
+// module itself, across all throttled responses in the process: their
+// combined egress rate and how many are active. Once either exceeds its
+// high watermark, limits are scaled by Factor; they are restored once
+// both fall below their low watermarks.
+type Adaptive struct {
+	// EgressHigh is the egress rate in bytes per second above which
+	// limits are lowered. 0 disables the egress signal.
+	EgressHigh float64 `json:"egress_high,omitempty"`
+
+	// EgressLow is the egress rate below which limits are restored.
+	// Defaults to 80% of EgressHigh.
+	EgressLow float64 `json:"egress_low,omitempty"`
+
+	// StreamsHigh is the number of active throttled responses above which
+	// limits are lowered. 0 disables the stream signal.
+	StreamsHigh int `json:"streams_high,omitempty"`
+
+	// StreamsLow is the number of active responses below which limits are
+	// restored. Defaults to 80% of StreamsHigh.
+	StreamsLow int `json:"streams_low,omitempty"`
+
+	// Factor scales limits while under load. Defaults to 0.5.
+	Factor float64 `json:"factor,omitempty"`
+
+	// Interval is how often load is sampled. Defaults to 1s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+}
+
+const (
+	defaultAdaptiveFactor   = 0.5
+	defaultAdaptiveInterval = time.Second
+)
+
+func (a *Adaptive) provision() error {
+	if a.EgressHigh < 0 || a.EgressLow < 0 || a.StreamsHigh < 0 || a.StreamsLow < 0 {
+		return fmt.Errorf("watermarks must not be negative")
+	}
+	if a.EgressHigh == 0 && a.StreamsHigh == 0 {
+		return fmt.Errorf("an egress or streams watermark is required")
+	}
+	if a.EgressLow == 0 {
+		a.EgressLow = 0.8 * a.EgressHigh
+	}
+	if a.StreamsLow == 0 {
+		a.StreamsLow = a.StreamsHigh * 4 / 5
+	}
+	if a.EgressLow > a.EgressHigh || a.StreamsLow > a.StreamsHigh {
+		return fmt.Errorf("low watermarks must not exceed high watermarks")
+	}
+	if a.Factor == 0 {
+		a.Factor = defaultAdaptiveFactor
+	}
+	if a.Factor < 0 || a.Factor > 1 {
+		return fmt.Errorf("factor must be between 0 and 1")
+	}
+	if a.Interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	if a.Interval == 0 {
+		a.Interval = caddy.Duration(defaultAdaptiveInterval)
+	}
+	return nil
+}
+
+// overloaded reports whether the load exceeds a high watermark.
+func (a *Adaptive) overloaded(egress float64, streams int) bool {
+	return (a.EgressHigh > 0 && egress > a.EgressHigh) ||
+		(a.StreamsHigh > 0 && streams > a.StreamsHigh)
+}
+
+// relieved reports whether the load is below every low watermark.
+func (a *Adaptive) relieved(egress float64, streams int) bool {
+	return (a.EgressHigh == 0 || egress < a.EgressLow) &&
+		(a.StreamsHigh == 0 || streams < a.StreamsLow)
+}
+
+// loadMonitor samples the load periodically and decides whether limits
+// are lowered. It lives in the handler's state, so that the decision
+// carries over config reloads.
+type loadMonitor struct {
+	cfg      Adaptive
+	logger   *zap.Logger
+	degraded atomic.Bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newLoadMonitor(ctx caddy.Context, cfg Adaptive) *loadMonitor {
+	lm := &loadMonitor{
+		cfg:    cfg,
+		logger: ctx.Logger().Named("adaptive"),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go lm.run()
+	return lm
+}
+
+// scale returns limit as lowered under load. A limit of 0 means the
+// request is not throttled and is left alone.
+func (lm *loadMonitor) scale(limit float64) float64 {
+	if !lm.degraded.Load() || limit <= 0 {
+		return limit
+	}
+	return max(limit*lm.cfg.Factor, 1)
+}
+
+func (lm *loadMonitor) run() {
+	defer close(lm.done)
+	ticker := time.NewTicker(time.Duration(lm.cfg.Interval))
+	defer ticker.Stop()
+	lastBytes, _ := stats.load()
+	lastTime := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			bytes, streams := stats.load()
+			egress := float64(bytes-lastBytes) / now.Sub(lastTime).Seconds()
+			lastBytes, lastTime = bytes, now
+			lm.update(egress, streams)
+		case <-lm.stop:
+			return
+		}
+	}
+}
+
+// update lowers or restores limits according to the latest sample.
+func (lm *loadMonitor) update(egress float64, streams int) {
+	switch {
+	case !lm.degraded.Load() && lm.cfg.overloaded(egress, streams):
+		lm.degraded.Store(true)
+		lm.logger.Warn("server under load, lowering limits",
+			zap.Float64("egress", egress),
+			zap.Int("streams", streams),
+			zap.Float64("factor", lm.cfg.Factor))
+	case lm.degraded.Load() && lm.cfg.relieved(egress, streams):
+		lm.degraded.Store(false)
+		lm.logger.Info("load subsided, restoring limits",
+			zap.Float64("egress", egress),
+			zap.Int("streams", streams))
+	}
+}
+
+// close stops sampling.
+func (lm *loadMonitor) close() {
+	close(lm.stop)
+	<-lm.done
+}
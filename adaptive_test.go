@@ -0,0 +1,122 @@
+package bandwidth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestAdaptiveCaddyfile(t *testing.T) {
+	var m Middleware
+	err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`bandwidth {
+		limit 1MB
+		adaptive {
+			egress 100MB 80MB
+			streams 1000
+			factor 0.25
+			interval 5s
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Adaptive{
+		EgressHigh:  100e6,
+		EgressLow:   80e6,
+		StreamsHigh: 1000,
+		Factor:      0.25,
+		Interval:    caddy.Duration(5 * time.Second),
+	}
+	if m.Adaptive == nil || *m.Adaptive != want {
+		t.Errorf("got %+v, want %+v", m.Adaptive, want)
+	}
+
+	for _, input := range []string{
+		`bandwidth {
+			adaptive {
+				egress 1MB 2MB 3MB
+			}
+		}`,
+		`bandwidth {
+			adaptive {
+				streams many
+			}
+		}`,
+		`bandwidth {
+			adaptive {
+				factor
+			}
+		}`,
+		`bandwidth {
+			adaptive {
+				cpu 80%
+			}
+		}`,
+		`bandwidth {
+			adaptive on
+		}`,
+	} {
+		var m Middleware
+		if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("%s: parsed, want an error", input)
+		}
+	}
+}
+
+func TestAdaptiveProvision(t *testing.T) {
+	a := Adaptive{EgressHigh: 1000, StreamsHigh: 10}
+	if err := a.provision(); err != nil {
+		t.Fatal(err)
+	}
+	if a.EgressLow != 800 || a.StreamsLow != 8 || a.Factor != defaultAdaptiveFactor ||
+		time.Duration(a.Interval) != defaultAdaptiveInterval {
+		t.Errorf("got defaults %+v", a)
+	}
+
+	for _, a := range []Adaptive{
+		{},
+		{EgressHigh: -1},
+		{EgressHigh: 1000, EgressLow: 2000},
+		{StreamsHigh: 10, StreamsLow: 20},
+		{StreamsHigh: 10, Factor: 2},
+		{StreamsHigh: 10, Interval: -1},
+	} {
+		if err := a.provision(); err == nil {
+			t.Errorf("%+v: provisioned, want an error", a)
+		}
+	}
+}
+
+func TestAdaptiveThrottling(t *testing.T) {
+	vc := useVirtualClock(t)
+	m, err := loadHandler(t, `{"limit": 1000, "adaptive": {"streams_high": 10, "interval": "1h"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Cleanup()
+
+	// Limits are lowered above a high watermark, and stay lowered until
+	// the load is below the low one
+	for _, tt := range []struct {
+		streams int
+		want    float64
+	}{
+		{streams: 10, want: 1000},
+		{streams: 11, want: 500},
+		{streams: 9, want: 500},
+		{streams: 7, want: 1000},
+	} {
+		m.load.update(0, tt.streams)
+		if got := m.load.scale(1000); got != tt.want {
+			t.Errorf("%d streams: got limit %v, want %v", tt.streams, got, tt.want)
+		}
+	}
+
+	m.load.update(0, 11)
+	serve(t, vc, m, requestFrom("192.0.2.1:1000"), 500)
+	if _, got := serve(t, vc, m, requestFrom("192.0.2.1:1000"), 1000); got != 2*time.Second {
+		t.Errorf("response under load took %s, want 2s", got)
+	}
+}
@@ -0,0 +1,434 @@
+package bandwidth
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI serves endpoints for inspecting and changing the settings of
+// named bandwidth handlers at runtime.
+type adminAPI struct{}
+
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.bandwidth",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/bandwidth/policies",
+			Handler: caddy.AdminHandlerFunc(a.handlePolicies),
+		},
+		{
+			Pattern: "/bandwidth/policies/",
+			Handler: caddy.AdminHandlerFunc(a.handlePolicy),
+		},
+		{
+			Pattern: "/bandwidth/overrides",
+			Handler: caddy.AdminHandlerFunc(a.handleAllOverrides),
+		},
+		{
+			Pattern: "/bandwidth/quotas",
+			Handler: caddy.AdminHandlerFunc(a.handleQuotas),
+		},
+		{
+			Pattern: "/bandwidth/stats",
+			Handler: caddy.AdminHandlerFunc(a.handleStats),
+		},
+		{
+			Pattern: "/bandwidth/dashboard",
+			Handler: caddy.AdminHandlerFunc(a.handleDashboard),
+		},
+	}
+}
+
+// handlePolicies lists all policies on GET, and applies a batch of updates
+// keyed by policy name atomically on POST.
+func (a adminAPI) handlePolicies(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return writeJSON(w, policies.all())
+	case http.MethodPost:
+		var updates map[string]policyUpdate
+		if err := decodeJSON(r, &updates); err != nil {
+			return err
+		}
+		before, after, err := policies.update(updates)
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+		}
+		audit(r, "update_policies", zap.Any("before", before), zap.Any("after", after))
+		return writeJSON(w, policies.all())
+	default:
+		return methodNotAllowed(r)
+	}
+}
+
+// handlePolicy returns a single policy on GET, and updates it on PATCH.
+// Requests for the policy's per-key overrides are passed on to
+// handleOverrides.
+func (a adminAPI) handlePolicy(w http.ResponseWriter, r *http.Request) error {
+	rest := strings.TrimPrefix(r.URL.EscapedPath(), "/bandwidth/policies/")
+	escapedName, sub, hasSub := strings.Cut(rest, "/")
+	name, err := url.PathUnescape(escapedName)
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+	if _, ok := policies.get(name); !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown policy '%s'", name),
+		}
+	}
+	if sub == "reservations" || strings.HasPrefix(sub, "reservations/") {
+		return a.handleReservations(w, r, name, sub)
+	}
+	if sub == "drain" {
+		return a.handleDrain(w, r, name)
+	}
+	if hasSub {
+		return a.handleOverrides(w, r, name, sub)
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var u policyUpdate
+		if err := decodeJSON(r, &u); err != nil {
+			return err
+		}
+		before, after, err := policies.update(map[string]policyUpdate{name: u})
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+		}
+		audit(r, "update_policy",
+			zap.String("policy", name),
+			zap.Any("before", before[name]),
+			zap.Any("after", after[name]))
+	default:
+		return methodNotAllowed(r)
+	}
+	s, _ := policies.get(name)
+	return writeJSON(w, s)
+}
+
+// handleOverrides serves the per-key overrides of a policy: GET on "keys"
+// lists them; GET, PUT and DELETE on "keys/<key>" read, set and remove a
+// single one. Keys must be path-escaped.
+func (a adminAPI) handleOverrides(w http.ResponseWriter, r *http.Request, policy, sub string) error {
+	if sub == "keys" {
+		if r.Method != http.MethodGet {
+			return methodNotAllowed(r)
+		}
+		return writeJSON(w, overrides.list(policy))
+	}
+	escapedKey, ok := strings.CutPrefix(sub, "keys/")
+	if !ok || escapedKey == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("resource not found: %v", r.URL.Path),
+		}
+	}
+	key, err := url.PathUnescape(escapedKey)
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		o, ok := overrides.get(policy, key)
+		if !ok {
+			return caddy.APIError{
+				HTTPStatus: http.StatusNotFound,
+				Err:        fmt.Errorf("no override for key '%s'", key),
+			}
+		}
+		return writeJSON(w, o)
+	case http.MethodPut:
+		var o keyOverride
+		if err := decodeJSON(r, &o); err != nil {
+			return err
+		}
+		if err := o.validate(); err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+		}
+		o.Created = time.Now().UTC()
+		prev, existed := overrides.set(policy, key, o)
+		fields := []zap.Field{zap.String("policy", policy), zap.String("key", key)}
+		if existed {
+			fields = append(fields, zap.Any("before", prev))
+		}
+		audit(r, "set_override", append(fields, zap.Any("after", o))...)
+		return writeJSON(w, o)
+	case http.MethodDelete:
+		prev, existed := overrides.remove(policy, key)
+		if !existed {
+			return caddy.APIError{
+				HTTPStatus: http.StatusNotFound,
+				Err:        fmt.Errorf("no override for key '%s'", key),
+			}
+		}
+		audit(r, "remove_override",
+			zap.String("policy", policy),
+			zap.String("key", key),
+			zap.Any("before", prev))
+		return nil
+	default:
+		return methodNotAllowed(r)
+	}
+}
+
+// handleReservations serves the capacity reservations of a policy: GET on
+// "reservations" lists them and POST makes a new one; GET and DELETE on
+// "reservations/<id>" read and cancel a single one.
+func (a adminAPI) handleReservations(w http.ResponseWriter, r *http.Request, policy, sub string) error {
+	if sub == "reservations" {
+		switch r.Method {
+		case http.MethodGet:
+			return writeJSON(w, reservations.list(policy))
+		case http.MethodPost:
+			var res reservation
+			if err := decodeJSON(r, &res); err != nil {
+				return err
+			}
+			if err := res.validate(); err != nil {
+				return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+			}
+			if res.expired(time.Now()) {
+				return caddy.APIError{
+					HTTPStatus: http.StatusBadRequest,
+					Err:        fmt.Errorf("reservation window is over"),
+				}
+			}
+			res.Created = time.Now().UTC()
+			s, _ := policies.get(policy)
+			if err := reservations.add(policy, &res, s.Limit); err != nil {
+				return caddy.APIError{HTTPStatus: http.StatusConflict, Err: err}
+			}
+			audit(r, "add_reservation", zap.String("policy", policy), zap.Any("after", res))
+			return writeJSON(w, res)
+		default:
+			return methodNotAllowed(r)
+		}
+	}
+	id := strings.TrimPrefix(sub, "reservations/")
+	switch r.Method {
+	case http.MethodGet:
+		res, ok := reservations.get(policy, id)
+		if !ok {
+			return caddy.APIError{
+				HTTPStatus: http.StatusNotFound,
+				Err:        fmt.Errorf("no reservation '%s'", id),
+			}
+		}
+		return writeJSON(w, res)
+	case http.MethodDelete:
+		prev, ok := reservations.remove(policy, id)
+		if !ok {
+			return caddy.APIError{
+				HTTPStatus: http.StatusNotFound,
+				Err:        fmt.Errorf("no reservation '%s'", id),
+			}
+		}
+		audit(r, "remove_reservation", zap.String("policy", policy), zap.Any("before", prev))
+		return nil
+	default:
+		return methodNotAllowed(r)
+	}
+}
+
+// handleDrain puts a policy in drain mode on POST, with the fallback for
+// new requests given in the optional body and defaulting to
+// "unthrottled", and resumes normal shaping on DELETE.
+func (a adminAPI) handleDrain(w http.ResponseWriter, r *http.Request, policy string) error {
+	var drain struct {
+		Fallback string `json:"fallback,omitempty"`
+	}
+	switch r.Method {
+	case http.MethodPost:
+		if r.ContentLength != 0 {
+			if err := decodeJSON(r, &drain); err != nil {
+				return err
+			}
+		}
+		if drain.Fallback == "" {
+			drain.Fallback = drainUnthrottled
+		}
+	case http.MethodDelete:
+	default:
+		return methodNotAllowed(r)
+	}
+	before, after, err := policies.update(map[string]policyUpdate{policy: {Drain: &drain.Fallback}})
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+	action := "drain_policy"
+	if r.Method == http.MethodDelete {
+		action = "resume_policy"
+	}
+	audit(r, action,
+		zap.String("policy", policy),
+		zap.Any("before", before[policy]),
+		zap.Any("after", after[policy]))
+	return writeJSON(w, after[policy])
+}
+
+// handleAllOverrides exports the per-key overrides of all policies on GET,
+// and imports a batch in the same format on POST, so that overrides can be
+// backed up or migrated between instances. Imports are validated as a
+// whole: if any override is invalid or names an unknown policy, nothing is
+// changed. By default, imported overrides are merged into the existing
+// ones; with "?mode=replace", they replace all existing overrides.
+func (a adminAPI) handleAllOverrides(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return writeJSON(w, overrides.all())
+	case http.MethodPost:
+		var merge bool
+		switch mode := r.URL.Query().Get("mode"); mode {
+		case "", "merge":
+			merge = true
+		case "replace":
+		default:
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("unknown import mode '%s'", mode),
+			}
+		}
+		var batch map[string]map[string]keyOverride
+		if err := decodeJSON(r, &batch); err != nil {
+			return err
+		}
+		for policy, byKey := range batch {
+			if _, ok := policies.get(policy); !ok {
+				return caddy.APIError{
+					HTTPStatus: http.StatusBadRequest,
+					Err:        fmt.Errorf("unknown policy '%s'", policy),
+				}
+			}
+			for key, o := range byKey {
+				if err := o.validate(); err != nil {
+					return caddy.APIError{
+						HTTPStatus: http.StatusBadRequest,
+						Err:        fmt.Errorf("policy '%s', key '%s': %v", policy, key, err),
+					}
+				}
+			}
+		}
+		before := overrides.load(batch, merge)
+		after := overrides.all()
+		audit(r, "import_overrides",
+			zap.Bool("merge", merge),
+			zap.Any("before", before),
+			zap.Any("after", after))
+		return writeJSON(w, after)
+	default:
+		return methodNotAllowed(r)
+	}
+}
+
+// handleQuotas exports the quota state of the keys of all policies on GET,
+// and imports a batch in the same format on POST, so that quotas can be
+// carried over to another instance along with the overrides. Imports are
+// validated as a whole: if any state is invalid or names an unknown
+// policy, nothing is changed.
+func (a adminAPI) handleQuotas(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return writeJSON(w, exportQuotas())
+	case http.MethodPost:
+		var batch map[string]map[string]quotaState
+		if err := decodeJSON(r, &batch); err != nil {
+			return err
+		}
+		for policy, byKey := range batch {
+			if _, ok := policies.get(policy); !ok {
+				return caddy.APIError{
+					HTTPStatus: http.StatusBadRequest,
+					Err:        fmt.Errorf("unknown policy '%s'", policy),
+				}
+			}
+			for key, s := range byKey {
+				if err := s.validate(); err != nil {
+					return caddy.APIError{
+						HTTPStatus: http.StatusBadRequest,
+						Err:        fmt.Errorf("policy '%s', key '%s': %v", policy, key, err),
+					}
+				}
+			}
+		}
+		importQuotas(batch)
+		audit(r, "import_quotas", zap.Any("quotas", batch))
+		return writeJSON(w, exportQuotas())
+	default:
+		return methodNotAllowed(r)
+	}
+}
+
+// handleStats returns the active transfers, cumulative bytes sent per
+// policy, the busiest keys and the quotas spent the most.
+func (a adminAPI) handleStats(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return methodNotAllowed(r)
+	}
+	snap := stats.snapshot()
+	snap.Quotas = quotaStatuses(maxTopKeys)
+	return writeJSON(w, snap)
+}
+
+// dashboardHTML is a self-contained page visualizing the stats and
+// policies endpoints.
+//
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+func (a adminAPI) handleDashboard(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return methodNotAllowed(r)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	_, err := w.Write(dashboardHTML)
+	return err
+}
+
+func decodeJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("decoding request body: %v", err),
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+func methodNotAllowed(r *http.Request) error {
+	return caddy.APIError{
+		HTTPStatus: http.StatusMethodNotAllowed,
+		Err:        fmt.Errorf("method not allowed: %v", r.Method),
+	}
+}
+
+// Interface guards
+var _ caddy.AdminRouter = (*adminAPI)(nil)
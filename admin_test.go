@@ -0,0 +1,243 @@
+package bandwidth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// adminDo sends a request to the admin API and returns the status and
+// body of its response.
+func adminDo(t *testing.T, method, target string, body any) (int, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Route like the admin server's mux: by the longest matching pattern
+	path, _, _ := strings.Cut(target, "?")
+	var route caddy.AdminRoute
+	for _, rt := range (adminAPI{}).Routes() {
+		match := rt.Pattern == path || strings.HasSuffix(rt.Pattern, "/") && strings.HasPrefix(path, rt.Pattern)
+		if match && len(rt.Pattern) > len(route.Pattern) {
+			route = rt
+		}
+	}
+	if route.Handler == nil {
+		t.Fatalf("no route for %s", path)
+	}
+	r := httptest.NewRequest(method, target, &buf)
+	w := httptest.NewRecorder()
+	if err := route.Handler.ServeHTTP(w, r); err != nil {
+		apiErr, ok := err.(caddy.APIError)
+		if !ok {
+			t.Fatalf("%s %s: %v", method, target, err)
+		}
+		return apiErr.HTTPStatus, []byte(apiErr.Err.Error())
+	}
+	return http.StatusOK, w.Body.Bytes()
+}
+
+func TestAdminReservations(t *testing.T) {
+	vc := useVirtualClock(t)
+	m, err := loadHandler(t, `{"name": "reservations", "limit": 1000}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Cleanup()
+	const path = "/bandwidth/policies/reservations/reservations"
+	now := time.Now()
+	window := func(res map[string]any, start, end time.Duration) map[string]any {
+		res["start"], res["end"] = now.Add(start), now.Add(end)
+		return res
+	}
+
+	status, body := adminDo(t, http.MethodPost, path,
+		window(map[string]any{"key": "192.0.2.9", "limit": 400}, -time.Minute, time.Hour))
+	if status != http.StatusOK {
+		t.Fatalf("adding a reservation: %d %s", status, body)
+	}
+	var res reservation
+	if err := json.Unmarshal(body, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.ID == "" {
+		t.Fatal("reservation was not assigned an ID")
+	}
+
+	for _, tt := range []struct {
+		method string
+		path   string
+		body   any
+		want   int
+	}{
+		{method: http.MethodPost, path: path, body: window(map[string]any{"limit": 100}, 0, time.Hour), want: http.StatusBadRequest},
+		{method: http.MethodPost, path: path, body: window(map[string]any{"key": "a"}, 0, time.Hour), want: http.StatusBadRequest},
+		{method: http.MethodPost, path: path, body: window(map[string]any{"key": "a", "limit": 100}, time.Hour, 0), want: http.StatusBadRequest},
+		{method: http.MethodPost, path: path, body: window(map[string]any{"key": "a", "limit": 100}, -2 * time.Hour, -time.Hour), want: http.StatusBadRequest},
+		{method: http.MethodPost, path: path, body: map[string]any{"key": "a", "limit": 100, "size": 1}, want: http.StatusBadRequest},
+		// Together with the first, it would take up the whole limit
+		{method: http.MethodPost, path: path, body: window(map[string]any{"key": "a", "limit": 600}, time.Minute, 2 * time.Hour), want: http.StatusConflict},
+		{method: http.MethodPut, path: path, want: http.StatusMethodNotAllowed},
+		{method: http.MethodGet, path: path + "/unknown", want: http.StatusNotFound},
+		{method: http.MethodGet, path: "/bandwidth/policies/unknown/reservations", want: http.StatusNotFound},
+	} {
+		if status, body := adminDo(t, tt.method, tt.path, tt.body); status != tt.want {
+			t.Errorf("%s %s %v: got %d %s, want %d", tt.method, tt.path, tt.body, status, body, tt.want)
+		}
+	}
+
+	var list []reservation
+	status, body = adminDo(t, http.MethodGet, path, nil)
+	if err := json.Unmarshal(body, &list); status != http.StatusOK || err != nil {
+		t.Fatalf("listing reservations: %d %s", status, body)
+	}
+	if len(list) != 1 || list[0].ID != res.ID {
+		t.Fatalf("got reservations %+v, want only %s", list, res.ID)
+	}
+
+	// The key draws from its reservation, everyone else from what is left
+	if _, got := serve(t, vc, m, requestFrom("192.0.2.9:1000"), 1200); got != 2*time.Second {
+		t.Errorf("reserved key took %s, want 2s", got)
+	}
+	if _, got := serve(t, vc, m, requestFrom("192.0.2.1:1000"), 1800); got != 2*time.Second {
+		t.Errorf("other key took %s, want 2s", got)
+	}
+
+	if status, body := adminDo(t, http.MethodDelete, path+"/"+res.ID, nil); status != http.StatusOK {
+		t.Fatalf("removing the reservation: %d %s", status, body)
+	}
+	if status, _ := adminDo(t, http.MethodGet, path+"/"+res.ID, nil); status != http.StatusNotFound {
+		t.Errorf("got %d for a removed reservation, want 404", status)
+	}
+	if _, got := serve(t, vc, m, requestFrom("192.0.2.1:1000"), 3000); got != 3*time.Second {
+		t.Errorf("other key took %s after the reservation was removed, want 3s", got)
+	}
+}
+
+// requestBy returns a request of the given user, for handlers keyed by
+// the X-User header.
+func requestBy(user string) *http.Request {
+	r := requestFrom("192.0.2.1:1000")
+	r.Header.Set("X-User", user)
+	return r
+}
+
+func TestAdminOverridesExportImport(t *testing.T) {
+	vc := useVirtualClock(t)
+	m, err := loadHandler(t, `{"name": "transfer", "limit": 1000, "key": "{http.request.header.X-User}"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Cleanup()
+	defer adminDo(t, http.MethodPost, "/bandwidth/overrides?mode=replace", map[string]any{})
+
+	export := func() map[string]map[string]keyOverride {
+		t.Helper()
+		status, body := adminDo(t, http.MethodGet, "/bandwidth/overrides", nil)
+		var all map[string]map[string]keyOverride
+		if err := json.Unmarshal(body, &all); status != http.StatusOK || err != nil {
+			t.Fatalf("exporting overrides: %d %s", status, body)
+		}
+		return all
+	}
+	if status, body := adminDo(t, http.MethodPost, "/bandwidth/overrides", map[string]any{
+		"transfer": map[string]any{"alice": map[string]any{"limit": 500}, "bob": map[string]any{"limit": 2000}},
+	}); status != http.StatusOK {
+		t.Fatalf("importing overrides: %d %s", status, body)
+	}
+
+	// Invalid batches are rejected as a whole
+	for _, tt := range []struct {
+		path  string
+		batch any
+	}{
+		{path: "/bandwidth/overrides", batch: map[string]any{
+			"transfer": map[string]any{"carol": map[string]any{"limit": 100}},
+			"unknown":  map[string]any{"dave": map[string]any{"limit": 100}},
+		}},
+		{path: "/bandwidth/overrides", batch: map[string]any{
+			"transfer": map[string]any{"carol": map[string]any{"limit": -1}},
+		}},
+		{path: "/bandwidth/overrides?mode=append", batch: map[string]any{}},
+	} {
+		if status, _ := adminDo(t, http.MethodPost, tt.path, tt.batch); status != http.StatusBadRequest {
+			t.Errorf("%s %v: got %d, want 400", tt.path, tt.batch, status)
+		}
+	}
+	all := export()
+	if got := all["transfer"]; len(got) != 2 || got["alice"].Limit != 500 || got["bob"].Limit != 2000 {
+		t.Errorf("got overrides %+v after failed imports, want alice and bob", got)
+	}
+
+	if _, got := serve(t, vc, m, requestBy("alice"), 1500); got != 2*time.Second {
+		t.Errorf("overridden key took %s, want 2s", got)
+	}
+
+	// An export imported with "replace" is all that is left
+	delete(all["transfer"], "bob")
+	if status, body := adminDo(t, http.MethodPost, "/bandwidth/overrides?mode=replace", all); status != http.StatusOK {
+		t.Fatalf("replacing overrides: %d %s", status, body)
+	}
+	if got := export()["transfer"]; len(got) != 1 || got["alice"].Limit != 500 {
+		t.Errorf("got overrides %+v after replacing them, want alice only", got)
+	}
+}
+
+func TestAdminQuotasExportImport(t *testing.T) {
+	vc := useVirtualClock(t)
+	m, err := loadHandler(t, `{"name": "quotas", "limit": 10000, "key": "{http.request.header.X-User}",
+		"average_limit": 1000, "average_window": "10s"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Cleanup()
+
+	// alice spends 4000 of the budget of 10000 bytes
+	serve(t, vc, m, requestBy("alice"), 4000)
+	export := func() map[string]quotaState {
+		t.Helper()
+		status, body := adminDo(t, http.MethodGet, "/bandwidth/quotas", nil)
+		var all map[string]map[string]quotaState
+		if err := json.Unmarshal(body, &all); status != http.StatusOK || err != nil {
+			t.Fatalf("exporting quotas: %d %s", status, body)
+		}
+		return all["quotas"]
+	}
+	if got := export(); got["alice"].Spent != 4000 {
+		t.Fatalf("got quotas %+v, want alice to have spent 4000", got)
+	}
+
+	for _, batch := range []any{
+		map[string]any{"unknown": map[string]any{"bob": map[string]any{"spent": 1000}}},
+		map[string]any{"quotas": map[string]any{"bob": map[string]any{"spent": -1}}},
+	} {
+		if status, _ := adminDo(t, http.MethodPost, "/bandwidth/quotas", batch); status != http.StatusBadRequest {
+			t.Errorf("%v: got %d, want 400", batch, status)
+		}
+	}
+
+	// Imports spend budgets, as on the instance they were exported from,
+	// but never refill them
+	if status, body := adminDo(t, http.MethodPost, "/bandwidth/quotas", map[string]any{
+		"quotas": map[string]any{"alice": map[string]any{"spent": 1000}, "bob": map[string]any{"spent": 8000}},
+	}); status != http.StatusOK {
+		t.Fatalf("importing quotas: %d %s", status, body)
+	}
+	if got := export(); got["alice"].Spent != 4000 || got["bob"].Spent != 8000 {
+		t.Errorf("got quotas %+v, want alice at 4000 and bob at 8000", got)
+	}
+
+	// bob has 2000 bytes left, and gets the rest at the average
+	if _, got := serve(t, vc, m, requestBy("bob"), 4000); got != 2*time.Second {
+		t.Errorf("key with an imported quota took %s, want 2s", got)
+	}
+}
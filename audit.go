@@ -0,0 +1,51 @@
+package bandwidth
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// auditLoggerName is the name of the logger recording every runtime
+// mutation of bandwidth policies, so it can be routed to a dedicated sink
+// with a log's "include" option.
+const auditLoggerName = "bandwidth.audit"
+
+// audit records a runtime mutation made through the admin API, with the
+// actor that requested it. Callers include the affected policy and the
+// state before and after the change.
+func audit(r *http.Request, action string, fields ...zap.Field) {
+	prefix := []zap.Field{
+		zap.String("remote_addr", r.RemoteAddr),
+		zap.String("user_agent", r.UserAgent()),
+	}
+	// Any caller can claim to be anyone, so the header is only recorded
+	// next to the actor, never as it
+	if claimed := r.Header.Get("X-Actor"); claimed != "" {
+		prefix = append(prefix, zap.String("unverified_actor", claimed))
+	}
+	auditLog(action, auditActor(r), append(prefix, fields...)...)
+}
+
+// auditLog records a runtime mutation by any actor, including the
+// handler itself for automatic escalations.
+func auditLog(action, actor string, fields ...zap.Field) {
+	fields = append([]zap.Field{
+		zap.String("action", action),
+		zap.String("actor", actor),
+	}, fields...)
+	caddy.Log().Named(auditLoggerName).Info("policy mutation", fields...)
+}
+
+// auditActor identifies who made a request: the subject of the verified
+// client certificate for remote admin access, or else the remote address.
+func auditActor(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.String()
+	}
+	if r.RemoteAddr == "" {
+		return "local"
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,30 @@
+package bandwidth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuditActor(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/bandwidth/policies", nil)
+	r.RemoteAddr = "127.0.0.1:5000"
+	r.Header.Set("X-Actor", "root")
+	if got := auditActor(r); got != "127.0.0.1:5000" {
+		t.Errorf("got actor %q, want the remote address", got)
+	}
+
+	// Only a certificate the server verified identifies the caller
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "ops"}}
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if got := auditActor(r); got != "127.0.0.1:5000" {
+		t.Errorf("got actor %q from an unverified certificate", got)
+	}
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	if got := auditActor(r); got != "CN=ops" {
+		t.Errorf("got actor %q, want CN=ops", got)
+	}
+}
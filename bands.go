@@ -0,0 +1,66 @@
+package bandwidth
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SizeBand selects a limit for responses whose Content-Length falls within
+// [MinSize, MaxSize).
+type SizeBand struct {
+	// MinSize is the inclusive lower bound of the band in bytes.
+	MinSize int64 `json:"min_size,omitempty"`
+
+	// MaxSize is the exclusive upper bound of the band in bytes. The band
+	// is unbounded above when 0.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// Limit is the rate in bytes per second applied to matching responses.
+	// Matching responses are not throttled when 0.
+	Limit float64 `json:"limit,omitempty"`
+}
+
+func (b SizeBand) contains(size int64) bool {
+	return size >= b.MinSize && (b.MaxSize == 0 || size < b.MaxSize)
+}
+
+// matchBand returns the first band containing size.
+func matchBand(bands []SizeBand, size int64) (SizeBand, bool) {
+	for _, b := range bands {
+		if b.contains(size) {
+			return b, true
+		}
+	}
+	return SizeBand{}, false
+}
+
+// parseBandRange parses a size range in one of the forms "<1MB",
+// "1MB-100MB" or ">100MB" (the latter meaning 100MB and above).
+func parseBandRange(s string) (SizeBand, error) {
+	var b SizeBand
+	var err error
+	switch {
+	case strings.HasPrefix(s, "<"):
+		if b.MaxSize, err = parseBytes(s[1:]); err == nil && b.MaxSize == 0 {
+			return b, fmt.Errorf("empty size range '%s'", s)
+		}
+	case strings.HasPrefix(s, ">"):
+		b.MinSize, err = parseBytes(s[1:])
+	default:
+		lo, hi, ok := strings.Cut(s, "-")
+		if !ok {
+			return b, fmt.Errorf("invalid size range '%s'", s)
+		}
+		if b.MinSize, err = parseBytes(lo); err != nil {
+			return b, err
+		}
+		b.MaxSize, err = parseBytes(hi)
+	}
+	if err != nil {
+		return b, err
+	}
+	if b.MaxSize != 0 && b.MaxSize <= b.MinSize {
+		return b, fmt.Errorf("empty size range '%s'", s)
+	}
+	return b, nil
+}
@@ -1,13 +1,24 @@
 package bandwidth
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
 	"net/http"
+	"net/netip"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/sync/semaphore"
 	"golang.org/x/time/rate"
 )
 
@@ -17,11 +28,450 @@ func init() {
 }
 
 type Middleware struct {
-	Limit     int    `json:"limit,omitempty"`
-	LimitStr  string `json:"limit_str,omitempty"`
-	limiter   *rate.Limiter
+	// Name registers the handler as a named policy, whose limit and
+	// upload limit can be changed at runtime through the admin API.
+	// Handlers sharing a name share these settings.
+	Name string `json:"name,omitempty"`
+
+	// Pool makes handlers with the same pool name share their buckets and
+	// other state, even across server blocks, e.g. the HTTP and HTTPS
+	// variants of a site or several vhosts of one tenant. Pools are
+	// process-wide and created on first use. Handlers of a pool must agree
+	// on the settings that shape the state: name, limits, key and the
+	// per-key caps, sessions, ranges, connection and global limits,
+	// adaptive limits, external limits and accounting.
+	Pool string `json:"pool,omitempty"`
+
+	// Limit is the maximum rate in bytes per second at which responses
+	// are written. Responses are not throttled when 0.
+	Limit float64 `json:"limit,omitempty"`
+
+	// LimitStr is a limit resolved per request from placeholders, e.g. a
+	// header set by an upstream, with units such as "5MB", or "unlimited"
+	// or "off". Ignored if Limit is set. Without placeholders, it is
+	// parsed once like Limit.
+	LimitStr string `json:"limit_str,omitempty"`
+
+	// Unlimited records that the handler was explicitly configured to
+	// leave responses unthrottled, e.g. with "limit unlimited", "off" or
+	// "0" in the Caddyfile, so that it passes validation without a limit.
+	Unlimited bool `json:"unlimited,omitempty"`
+
+	// DefaultLimit is the limit applied when LimitStr does not resolve to
+	// a valid limit and OnInvalid is "default".
+	DefaultLimit float64 `json:"default_limit,omitempty"`
+
+	// OnInvalid decides what happens when LimitStr resolves to something
+	// that is not a positive number: "unlimited" serves the response
+	// without throttling, "deny" rejects the request and "default" applies
+	// DefaultLimit. Defaults to "default" if DefaultLimit is set, otherwise
+	// "unlimited".
+	OnInvalid string `json:"on_invalid,omitempty"`
+
+	// OnZero decides what happens when LimitStr resolves to 0:
+	// "unlimited" (the default) serves the response without throttling,
+	// "deny" rejects the request with 403 Forbidden and "default" applies
+	// DefaultLimit. Values of "unlimited" or "off" always lift the limit.
+	OnZero string `json:"on_zero,omitempty"`
+
+	// ExternalLimits maps keys to limits from a file or HTTP endpoint that
+	// is refreshed periodically, taking precedence over ClientCerts, Paths,
+	// Extensions, Hosts, Geo and Limit for the keys it lists.
+	ExternalLimits *ExternalLimits `json:"external_limits,omitempty"`
+
+	// ClientCerts maps SHA-256 fingerprints of TLS client certificates to
+	// limits, so that machine clients authenticating with mTLS get a rate
+	// per identity regardless of their source address. Fingerprints may be
+	// written with colons. Takes precedence over Paths, Extensions, Hosts,
+	// Geo and Limit; requests without a listed certificate fall through to
+	// those.
+	ClientCerts map[string]float64 `json:"client_certs,omitempty"`
+
+	// Paths select the limit by the request path, so that one handler can
+	// implement a whole site's policy. The first matching entry wins and
+	// takes precedence over Extensions, Hosts, Geo and Limit. Unmatched
+	// paths fall through to those.
+	Paths []PathLimit `json:"paths,omitempty"`
+
+	// Extensions maps file extensions of the request path to limits, e.g.
+	// {".mp4": 1000000, ".zip": 5000000}, for operators who think in file
+	// types rather than paths. Matching ignores case, and the longest
+	// listed extension wins, so ".tar.gz" can be set apart from ".gz".
+	// Takes precedence over Hosts, Geo and Limit; other files fall through
+	// to those.
+	Extensions map[string]float64 `json:"extensions,omitempty"`
+
+	// Hosts maps request hosts to limits, for sites serving many tenants
+	// from one handler. Entries may use a wildcard for the leftmost label,
+	// e.g. "*.example.com". A limit of 0 leaves the host unthrottled.
+	// Unlisted hosts use Limit.
+	Hosts map[string]float64 `json:"hosts,omitempty"`
+
+	// Geo selects the limit by the client's country. Host limits take
+	// precedence.
+	Geo *GeoLimits `json:"geo,omitempty"`
+
+	// Methods override the limits of requests by HTTP method, e.g.
+	// {"GET": {"limit": 2000000}, "PUT": {"upload_limit": 500000}}.
+	// Response limits of a method take precedence over Limit, but not over
+	// ExternalLimits, ClientCerts, Paths, Extensions, Hosts and Geo; upload
+	// limits replace UploadLimit.
+	Methods map[string]MethodLimit `json:"methods,omitempty"`
+
+	// SizeBands select the limit by the response's Content-Length, decided
+	// when the response header is written. The first matching band wins and
+	// is applied per response, taking precedence over Limit. Responses of
+	// unknown length or outside every band use Limit.
+	SizeBands []SizeBand `json:"size_bands,omitempty"`
+
+	// StatusLimits select the limit by the response's status code, keyed
+	// by code, e.g. "206", or class, e.g. "3xx", with codes taking
+	// precedence over classes. A limit of 0 leaves matching responses
+	// unthrottled, e.g. redirects and error pages. Decided when the
+	// response header is written, taking precedence over SizeBands and
+	// Limit; other non-zero limits are applied per response.
+	StatusLimits map[string]float64 `json:"status_limits,omitempty"`
+
+	// MinSize exempts responses smaller than this many bytes, such as HTML
+	// pages and API calls, from throttling. It is decided from the
+	// Content-Length when the header is written; if the length is unknown,
+	// the first MinSize bytes are sent unthrottled.
+	MinSize int64 `json:"min_size,omitempty"`
+
+	// HeadStart lets the first bytes of every throttled response through
+	// without waiting for tokens, so that time to first byte stays low
+	// even under small limits. Unlike MinSize, the bytes are still charged
+	// to the buckets, which later writes pay back, so aggregate shaping
+	// holds.
+	HeadStart int64 `json:"head_start,omitempty"`
+
+	// Measure is what limits are measured in when responses are encoded,
+	// e.g. compressed by the encode handler: "wire" (default) meters the
+	// bytes as this handler writes them, which are compressed if the
+	// handler runs before encode, so the same limit serves well
+	// compressible files faster; "content" meters gzip and zstd encoded
+	// responses by their estimated decoded size, so that limits reflect
+	// the logical content rate. Decoding to measure costs CPU; placing
+	// the handler after encode instead meters content for free.
+	Measure string `json:"measure,omitempty"`
+
+	// RampUp makes throttled responses start at a tenth of the limit and
+	// speed up to the full limit over this duration, so that clients
+	// opening many short connections get less than long steady downloads.
+	RampUp caddy.Duration `json:"ramp_up,omitempty"`
+
+	// RampCurve is how the rate rises during RampUp: "linear" (default)
+	// or "exponential".
+	RampCurve string `json:"ramp_curve,omitempty"`
+
+	// Algorithm is how throttled responses are paced: "token_bucket"
+	// (default) lets a response burst up to a second worth of bytes and
+	// then wait for the bucket to refill, delivering data in one-second
+	// surges; "leaky_bucket" spreads writes evenly across each second, in
+	// chunks of PacingInterval, to avoid jitter that makes audio and video
+	// players rebuffer.
+	Algorithm string `json:"algorithm,omitempty"`
+
+	// PacingInterval is the interval between writes of the leaky bucket
+	// algorithm. Defaults to 20ms.
+	PacingInterval caddy.Duration `json:"pacing_interval,omitempty"`
+
+	// Ranges makes Range requests of a client for the same resource share
+	// one warm bucket, e.g. while a video player seeks, instead of each
+	// getting a fresh per-request limiter and ramp-up. Limits shared by
+	// key or a static limit are already shared, but Ranges.Exempt still
+	// applies to them.
+	Ranges *RangeShaping `json:"ranges,omitempty"`
+
+	// Simulate adds latency and jitter to every chunk of a response on top
+	// of the limit, to emulate slow networks in development and staging.
+	// Responses are delayed even if they are not rate limited.
+	Simulate *Simulate `json:"simulate,omitempty"`
+
+	// Adaptive lowers per-client limits while the server's aggregate
+	// egress or number of active streams is above a watermark, and
+	// restores them once load falls.
+	Adaptive *Adaptive `json:"adaptive,omitempty"`
+
+	// MaxTransferTime bounds how long a throttled response may take.
+	// Responses whose Content-Length cannot be delivered in time at the
+	// limit are rejected up front with a 503 error; others are aborted once
+	// the budget runs out.
+	MaxTransferTime caddy.Duration `json:"max_transfer_time,omitempty"`
+
+	// WaitTimeout bounds how long a single chunk of a throttled response
+	// may wait for tokens, e.g. when a shared pool is starved. Responses
+	// that would wait longer fail fast with a *WaitTimeoutError, served
+	// with status 503, instead of blocking for as long as the request
+	// lives. Disabled when 0.
+	WaitTimeout caddy.Duration `json:"wait_timeout,omitempty"`
+
+	// MinEffectiveRate is the lowest acceptable average rate in bytes per
+	// second for throttled responses of known length. Like MaxTransferTime,
+	// it rejects or aborts responses that cannot be delivered at this rate.
+	MinEffectiveRate float64 `json:"min_effective_rate,omitempty"`
+
+	// AverageLimit caps the long-run average rate per key at this many
+	// bytes per second over AverageWindow, on top of the instantaneous
+	// Limit, e.g. never above 20MB/s but no more than 5MB/s on average
+	// over an hour. Requires Key.
+	AverageLimit float64 `json:"average_limit,omitempty"`
+
+	// AverageWindow is the window over which AverageLimit is enforced.
+	// Defaults to 1h.
+	AverageWindow caddy.Duration `json:"average_window,omitempty"`
+
+	// Overage lets keys overdraw the budget of AverageLimit, their quota,
+	// by a grace at a reduced rate, and optionally blocks them once that
+	// is spent too, instead of holding them to the average limit.
+	// Requires AverageLimit.
+	Overage *Overage `json:"overage,omitempty"`
+
+	// Peak and Sustained shape responses with two buckets, like the boost
+	// of cable modems: transfers may run at up to Peak bytes per second
+	// for PeakDuration, and are held to Sustained bytes per second after
+	// that, until idle time lets them boost again. This keeps page loads
+	// snappy while capping long downloads. The buckets are per key if the
+	// handler is keyed, and per response otherwise, and apply on top of
+	// Limit. Both must be set, and Sustained must be lower than Peak.
+	Peak      float64 `json:"peak,omitempty"`
+	Sustained float64 `json:"sustained,omitempty"`
+
+	// PeakDuration is how long a transfer may run at Peak once the buckets
+	// are full. Defaults to 5s.
+	PeakDuration caddy.Duration `json:"peak_duration,omitempty"`
+
+	// ConnectionLimit caps the rate of each client connection in bytes per
+	// second, shared by the requests in flight on it, e.g. multiplexed
+	// HTTP/2 streams. It is enforced together with the limit of the
+	// request's key and GlobalLimit: every write takes tokens from each
+	// applicable bucket at once.
+	ConnectionLimit float64 `json:"connection_limit,omitempty"`
+
+	// GlobalLimit caps the combined rate of all responses throttled by the
+	// handler in bytes per second, on top of their connection and key
+	// limits.
+	GlobalLimit float64 `json:"global_limit,omitempty"`
+
+	// Weight divides GlobalLimit between the keys with responses in flight
+	// in proportion to their weights while it is saturated, e.g. 4 for
+	// premium users and 1 for free ones, instead of first come, first
+	// served. Capacity that a key leaves unused goes to the others. May
+	// contain placeholders, e.g. a variable set by a matcher or map; values
+	// that are not a positive number count as 1. Requires Key and
+	// GlobalLimit.
+	Weight string `json:"weight,omitempty"`
+
+	// UploadLimit is the maximum rate in bytes per second at which request
+	// bodies are read. Uploads are not throttled when 0.
+	UploadLimit float64 `json:"upload_limit,omitempty"`
+
+	// UploadMaxSize is the maximum size of paced request bodies, in bytes,
+	// typically the same as request_body's max_size. Requests declaring a
+	// larger Content-Length are rejected before any of the body is paced,
+	// and bodies of unknown length as soon as they exceed it, with 413
+	// Request Entity Too Large and an UploadTooLargeError.
+	UploadMaxSize int64 `json:"upload_max_size,omitempty"`
+
+	// TwoWay makes request bodies and responses draw from the same token
+	// bucket at Limit, capping total throughput rather than each direction
+	// separately. Cannot be combined with UploadLimit.
+	TwoWay bool `json:"two_way,omitempty"`
+
+	// Key is a placeholder-aware string identifying which requests share
+	// state. Requests resolving to the same key draw from one token bucket
+	// and one in-flight budget, e.g. "{http.request.remote.host}".
+	Key string `json:"key,omitempty"`
+
+	// KeyCIDRv4 and KeyCIDRv6 aggregate keys that are IPv4 or IPv6
+	// addresses to networks of this prefix length, e.g. 24 and 64, so that
+	// a client rotating through the addresses of its network, such as an
+	// IPv6 /64, cannot dodge its limits. Overrides and reservations must
+	// then use the network, e.g. "2001:db8:1:2::/64". 0 keys by the full
+	// address.
+	KeyCIDRv4 int `json:"key_cidr_ipv4,omitempty"`
+	KeyCIDRv6 int `json:"key_cidr_ipv6,omitempty"`
+
+	// HashKeys replaces resolved keys, session IDs and accounting keys by
+	// a hash before they are stored, logged, exported or shown through the
+	// admin API, so that secrets used as keys, such as API tokens in
+	// {http.request.uri.query.token} or {http.bandwidth.bearer_token},
+	// never sit in memory or logs in plaintext. Overrides and reservations
+	// made through the admin API must use the hashed keys.
+	HashKeys bool `json:"hash_keys,omitempty"`
+
+	// HashSecret makes HashKeys use HMAC-SHA256 with this secret instead
+	// of plain SHA-256, so that hashes of guessable keys cannot be
+	// reversed by brute force. Supports global placeholders, e.g.
+	// "{env.BANDWIDTH_KEY_SECRET}".
+	HashSecret string `json:"hash_secret,omitempty"`
+
+	// Sessions keeps a client's bucket when its key changes within the
+	// same session, e.g. when keying by IP address and the client roams.
+	// Requires Key.
+	Sessions *Sessions `json:"sessions,omitempty"`
+
+	// MaxInflight caps the number of bytes per key that have been granted
+	// by the limiter but not yet written to the client, independent of the
+	// rate. Requires Key.
+	MaxInflight int `json:"max_inflight,omitempty"`
+
+	// EnforceAt delays enforcement of this policy until the given RFC 3339
+	// timestamp. Until then, requests that would be throttled more strictly
+	// than under PreviousLimit are served at PreviousLimit instead and get a
+	// NoticeHeader announcing the upcoming limit.
+	EnforceAt string `json:"enforce_at,omitempty"`
+
+	// PreviousLimit is the limit in effect before EnforceAt. 0 means
+	// responses were not throttled.
+	PreviousLimit float64 `json:"previous_limit,omitempty"`
+
+	// NoticeHeader is the response header announcing the upcoming limit.
+	// Defaults to "X-Bandwidth-Notice".
+	NoticeHeader string `json:"notice_header,omitempty"`
+
+	// UpstreamFeedback reports how long throttled responses spent waiting
+	// for tokens, per reverse_proxy upstream, to the bandwidth_aware load
+	// balancing policy.
+	UpstreamFeedback bool `json:"upstream_feedback,omitempty"`
+
+	// Nested selects how the handler limits responses that already pass
+	// through another bandwidth handler, e.g. one in an enclosing route:
+	// "stack" (default) throttles them again, so that they wait on each
+	// handler's buckets in turn; "compose" adds the handler's buckets to
+	// the enclosing handler's response instead, so that the outer limit
+	// is a ceiling that this handler can only lower, and every chunk waits
+	// once. Composed responses are counted, logged and accounted by the
+	// enclosing handler. Request bodies are paced by both handlers either
+	// way.
+	Nested string `json:"nested,omitempty"`
+
+	// Granularity selects what the limit applies to when the handler is
+	// neither keyed nor static: "stream" (default) gives each request,
+	// i.e. each HTTP/2 or HTTP/3 stream, its own buckets; "connection"
+	// shares them among the requests in flight on a client connection, so
+	// that a gRPC or HTTP/2 client cannot multiply its bandwidth by
+	// opening more streams. The upload limit is shared the same way.
+	// Keyed requests share the buckets of their key either way.
+	Granularity string `json:"granularity,omitempty"`
+
+	// Trailers appends HTTP trailers summarizing the throttle wait and
+	// delivery rate of each throttled response.
+	Trailers *SummaryTrailers `json:"trailers,omitempty"`
+
+	// Priority classifies requests as "high", "normal" or "low". When the
+	// pool of a shared limit or key is saturated, waiting requests of
+	// higher classes get tokens first. May contain placeholders, e.g. a
+	// request header or a variable set by a matcher; values that are not a
+	// known class count as "normal". Has no effect on per-request limits.
+	Priority string `json:"priority,omitempty"`
+
+	// ProgressHeader enables progress reporting: each throttled response
+	// gets a token in this header, with which the client can follow the
+	// transfer through a bandwidth_progress endpoint. Disabled when empty.
+	ProgressHeader string `json:"progress_header,omitempty"`
+
+	// MaxStartsPerMinute caps how many requests per key this handler
+	// accepts per minute, to blunt scripted mass-download loops. Excess
+	// requests are rejected with 429 Too Many Requests. Requires Key.
+	MaxStartsPerMinute int `json:"max_starts_per_minute,omitempty"`
+
+	// MaxStreams caps how many throttled responses per key may be in
+	// flight at once, so that a single client cannot open dozens of
+	// simultaneous downloads. Excess requests are rejected with 429 Too
+	// Many Requests, unless StreamQueue is set. Requires Key.
+	MaxStreams int `json:"max_streams,omitempty"`
+
+	// StreamQueue makes requests exceeding MaxStreams wait up to this long
+	// for another response of the key to finish before they are rejected.
+	StreamQueue caddy.Duration `json:"stream_queue,omitempty"`
+
+	// RejectWhen rejects new requests of a key right away while the key is
+	// saturated, instead of letting them trickle. Requires Key.
+	RejectWhen *RejectWhen `json:"reject_when,omitempty"`
+
+	// ResetFlood escalates keys that repeatedly reset throttled responses
+	// before completion to reject mode. Requires Key.
+	ResetFlood *ResetFlood `json:"reset_flood,omitempty"`
+
+	// SlowClients reports, and optionally evicts, clients reading
+	// throttled responses far below their limit for too long.
+	SlowClients *SlowClients `json:"slow_clients,omitempty"`
+
+	// Accounting aggregates the bytes transferred by throttled requests
+	// per key and periodically exports them for billing. Unthrottled
+	// requests can be recorded too, see Accounting.IncludeExempt.
+	Accounting *Accounting `json:"accounting,omitempty"`
+
+	// WarmStart pre-fills the buckets of keys, when they are created, from
+	// the demand observed by Accounting in its most recent interval,
+	// instead of starting them full. A key that kept its bucket drained
+	// starts with an empty one, which smooths throttling of busy keys
+	// right after a config reload. Requires Name, Key and Accounting by
+	// the same key.
+	WarmStart bool `json:"warm_start,omitempty"`
+
+	// TrustedProxies lists the IP addresses and CIDR ranges, or
+	// "private_ranges", of internal services allowed to override the
+	// limit of a request with OverrideHeader, e.g. an auth gateway. The
+	// header is ignored on requests from other peers.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// OverrideHeader is the request header carrying the limit set by a
+	// trusted proxy, with the same units as Limit, or "unlimited" or "off".
+	// Defaults to "X-Override-Bandwidth".
+	OverrideHeader string `json:"override_header,omitempty"`
+
+	// Trace logs how the limit of every request was resolved: which
+	// sources were consulted, what each returned, and the final limit.
+	Trace bool `json:"trace,omitempty"`
+
+	// TraceSecret traces only requests carrying it in the
+	// X-Bandwidth-Trace header, and attaches the trace to the response in
+	// the same header.
+	TraceSecret string `json:"trace_secret,omitempty"`
+
+	// LogLevel enables logging of throttling decisions at the given
+	// level (debug, info, warn, error). Logging is disabled when empty.
+	LogLevel string `json:"log_level,omitempty"`
+
+	identity       string
+	policy         *policyRegistration
+	shared         *keyState // limiters shared by all requests of an unkeyed handler
+	keys           *keyRegistry
+	ranges         *keyRegistry // buckets shared by Range requests, see Ranges
+	conns          *keyRegistry // buckets of client connections, see ConnectionLimit
+	streams        *keyRegistry // buckets shared by a connection's streams, see Granularity
+	global         *rate.Limiter
+	weighted       *weightedPool // shares of keys in global, see Weight
+	external       *externalLimits
+	hashSecret     []byte
+	load           *loadMonitor
+	accounting     *accountant
+	enforceAt      time.Time
+	trustedProxies []netip.Prefix
+	metrics        *metrics
+	events         *caddyevents.App
+	ctx            caddy.Context
+	logger         *zap.Logger
+	logLevel       zapcore.Level
+	logDecisions   bool
 }
 
+// Policies for handling limits that fail to resolve.
+const (
+	onInvalidUnlimited = "unlimited"
+	onInvalidDeny      = "deny"
+	onInvalidDefault   = "default"
+)
+
+// Policies for handling limits that resolve to 0.
+const (
+	onZeroUnlimited = "unlimited"
+	onZeroDeny      = "deny"
+	onZeroDefault   = "default"
+)
+
 func (Middleware) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID:  "http.handlers.bandwidth",
@@ -29,71 +479,1132 @@ func (Middleware) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-func (m *Middleware) Provision(ctx caddy.Context) error {
-	// If LimitStr is set (potentially containing placeholders), we'll resolve it at request time
-	// If Limit is set directly, we can create the limiter now
-	if m.Limit > 0 && m.LimitStr == "" {
-		m.limiter = rate.NewLimiter(rate.Limit(m.Limit), m.Limit)
+func (m *Middleware) Provision(ctx caddy.Context) error {
+	// Identify the handler by its configuration as given, before defaults
+	// are filled in
+	config, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("encoding config: %v", err)
+	}
+	m.identity = handlerIdentity(ctx, config)
+	if m.Pool != "" {
+		config, err := json.Marshal(m.poolConfig())
+		if err != nil {
+			return fmt.Errorf("encoding pool config: %v", err)
+		}
+		if m.identity, err = poolIdentity(ctx, m.Pool, config); err != nil {
+			return err
+		}
+	}
+
+	m.logger = ctx.Logger()
+	m.ctx = ctx
+	m.metrics = newMetrics(ctx)
+	if m.LogLevel != "" {
+		level, err := zapcore.ParseLevel(m.LogLevel)
+		if err != nil {
+			return fmt.Errorf("parsing log_level: %v", err)
+		}
+		m.logLevel = level
+		m.logDecisions = true
+	}
+
+	if m.OnInvalid == "" {
+		m.OnInvalid = onInvalidUnlimited
+		if m.DefaultLimit > 0 {
+			m.OnInvalid = onInvalidDefault
+		}
+	}
+	switch m.OnInvalid {
+	case onInvalidUnlimited, onInvalidDeny:
+	case onInvalidDefault:
+		if m.DefaultLimit <= 0 {
+			return fmt.Errorf("on_invalid %s requires a positive default_limit", onInvalidDefault)
+		}
+	default:
+		return fmt.Errorf("unrecognized on_invalid policy '%s'", m.OnInvalid)
+	}
+	switch m.OnZero {
+	case "":
+		m.OnZero = onZeroUnlimited
+	case onZeroUnlimited, onZeroDeny:
+	case onZeroDefault:
+		if m.DefaultLimit <= 0 {
+			return fmt.Errorf("on_zero %s requires a positive default_limit", onZeroDefault)
+		}
+	default:
+		return fmt.Errorf("unrecognized on_zero policy '%s'", m.OnZero)
+	}
+
+	if err := checkPlaceholders(m.LimitStr); err != nil {
+		return fmt.Errorf("limit_str: %v", err)
+	}
+	if m.LimitStr != "" && !containsPlaceholders(m.LimitStr) && m.Limit == 0 {
+		limit, err := parseLimit(m.LimitStr)
+		if err != nil {
+			return fmt.Errorf("parsing limit_str: %v", err)
+		}
+		m.Limit, m.LimitStr = limit, ""
+		m.Unlimited = m.Unlimited || limit == 0
+	}
+
+	if m.EnforceAt != "" {
+		var err error
+		m.enforceAt, err = time.Parse(time.RFC3339, m.EnforceAt)
+		if err != nil {
+			return fmt.Errorf("parsing enforce_at: %v", err)
+		}
+	}
+	if m.PreviousLimit < 0 {
+		return fmt.Errorf("previous_limit must not be negative")
+	}
+	if !containsPlaceholders(m.Priority) {
+		if _, err := parsePriority(m.Priority); err != nil {
+			return fmt.Errorf("priority: %v", err)
+		}
+	}
+	if len(m.TrustedProxies) > 0 {
+		var err error
+		m.trustedProxies, err = parseTrustedProxies(m.TrustedProxies)
+		if err != nil {
+			return fmt.Errorf("trusted_proxies: %v", err)
+		}
+	}
+	if m.OverrideHeader == "" {
+		m.OverrideHeader = defaultOverrideHeader
+	}
+	if m.NoticeHeader == "" {
+		m.NoticeHeader = "X-Bandwidth-Notice"
+	}
+	if m.MinSize < 0 {
+		return fmt.Errorf("min_size must not be negative")
+	}
+	if m.HeadStart < 0 {
+		return fmt.Errorf("head_start must not be negative")
+	}
+	if m.RampUp < 0 {
+		return fmt.Errorf("ramp_up must not be negative")
+	}
+	switch m.Measure {
+	case "":
+		m.Measure = measureWire
+	case measureWire, measureContent:
+	default:
+		return fmt.Errorf("unrecognized measure '%s'", m.Measure)
+	}
+	switch m.Nested {
+	case "":
+		m.Nested = nestedStack
+	case nestedStack, nestedCompose:
+	default:
+		return fmt.Errorf("unrecognized nested mode '%s'", m.Nested)
+	}
+	switch m.Granularity {
+	case "":
+		m.Granularity = granularityStream
+	case granularityStream, granularityConnection:
+	default:
+		return fmt.Errorf("unrecognized granularity '%s'", m.Granularity)
+	}
+	switch m.Algorithm {
+	case "":
+		m.Algorithm = algorithmTokenBucket
+	case algorithmTokenBucket, algorithmLeakyBucket:
+	default:
+		return fmt.Errorf("unrecognized algorithm '%s'", m.Algorithm)
+	}
+	if m.PacingInterval < 0 {
+		return fmt.Errorf("pacing_interval must not be negative")
+	}
+	if m.PacingInterval == 0 {
+		m.PacingInterval = caddy.Duration(defaultPacingInterval)
+	}
+	switch m.RampCurve {
+	case "":
+		m.RampCurve = rampLinear
+	case rampLinear, rampExponential:
+	default:
+		return fmt.Errorf("unrecognized ramp_curve '%s'", m.RampCurve)
+	}
+	if m.Ranges != nil {
+		if err := m.Ranges.provision(); err != nil {
+			return fmt.Errorf("ranges: %v", err)
+		}
+	}
+	if m.Simulate != nil {
+		if err := m.Simulate.provision(); err != nil {
+			return fmt.Errorf("simulate: %v", err)
+		}
+	}
+	if m.Trailers != nil {
+		if err := m.Trailers.provision(); err != nil {
+			return fmt.Errorf("trailers: %v", err)
+		}
+	}
+	if m.HashSecret != "" {
+		if !m.HashKeys {
+			return fmt.Errorf("hash_secret requires hash_keys")
+		}
+		m.hashSecret = []byte(caddy.NewReplacer().ReplaceAll(m.HashSecret, ""))
+	}
+	if m.Adaptive != nil {
+		if err := m.Adaptive.provision(); err != nil {
+			return fmt.Errorf("adaptive: %v", err)
+		}
+	}
+	if m.MaxTransferTime < 0 || m.MinEffectiveRate < 0 {
+		return fmt.Errorf("max_transfer_time and min_effective_rate must not be negative")
+	}
+	if m.WaitTimeout < 0 {
+		return fmt.Errorf("wait_timeout must not be negative")
+	}
+	if m.ConnectionLimit < 0 || m.GlobalLimit < 0 {
+		return fmt.Errorf("connection_limit and global_limit must not be negative")
+	}
+	if m.Weight != "" {
+		if m.Key == "" || m.GlobalLimit == 0 {
+			return fmt.Errorf("weight requires a key and global_limit")
+		}
+		if !containsPlaceholders(m.Weight) {
+			if _, err := parseWeight(m.Weight); err != nil {
+				return err
+			}
+		}
+	}
+	if m.UploadLimit < 0 {
+		return fmt.Errorf("upload_limit must not be negative")
+	}
+	if m.UploadMaxSize < 0 {
+		return fmt.Errorf("upload_max_size must not be negative")
+	}
+	if m.TwoWay && m.UploadLimit > 0 {
+		return fmt.Errorf("upload_limit cannot be combined with two_way")
+	}
+	if len(m.ClientCerts) > 0 {
+		certs := make(map[string]float64, len(m.ClientCerts))
+		for fp, limit := range m.ClientCerts {
+			normalized, err := normalizeFingerprint(fp)
+			if err != nil {
+				return fmt.Errorf("client_certs: %v", err)
+			}
+			if limit < 0 {
+				return fmt.Errorf("limit for client certificate '%s' must not be negative", fp)
+			}
+			certs[normalized] = limit
+		}
+		m.ClientCerts = certs
+	}
+	for i := range m.Paths {
+		if err := m.Paths[i].provision(ctx); err != nil {
+			return fmt.Errorf("paths: %v", err)
+		}
+	}
+	if len(m.Extensions) > 0 {
+		exts, err := normalizeExtensions(m.Extensions)
+		if err != nil {
+			return fmt.Errorf("extensions: %v", err)
+		}
+		m.Extensions = exts
+	}
+	if len(m.Hosts) > 0 {
+		hosts := make(map[string]float64, len(m.Hosts))
+		for host, limit := range m.Hosts {
+			if limit < 0 {
+				return fmt.Errorf("limit for host '%s' must not be negative", host)
+			}
+			hosts[strings.ToLower(host)] = limit
+		}
+		m.Hosts = hosts
+	}
+	if m.Geo != nil {
+		if m.Geo.Country == "" {
+			return fmt.Errorf("geo requires a country placeholder")
+		}
+		countries := make(map[string]float64, len(m.Geo.Countries))
+		for country, limit := range m.Geo.Countries {
+			if limit < 0 {
+				return fmt.Errorf("limit for country '%s' must not be negative", country)
+			}
+			countries[strings.ToUpper(country)] = limit
+		}
+		m.Geo.Countries = countries
+		if m.Geo.Default != nil && *m.Geo.Default < 0 {
+			return fmt.Errorf("geo default limit must not be negative")
+		}
+	}
+	if len(m.Methods) > 0 {
+		methods, err := normalizeMethods(m.Methods)
+		if err != nil {
+			return fmt.Errorf("methods: %v", err)
+		}
+		m.Methods = methods
+	}
+	if err := validateStatusLimits(m.StatusLimits); err != nil {
+		return fmt.Errorf("status_limits: %v", err)
+	}
+	for _, b := range m.SizeBands {
+		if b.MinSize < 0 || b.MaxSize < 0 || b.Limit < 0 {
+			return fmt.Errorf("size bands must not contain negative values")
+		}
+	}
+	if err := validateKeyCIDR(m.KeyCIDRv4, m.KeyCIDRv6); err != nil {
+		return err
+	}
+	if (m.KeyCIDRv4 > 0 || m.KeyCIDRv6 > 0) && m.Key == "" {
+		return fmt.Errorf("key_cidr_ipv4 and key_cidr_ipv6 require a key")
+	}
+	if m.MaxInflight < 0 {
+		return fmt.Errorf("max_inflight must not be negative")
+	}
+	if m.MaxInflight > 0 && m.Key == "" {
+		return fmt.Errorf("max_inflight requires a key")
+	}
+	if m.MaxStartsPerMinute < 0 {
+		return fmt.Errorf("max_starts_per_minute must not be negative")
+	}
+	if m.MaxStartsPerMinute > 0 && m.Key == "" {
+		return fmt.Errorf("max_starts_per_minute requires a key")
+	}
+	if m.Sessions != nil {
+		if m.Key == "" {
+			return fmt.Errorf("sessions requires a key")
+		}
+		if err := m.Sessions.provision(); err != nil {
+			return fmt.Errorf("sessions: %v", err)
+		}
+	}
+	if m.MaxStreams < 0 || m.StreamQueue < 0 {
+		return fmt.Errorf("max_streams and stream_queue must not be negative")
+	}
+	if m.MaxStreams > 0 && m.Key == "" {
+		return fmt.Errorf("max_streams requires a key")
+	}
+	if m.AverageLimit < 0 || m.AverageWindow < 0 {
+		return fmt.Errorf("average_limit and average_window must not be negative")
+	}
+	if m.AverageLimit > 0 && m.Key == "" {
+		return fmt.Errorf("average_limit requires a key")
+	}
+	if m.AverageWindow == 0 {
+		m.AverageWindow = caddy.Duration(time.Hour)
+	}
+	if m.Overage != nil {
+		if m.AverageLimit <= 0 {
+			return fmt.Errorf("overage requires average_limit")
+		}
+		if err := m.Overage.provision(m.AverageLimit); err != nil {
+			return fmt.Errorf("overage: %v", err)
+		}
+	}
+	if err := m.validatePeak(); err != nil {
+		return err
+	}
+	if m.RejectWhen != nil {
+		if m.Key == "" {
+			return fmt.Errorf("reject_when requires a key")
+		}
+		if err := m.RejectWhen.provision(); err != nil {
+			return fmt.Errorf("reject_when: %v", err)
+		}
+	}
+	var retain time.Duration
+	if m.ResetFlood != nil {
+		if m.Key == "" {
+			return fmt.Errorf("reset_flood requires a key")
+		}
+		if err := m.ResetFlood.provision(); err != nil {
+			return fmt.Errorf("reset_flood: %v", err)
+		}
+		retain = m.ResetFlood.retain()
+	}
+	if m.SlowClients != nil {
+		if err := m.SlowClients.provision(); err != nil {
+			return fmt.Errorf("slow_clients: %v", err)
+		}
+	}
+	if m.ResetFlood != nil || m.SlowClients != nil || m.ExternalLimits != nil {
+		eventsApp, err := ctx.App("events")
+		if err != nil {
+			return fmt.Errorf("getting events app: %v", err)
+		}
+		m.events = eventsApp.(*caddyevents.App)
+	}
+	if m.ExternalLimits != nil {
+		if err := m.ExternalLimits.provision(m.Key); err != nil {
+			return fmt.Errorf("external_limits: %v", err)
+		}
+	}
+	if m.Accounting != nil {
+		if err := m.Accounting.provision(m.Key); err != nil {
+			return fmt.Errorf("accounting: %v", err)
+		}
+	}
+	if m.WarmStart {
+		if m.Name == "" || m.Key == "" || m.Accounting == nil {
+			return fmt.Errorf("warm_start requires name, key and accounting")
+		}
+		if m.Accounting.Key != m.Key {
+			return fmt.Errorf("warm_start requires accounting by the handler's key")
+		}
+	}
+	// Reuse the limiter state of an identical handler from the previous
+	// config, so that in-flight and new requests keep sharing buckets
+	val, _, err := handlerStates.LoadOrNew(m.identity, func() (caddy.Destructor, error) {
+		state := &handlerState{policy: m.Name, shared: new(keyState)}
+		if m.Key != "" {
+			opts := keyOptions{
+				maxInflight:     int64(m.MaxInflight),
+				startsPerMinute: m.MaxStartsPerMinute,
+				maxStreams:      int64(m.MaxStreams),
+				avgLimit:        m.AverageLimit,
+				avgWindow:       time.Duration(m.AverageWindow),
+				peak:            m.Peak,
+				sustained:       m.Sustained,
+				peakDuration:    time.Duration(m.PeakDuration),
+				retain:          retain,
+			}
+			if m.Overage != nil {
+				opts.overageRate, opts.overageGrace = m.Overage.Rate, m.Overage.Grace
+			}
+			if m.Sessions != nil {
+				opts.sessionTTL = time.Duration(m.Sessions.TTL)
+			}
+			if m.WarmStart {
+				name := m.Name
+				opts.demand = func(key string) float64 { return demand.rate(name, key) }
+			}
+			state.keys = newKeyRegistry(opts)
+		}
+		if m.Ranges != nil {
+			state.ranges = newKeyRegistry(keyOptions{retain: time.Duration(m.Ranges.Retain)})
+		}
+		if m.ConnectionLimit > 0 {
+			state.conns = newKeyRegistry(keyOptions{})
+		}
+		if m.Granularity == granularityConnection {
+			state.streams = newKeyRegistry(keyOptions{})
+		}
+		if m.GlobalLimit > 0 {
+			state.global = newLimiter(m.GlobalLimit)
+		}
+		if m.Weight != "" {
+			state.weighted = newWeightedPool(state.global)
+		}
+		if m.Adaptive != nil {
+			state.load = newLoadMonitor(ctx, *m.Adaptive)
+		}
+		if m.ExternalLimits != nil {
+			external, err := newExternalLimits(ctx, *m.ExternalLimits, m.events)
+			if err != nil {
+				return nil, fmt.Errorf("loading external limits: %v", err)
+			}
+			state.external = external
+		}
+		if m.Accounting != nil {
+			state.accounting = newAccountant(ctx, *m.Accounting, m.Name)
+		}
+		return state, nil
+	})
+	if err != nil {
+		return err
+	}
+	state := val.(*handlerState)
+	m.shared, m.keys, m.ranges, m.accounting = state.shared, state.keys, state.ranges, state.accounting
+	m.external = state.external
+	if m.external != nil {
+		m.external.attach(ctx, m.events)
+	}
+	m.conns, m.streams, m.global, m.weighted = state.conns, state.streams, state.global, state.weighted
+	m.load = state.load
+	return nil
+}
+
+// registerPolicy registers the named policy of a provisioned handler. It
+// is the last step of loading the handler, so that a config failing
+// validation leaves the live policy alone.
+func (m *Middleware) registerPolicy() {
+	if m.Name == "" || m.shared == nil {
+		return
+	}
+	m.policy = policies.register(m.Name, policySettings{
+		Limit:       m.Limit,
+		UploadLimit: m.UploadLimit,
+	})
+}
+
+func (m *Middleware) Cleanup() error {
+	// Nothing was registered if provisioning failed early
+	if m.shared == nil {
+		return nil
+	}
+	if m.policy != nil {
+		policies.unregister(m.Name, m.policy)
+	}
+	_, err := handlerStates.Delete(m.identity)
+	return err
+}
+
+func (m Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	setBearerToken(repl, r)
+
+	// A limit set by a trusted proxy applies to this request only and
+	// takes precedence over every other source
+	limit, overridden, err := m.headerOverride(r)
+
+	settings := m.settings()
+	if settings.Drain != "" {
+		return m.serveDrained(w, r, next, repl, settings.Drain, m.startTrace(r))
+	}
+	ml, ok := m.Methods[r.Method]
+	methodUpload := ok && ml.UploadLimit != nil
+	if methodUpload {
+		settings.UploadLimit = *ml.UploadLimit
+	}
+	trace := m.startTrace(r)
+	if err != nil {
+		m.logger.Warn("ignoring invalid override header",
+			zap.String("header", m.OverrideHeader),
+			zap.Error(err))
+		trace.add("override_header", "invalid: %v", err)
+	}
+	var static bool
+	if overridden {
+		trace.add("override_header", "%s", formatLimit(limit))
+	} else {
+		limit, static, err = m.resolveLimit(r, repl, settings.Limit, trace)
+		if err != nil {
+			trace.emit(w.Header(), 0)
+			return err
+		}
+	}
+
+	// During the announcement window, keep the previous behavior for
+	// requests the new policy would throttle harder, but tell the client
+	if !overridden && m.announcing(limit) {
+		w.Header().Set(m.NoticeHeader, fmt.Sprintf("limit=%s; enforce-at=%s", formatRate(limit), m.EnforceAt))
+		m.metrics.announced.Inc()
+		m.log("announcing upcoming bandwidth limit",
+			zap.String("uri", r.RequestURI),
+			zap.Float64("limit", limit),
+			zap.Float64("previous_limit", m.PreviousLimit))
+		trace.add("enforce_at", "announcing until %s, previous_limit %s", m.EnforceAt, formatLimit(m.PreviousLimit))
+		limit = m.PreviousLimit
+	}
+
+	// Under load, limits are lowered for graceful degradation
+	if m.load != nil && !overridden {
+		if scaled := m.load.scale(limit); scaled != limit {
+			trace.add("adaptive", "lowered to %s under load", formatLimit(scaled))
+			limit = scaled
+		}
+	}
+
+	var key string
+	var limiter, uploadLimiter *rate.Limiter
+	var inflight *semaphore.Weighted
+	var sched *scheduler
+	var avgLimiter *rate.Limiter
+	var quota *quota
+	var ks *keyState
+	var warm bool // whether the limiter was used by an earlier request
+	now := time.Now()
+	var reserved float64
+	if m.Name != "" {
+		reserved = reservations.reserved(m.Name, now)
+		m.metrics.reserved.WithLabelValues(m.Name).Set(reserved)
+	}
+	switch {
+	case m.keys != nil:
+		// Requests sharing a key share their limiters and in-flight budget
+		key = m.hashKey(m.aggregateKey(repl.ReplaceAll(m.Key, "")))
+		if m.Sessions != nil {
+			if session := m.hashKey(repl.ReplaceAll(m.Sessions.ID, "")); session != "" {
+				if k := m.keys.resolveSession(session, key, m.Sessions.Link); k != key {
+					trace.add("sessions", "'%s' continues with key '%s'", session, k)
+					key = k
+				}
+			}
+		}
+		ks = m.keys.acquire(key)
+		defer m.keys.release(key)
+		trace.add("key", "'%s'", key)
+		if err := m.checkEscalated(w, ks, key); err != nil {
+			trace.add("reset_flood", "rejected")
+			trace.emit(w.Header(), limit)
+			return err
+		}
+		if err := m.checkStarts(w, ks, key); err != nil {
+			trace.add("max_starts_per_minute", "rejected")
+			trace.emit(w.Header(), limit)
+			return err
+		}
+		if err := m.checkSaturated(w, ks, key); err != nil {
+			trace.add("reject_when", "rejected")
+			trace.emit(w.Header(), limit)
+			return err
+		}
+		if err := m.checkQuota(w, ks, key); err != nil {
+			trace.add("overage", "rejected")
+			trace.emit(w.Header(), limit)
+			return err
+		}
+		if m.Name != "" && !overridden {
+			if o, ok := overrides.get(m.Name, key); ok {
+				trace.add("override", "%s", formatLimit(o.Limit))
+				limit = o.Limit
+			}
+		}
+		limiter = ks.limiterFor(limit)
+		uploadLimiter = ks.uploadLimiterFor(settings.UploadLimit)
+		inflight = ks.inflight
+		avgLimiter = ks.avgLimiter
+		quota = ks.quota
+		sched = &ks.sched
+	case static:
+		// Static limits are shared by all requests, except for capacity
+		// reserved for particular keys
+		limit = unreserved(limit, reserved)
+		limiter = m.shared.limiterFor(limit)
+		uploadLimiter = m.uploadLimiterFor(settings.UploadLimit, methodUpload)
+		sched = &m.shared.sched
+	case m.ranges != nil && isRangeRequest(r):
+		// Range requests of a client for the same resource share a
+		// bucket, which stays warm between seeks
+		rangeKey := m.Ranges.key(r, repl)
+		rs := m.ranges.acquire(rangeKey)
+		defer m.ranges.release(rangeKey)
+		trace.add("ranges", "'%s'", rangeKey)
+		limiter = rs.limiterFor(limit)
+		uploadLimiter = m.uploadLimiterFor(settings.UploadLimit, methodUpload)
+		warm = rs.markUsed()
+	case m.streams != nil:
+		// Streams multiplexed on a connection share its buckets, which
+		// stay warm while any of them is in flight
+		cs := m.streams.acquire(r.RemoteAddr)
+		defer m.streams.release(r.RemoteAddr)
+		trace.add("granularity", "connection '%s'", r.RemoteAddr)
+		limiter = cs.limiterFor(limit)
+		uploadLimiter = cs.uploadLimiterFor(settings.UploadLimit)
+		sched = &cs.sched
+		warm = cs.markUsed()
+	default:
+		// Create limiter per request
+		if limit > 0 {
+			limiter = newLimiter(limit)
+		}
+		uploadLimiter = m.uploadLimiterFor(settings.UploadLimit, methodUpload)
+	}
+	if reserved > 0 && !overridden {
+		resKey := key
+		if resKey == "" {
+			resKey = repl.ReplaceAll("{http.request.remote.host}", "")
+		}
+		if lim, resLimit := reservations.limiterFor(m.Name, resKey, now); lim != nil {
+			trace.add("reservation", "%s for key '%s'", formatLimit(resLimit), resKey)
+			limiter, limit, sched = lim, resLimit, nil
+		}
+	}
+	if m.TwoWay {
+		uploadLimiter = limiter
+	}
+
+	// The peak, connection and global tiers apply on top of the limit,
+	// unless a trusted proxy set it
+	var tiers []*rate.Limiter
+	var sustained *rate.Limiter
+	if m.Peak > 0 && !overridden {
+		var dual dualBucket
+		if ks != nil {
+			dual = ks.dual
+		} else {
+			dual = newDualBucket(m.Peak, m.Sustained, time.Duration(m.PeakDuration))
+		}
+		tiers = append(tiers, dual.peak)
+		sustained = dual.sustained
+	}
+	if m.conns != nil && !overridden {
+		cs := m.conns.acquire(r.RemoteAddr)
+		defer m.conns.release(r.RemoteAddr)
+		tiers = append(tiers, cs.limiterFor(m.ConnectionLimit))
+	}
+	if m.global != nil && !overridden {
+		tiers = append(tiers, m.global)
+	}
+	if len(tiers) > 0 {
+		limit = tieredLimit(limit, tiers)
+		trace.add("tiers", "%s", formatLimit(limit))
+	}
+
+	if limiter == nil && uploadLimiter == nil && avgLimiter == nil && sustained == nil && inflight == nil && len(tiers) == 0 && len(m.SizeBands) == 0 && len(m.StatusLimits) == 0 && m.Simulate == nil {
+		trace.emit(w.Header(), 0)
+		repl.Set(placeholderLimit, 0)
+		if m.accounting != nil && m.Accounting.IncludeExempt {
+			return m.serveExempt(w, r, next, repl)
+		}
+		return next.ServeHTTP(w, r)
+	}
+
+	if ks != nil && ks.streams != nil {
+		if err := m.acquireStream(r, ks, key); err != nil {
+			trace.add("max_streams", "rejected")
+			trace.emit(w.Header(), limit)
+			return err
+		}
+		defer ks.streams.Release(1)
+	}
+
+	var body *limitedBody
+	if uploadLimiter != nil && r.Body != nil && r.Body != http.NoBody {
+		if m.UploadMaxSize > 0 && r.ContentLength > m.UploadMaxSize {
+			trace.emit(w.Header(), limit)
+			m.log("rejecting upload exceeding maximum size",
+				zap.String("uri", r.RequestURI),
+				zap.Int64("content_length", r.ContentLength),
+				zap.Int64("upload_max_size", m.UploadMaxSize))
+			return caddyhttp.Error(http.StatusRequestEntityTooLarge,
+				&UploadTooLargeError{Limit: m.UploadMaxSize, Declared: r.ContentLength})
+		}
+		body = &limitedBody{
+			ReadCloser: r.Body,
+			limiter:    uploadLimiter,
+			ctx:        r.Context(),
+			maxSize:    m.UploadMaxSize,
+		}
+		r.Body = body
+	}
+
+	lw := &limitedResponseWriter{
+		ResponseWriter: w,
+		limiter:        limiter,
+		uploadLimiter:  uploadLimiter,
+		limit:          limit,
+		bands:          m.SizeBands,
+		statusLimits:   m.StatusLimits,
+		minSize:        m.MinSize,
+		headStart:      m.HeadStart,
+		measureContent: m.Measure == measureContent,
+		inflight:       inflight,
+		maxInflight:    m.MaxInflight,
+		avgLimiter:     avgLimiter,
+		overage:        m.Overage,
+		quota:          quota,
+		key:            key,
+		sustained:      sustained,
+		tiers:          tiers,
+		saturation:     saturationOf(ks, m.RejectWhen),
+		simulate:       m.Simulate,
+		stopped:        m.ctx.Done(),
+		trace:          trace,
+		r:              r,
+
+		maxTransferTime: time.Duration(m.MaxTransferTime),
+		waitTimeout:     time.Duration(m.WaitTimeout),
+		minRate:         m.MinEffectiveRate,
+		ctx:             r.Context(),
+	}
+	if m.Nested == nestedCompose {
+		if outer := outerWriter(w); outer != nil {
+			// Let the enclosing handler wait on our buckets too rather
+			// than throttling the response twice
+			m.log("composing bandwidth limit with enclosing handler",
+				zap.String("uri", r.RequestURI),
+				zap.String("key", key),
+				zap.Float64("limit", limit))
+			outer.compose(lw)
+			return next.ServeHTTP(w, r)
+		}
+	}
+	if m.Priority != "" && limiter != nil {
+		lw.sched = sched
+		lw.priority, err = parsePriority(repl.ReplaceAll(m.Priority, ""))
+		if err != nil {
+			m.log("invalid priority class, using normal",
+				zap.String("uri", r.RequestURI),
+				zap.Error(err))
+			lw.priority = priorityNormal
+		}
+	}
+	if m.weighted != nil && !overridden && ks != nil {
+		weight, err := parseWeight(repl.ReplaceAll(m.Weight, ""))
+		if err != nil {
+			m.log("invalid weight, using 1",
+				zap.String("uri", r.RequestURI),
+				zap.Error(err))
+			weight = 1
+		}
+		trace.add("weight", "%g", weight)
+		lw.weighted, lw.share = m.weighted, m.weighted.join(key, weight)
+		defer m.weighted.leave(key)
+	}
+	if m.Ranges != nil && isRangeRequest(r) {
+		lw.unthrottled = m.Ranges.Exempt
+	}
+	if m.Algorithm == algorithmLeakyBucket {
+		lw.pacingInterval = time.Duration(m.PacingInterval)
+	}
+	if m.RampUp > 0 && !warm {
+		lw.ramp = &ramper{duration: time.Duration(m.RampUp), curve: m.RampCurve}
+	}
+	if m.SlowClients != nil {
+		lw.slow = newSlowTracker(m.SlowClients, w)
+		lw.onSlow = func(rate float64) { m.reportSlowClient(r, key, lw.limit, rate) }
+	}
+	lw.transfer = stats.start(m.Name, key, r.RequestURI, limit)
+	defer stats.finish(lw.transfer)
+	if m.ProgressHeader != "" {
+		token, err := stats.issueToken(lw.transfer)
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("issuing progress token: %v", err))
+		}
+		w.Header().Set(m.ProgressHeader, token)
+	}
+
+	repl.Set(placeholderLimit, limit)
+	if key != "" {
+		repl.Set(placeholderKey, key)
+	}
+	m.log("applying bandwidth limit",
+		zap.String("uri", r.RequestURI),
+		zap.String("key", key),
+		zap.Float64("limit", limit))
+
+	start := clk.Now()
+	err = next.ServeHTTP(lw, r)
+	if lw.cancel != nil {
+		lw.cancel()
+	}
+	lw.content.close()
+	lw.slow.done()
+	// In case the handler did not write a response
+	trace.emit(w.Header(), lw.limit)
+	if exempt := lw.limit <= 0 && lw.avgLimiter == nil && lw.sustained == nil; m.accounting != nil && (!exempt || m.Accounting.IncludeExempt) {
+		var received int64
+		if body != nil {
+			received = body.read
+		}
+		m.accounting.add(m.accountingKey(repl), exempt, lw.written, received)
+	}
+	outcome := lw.outcome()
+	if outcome != outcomeComplete {
+		m.metrics.partial.WithLabelValues(m.Name, outcome).Inc()
+	}
+	if m.ResetFlood != nil && outcome == outcomeClientAbort {
+		m.recordReset(ks, key)
+	}
+	elapsed := clk.Now().Sub(start)
+	if m.UpstreamFeedback {
+		upstream, _ := repl.GetString("http.reverse_proxy.upstream.address")
+		upstreamStalls.observe(upstream, lw.waited, elapsed)
+	}
+
+	fields := []zap.Field{
+		zap.String("uri", r.RequestURI),
+		zap.String("key", key),
+		zap.Float64("limit", lw.limit),
+		zap.Int64("bytes_sent", lw.written),
+		zap.Duration("wait", lw.waited),
+		zap.Bool("aborted", lw.aborted),
+		zap.String("outcome", outcome),
+	}
+	if size := lw.size(); size >= 0 {
+		fields = append(fields, zap.Int64("content_length", size))
+	}
+	if lw.budgetErr != nil {
+		fields = append(fields, zap.NamedError("budget", lw.budgetErr))
+	}
+	if body != nil {
+		fields = append(fields,
+			zap.Int64("bytes_received", body.read),
+			zap.Duration("upload_wait", body.waited),
+			zap.Bool("upload_aborted", body.aborted),
+			zap.Bool("upload_rejected", body.rejected))
+	}
+	m.log("finished throttled response", fields...)
+	m.metrics.observePacing(m.Name, lw)
+	annotateSpan(r, lw, body, outcome)
+	setPlaceholders(repl, lw, body, outcome, elapsed)
+	if lw.budgetErr != nil {
+		if _, ok := lw.budgetErr.(*QuotaExceededError); ok {
+			return caddyhttp.Error(http.StatusTooManyRequests, lw.budgetErr)
+		}
+		return caddyhttp.Error(http.StatusServiceUnavailable, lw.budgetErr)
+	}
+	if m.Trailers != nil && lw.wroteHeader && err == nil {
+		m.Trailers.set(w.Header(), repl, lw, elapsed)
+	}
+	return err
+}
+
+// checkStarts rejects the request if its key started too many transfers
+// within the last minute, telling the client when to retry.
+func (m Middleware) checkStarts(w http.ResponseWriter, ks *keyState, key string) error {
+	if ks.starts == nil {
+		return nil
+	}
+	res := ks.starts.Reserve()
+	delay := res.Delay()
+	if delay == 0 {
+		return nil
+	}
+	res.Cancel()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	m.log("too many new transfers for key",
+		zap.String("key", key),
+		zap.Duration("retry_after", delay))
+	return caddyhttp.Error(http.StatusTooManyRequests,
+		fmt.Errorf("key exceeded %d new transfers per minute", m.MaxStartsPerMinute))
+}
+
+// acquireStream takes one of the key's stream slots for the duration of
+// the request. When all slots are taken, the request waits for one to free
+// up for at most StreamQueue, and is rejected after that.
+func (m Middleware) acquireStream(r *http.Request, ks *keyState, key string) error {
+	if ks.streams.TryAcquire(1) {
+		return nil
+	}
+	if m.StreamQueue > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(m.StreamQueue))
+		defer cancel()
+		err := ks.streams.Acquire(ctx, 1)
+		if err == nil {
+			return nil
+		}
+		if r.Context().Err() != nil {
+			return r.Context().Err()
+		}
+	}
+	m.log("too many concurrent streams for key",
+		zap.String("key", key),
+		zap.Int("max_streams", m.MaxStreams))
+	return caddyhttp.Error(http.StatusTooManyRequests,
+		fmt.Errorf("key exceeded %d concurrent streams", m.MaxStreams))
+}
+
+// serveExempt serves a request that is not throttled, counting its bytes
+// for accounting.
+func (m Middleware) serveExempt(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, repl *caddy.Replacer) error {
+	var body *countingBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &countingBody{ReadCloser: r.Body}
+		r.Body = body
+	}
+	cw := &countingWriter{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}}
+	err := next.ServeHTTP(cw, r)
+	var received int64
+	if body != nil {
+		received = body.read
+	}
+	m.accounting.add(m.accountingKey(repl), true, cw.written, received)
+	repl.Set(placeholderBytesSent, cw.written)
+	repl.Set(placeholderBytesReceived, received)
+	return err
+}
+
+// checkEscalated rejects the request if its key was escalated to reject
+// mode by ResetFlood.
+func (m Middleware) checkEscalated(w http.ResponseWriter, ks *keyState, key string) error {
+	if m.ResetFlood == nil {
+		return nil
+	}
+	remaining := ks.rejecting(clk.Now())
+	if remaining == 0 {
+		return nil
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+	m.log("rejecting escalated key",
+		zap.String("key", key),
+		zap.Duration("retry_after", remaining))
+	return caddyhttp.Error(http.StatusTooManyRequests,
+		fmt.Errorf("key is rejected for repeatedly resetting throttled responses"))
+}
+
+// checkSaturated rejects the request if its key is saturated, telling the
+// client to retry once the backlog of the key's bucket has drained.
+func (m Middleware) checkSaturated(w http.ResponseWriter, ks *keyState, key string) error {
+	if m.RejectWhen == nil || !ks.saturation.saturated(m.RejectWhen, clk.Now()) {
+		return nil
+	}
+	retry := time.Second
+	ks.mu.Lock()
+	lim := ks.limiter
+	ks.mu.Unlock()
+	if lim != nil {
+		if tokens := lim.TokensAt(clk.Now()); tokens < 0 {
+			retry = max(retry, bytesDuration(int64(-tokens), float64(lim.Limit())))
+		}
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	m.log("rejecting request of saturated key",
+		zap.String("key", key),
+		zap.Int64("waiters", ks.saturation.waiters.Load()),
+		zap.Duration("retry_after", retry))
+	return caddyhttp.Error(m.RejectWhen.Status, fmt.Errorf("key is saturated"))
+}
+
+// saturationOf returns the saturation tracker of a key, or nil if it is
+// not needed.
+func saturationOf(ks *keyState, rw *RejectWhen) *saturation {
+	if ks == nil || rw == nil {
+		return nil
+	}
+	return &ks.saturation
+}
+
+// recordReset counts a throttled response the client reset before it was
+// complete, escalating the key once it crosses the ResetFlood threshold.
+func (m Middleware) recordReset(ks *keyState, key string) {
+	until, escalated := m.ResetFlood.record(ks, clk.Now())
+	if !escalated {
+		return
+	}
+	m.metrics.escalations.Inc()
+	m.logger.Warn("escalating key to reject mode for resetting throttled responses",
+		zap.String("key", key),
+		zap.Int("resets", m.ResetFlood.MaxResets),
+		zap.Duration("window", time.Duration(m.ResetFlood.Window)),
+		zap.Time("reject_until", until))
+	auditLog("escalate", "reset_flood",
+		zap.String("policy", m.Name),
+		zap.String("key", key),
+		zap.Time("reject_until", until))
+	m.events.Emit(m.ctx, "bandwidth_escalated", map[string]any{
+		"policy":       m.Name,
+		"key":          key,
+		"resets":       m.ResetFlood.MaxResets,
+		"reject_until": until,
+	})
+}
+
+// settings returns the handler's current limits, which may have been
+// changed through the admin API if the handler is named.
+func (m Middleware) settings() policySettings {
+	if m.Name != "" {
+		if s, ok := policies.get(m.Name); ok {
+			return s
+		}
+	}
+	return policySettings{Limit: m.Limit, UploadLimit: m.UploadLimit}
+}
+
+// resolveLimit returns the limit for the current request from the
+// external, client certificate, path, extension, host, geo or method
+// tables, or else the configured limit, resolving placeholders unless a
+// static limit is set. A limit of 0 means the request is not throttled.
+// static reports whether the limit is the same for all requests, so one
+// limiter can be shared.
+func (m Middleware) resolveLimit(r *http.Request, repl *caddy.Replacer, configured float64, t *decisionTrace) (limit float64, static bool, err error) {
+	if m.external != nil {
+		key := repl.ReplaceAll(m.ExternalLimits.Key, "")
+		if limit, ok := m.external.lookup(key); ok {
+			t.add("external_limits", "%s for key '%s'", formatLimit(limit), m.hashKey(key))
+			return limit, false, nil
+		}
+		t.add("external_limits", "no match for key '%s'", m.hashKey(key))
+	}
+	if len(m.ClientCerts) > 0 {
+		fp := clientCertFingerprint(r)
+		if limit, ok := m.ClientCerts[fp]; ok && fp != "" {
+			t.add("client_certs", "%s for certificate %s", formatLimit(limit), fp)
+			return limit, false, nil
+		}
+		t.add("client_certs", "no match for certificate '%s'", fp)
+	}
+	if len(m.Paths) > 0 {
+		p, ok := matchPath(m.Paths, r)
+		if ok {
+			t.add("paths", "%s for %s", formatLimit(p.Limit), p.Path)
+			return p.Limit, false, nil
+		}
+		t.add("paths", "no match for %s", r.URL.Path)
+	}
+	if len(m.Extensions) > 0 {
+		limit, ext, ok := lookupExtensionLimit(m.Extensions, r.URL.Path)
+		if ok {
+			t.add("extensions", "%s for %s", formatLimit(limit), ext)
+			return limit, false, nil
+		}
+		t.add("extensions", "no match for %s", r.URL.Path)
+	}
+	if len(m.Hosts) > 0 {
+		limit, ok := lookupHostLimit(m.Hosts, r.Host)
+		if ok {
+			t.add("hosts", "%s for %s", formatLimit(limit), r.Host)
+			return limit, false, nil
+		}
+		t.add("hosts", "no match for %s", r.Host)
+	}
+	if m.Geo != nil {
+		limit, country, ok := m.Geo.limitFor(repl)
+		if ok {
+			t.add("geo", "%s for country '%s'", formatLimit(limit), country)
+			return limit, false, nil
+		}
+		t.add("geo", "no match for country '%s'", country)
+	}
+	if ml, ok := m.Methods[r.Method]; ok && ml.Limit != nil {
+		t.add("methods", "%s for %s", formatLimit(*ml.Limit), r.Method)
+		return *ml.Limit, false, nil
+	}
+	if configured > 0 || m.LimitStr == "" {
+		t.add("limit", "%s", formatLimit(configured))
+		return configured, true, nil
+	}
+	limitStr := repl.ReplaceAll(m.LimitStr, "")
+	t.add("limit_str", "'%s' resolved to '%s'", m.LimitStr, limitStr)
+	if unlimitedKeyword(limitStr) {
+		return 0, false, nil
+	}
+	limit, err = parseRate(limitStr)
+	switch {
+	case err == nil && limit > 0:
+		return limit, false, nil
+	case err == nil:
+		t.add("on_zero", "%s", m.OnZero)
+		switch m.OnZero {
+		case onZeroDeny:
+			return 0, false, caddyhttp.Error(http.StatusForbidden,
+				fmt.Errorf("bandwidth limit is zero"))
+		case onZeroDefault:
+			return m.DefaultLimit, false, nil
+		default:
+			return 0, false, nil
+		}
+	}
+	t.add("on_invalid", "%s", m.OnInvalid)
+	m.logger.Warn("limit did not resolve to a positive number",
+		zap.String("limit_str", m.LimitStr),
+		zap.String("resolved", limitStr),
+		zap.String("on_invalid", m.OnInvalid))
+	switch m.OnInvalid {
+	case onInvalidDeny:
+		return 0, false, caddyhttp.Error(http.StatusInternalServerError,
+			fmt.Errorf("invalid bandwidth limit '%s'", limitStr))
+	case onInvalidDefault:
+		return m.DefaultLimit, false, nil
+	default:
+		return 0, false, nil
+	}
+}
+
+// announcing reports whether limit would newly throttle the request and is
+// still within the announcement window.
+func (m Middleware) announcing(limit float64) bool {
+	if m.enforceAt.IsZero() || !time.Now().Before(m.enforceAt) {
+		return false
 	}
-	return nil
+	return limit > 0 && (m.PreviousLimit == 0 || limit < m.PreviousLimit)
 }
 
-func (m Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	var limiter *rate.Limiter
-	
-	// If we have a static limiter, use it
-	if m.limiter != nil {
-		limiter = m.limiter
-	} else if m.LimitStr != "" {
-		// Resolve placeholder and create limiter per request
-		repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
-		limitStr := repl.ReplaceAll(m.LimitStr, "")
-		if limit, err := strconv.Atoi(limitStr); err == nil && limit > 0 {
-			limiter = rate.NewLimiter(rate.Limit(limit), limit)
-		}
-	}
-	
-	if limiter != nil {
-		w = &limitedResponseWriter{
-			ResponseWriter: w,
-			limiter:        limiter,
-			r:              r,
-		}
-	}
-	return next.ServeHTTP(w, r)
-}
-
-type limitedResponseWriter struct {
-	http.ResponseWriter
-	limiter *rate.Limiter
-	r       *http.Request
-}
-
-func (l *limitedResponseWriter) Write(p []byte) (int, error) {
-   total := 0
-   for len(p) > 0 {
-	   // Determine chunk size based on limiter burst (minimum 1)
-	   chunk := l.limiter.Burst()
-	   if chunk <= 0 {
-		   chunk = 1
-	   }
-	   if len(p) < chunk {
-		   chunk = len(p)
-	   }
-	   // Wait for permission to send this chunk
-	   if err := l.limiter.WaitN(l.r.Context(), chunk); err != nil {
-		   return total, err
-	   }
-	   // Write the chunk
-	   n, err := l.ResponseWriter.Write(p[:chunk])
-	   total += n
-	   if err != nil {
-		   return total, err
-	   }
-	   // Advance the buffer
-	   p = p[chunk:]
-   }
-   return total, nil
+// log writes a throttling decision to the module logger at the configured
+// log level. It is a no-op unless log_level is set.
+func (m Middleware) log(msg string, fields ...zap.Field) {
+	if !m.logDecisions {
+		return
+	}
+	if ce := m.logger.Check(m.logLevel, msg); ce != nil {
+		ce.Write(fields...)
+	}
 }
 
 // containsPlaceholders checks if the string contains Caddy placeholder syntax {key}
@@ -110,36 +1621,1085 @@ func containsPlaceholders(s string) bool {
 	return closeIdx > 0
 }
 
-func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
-	var m Middleware
-
-	for h.Next() {
-		for h.NextBlock(0) {
-			switch h.Val() {
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens, so that
+// it can be used wherever Caddyfile handlers are unmarshaled, not just as
+// a directive. Every option sets a JSON field; the resulting config
+// behaves identically to the same fields set in JSON.
+func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextBlock(0) {
+			switch d.Val() {
 			case "limit":
-				limitStr := h.RemainingArgs()
+				limitStr := d.RemainingArgs()
 				if len(limitStr) != 1 {
-					return nil, h.ArgErr()
+					return d.ArgErr()
 				}
-				
+
 				// Check if the limit contains placeholders
 				limitValue := limitStr[0]
+				if err := checkPlaceholders(limitValue); err != nil {
+					return d.Errf("parsing limit value: %v", err)
+				}
 				if containsPlaceholders(limitValue) {
 					// Store as string for runtime resolution
 					m.LimitStr = limitValue
 				} else {
-					// Parse as integer immediately
+					// Parse the rate immediately
+					var err error
+					m.Limit, err = parseLimit(limitValue)
+					if err != nil {
+						return d.Errf("parsing limit value: %v", err)
+					}
+					m.Unlimited = m.Limit == 0
+				}
+			case "name":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Name = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "pool":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Pool = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "on_zero":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.OnZero = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "default_limit":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				var err error
+				m.DefaultLimit, err = parseRate(d.Val())
+				if err != nil {
+					return d.Errf("parsing default_limit value: %v", err)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "on_invalid":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.OnInvalid = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "limits_file", "limits_url":
+				opt := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.ExternalLimits = new(ExternalLimits)
+				if opt == "limits_file" {
+					m.ExternalLimits.File = d.Val()
+				} else {
+					m.ExternalLimits.URL = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					sub := d.Val()
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					switch sub {
+					case "key":
+						m.ExternalLimits.Key = d.Val()
+					case "refresh":
+						dur, err := caddy.ParseDuration(d.Val())
+						if err != nil {
+							return d.Errf("parsing refresh value: %v", err)
+						}
+						m.ExternalLimits.Refresh = caddy.Duration(dur)
+					case "fallback":
+						switch d.Val() {
+						case fallbackStale, fallbackLocal:
+							m.ExternalLimits.Fallback = d.Val()
+						default:
+							limit, err := parseLimit(d.Val())
+							if err != nil {
+								return d.Errf("parsing fallback value: %v", err)
+							}
+							m.ExternalLimits.Fallback = fallbackLimit
+							m.ExternalLimits.FallbackLimit = limit
+						}
+					default:
+						return d.Errf("unrecognized %s parameter '%s'", opt, sub)
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				}
+			case "paths":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					p := PathLimit{Path: d.Val()}
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					var err error
+					p.Limit, err = parseLimit(d.Val())
+					if err != nil {
+						return d.Errf("parsing limit for path '%s': %v", p.Path, err)
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					m.Paths = append(m.Paths, p)
+				}
+			case "client_certs":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.ClientCerts == nil {
+					m.ClientCerts = make(map[string]float64)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					fp := d.Val()
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					limit, err := parseLimit(d.Val())
+					if err != nil {
+						return d.Errf("parsing limit for client certificate '%s': %v", fp, err)
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					m.ClientCerts[fp] = limit
+				}
+			case "extensions":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.Extensions == nil {
+					m.Extensions = make(map[string]float64)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					ext := d.Val()
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					limit, err := parseLimit(d.Val())
+					if err != nil {
+						return d.Errf("parsing limit for extension '%s': %v", ext, err)
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					m.Extensions[ext] = limit
+				}
+			case "hosts":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.Hosts == nil {
+					m.Hosts = make(map[string]float64)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					host := strings.ToLower(d.Val())
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					var limit float64
+					var err error
+					limit, err = parseLimit(d.Val())
+					if err != nil {
+						return d.Errf("parsing limit for host '%s': %v", host, err)
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					m.Hosts[host] = limit
+				}
+			case "geo":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Geo = &GeoLimits{
+					Country:   d.Val(),
+					Countries: make(map[string]float64),
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					country := strings.ToUpper(d.Val())
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					var limit float64
 					var err error
-					m.Limit, err = strconv.Atoi(limitValue)
+					limit, err = parseLimit(d.Val())
+					if err != nil {
+						return d.Errf("parsing limit for country '%s': %v", country, err)
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					if country == "DEFAULT" {
+						m.Geo.Default = &limit
+					} else {
+						m.Geo.Countries[country] = limit
+					}
+				}
+			case "methods":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				if m.Methods == nil {
+					m.Methods = make(map[string]MethodLimit)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					method := strings.ToUpper(d.Val())
+					var ml MethodLimit
+					for d.NextArg() {
+						upload := d.Val() == "upload"
+						if upload && !d.NextArg() {
+							return d.ArgErr()
+						}
+						limit, err := parseLimit(d.Val())
+						if err != nil {
+							return d.Errf("parsing limit for method %s: %v", method, err)
+						}
+						if upload {
+							ml.UploadLimit = &limit
+						} else {
+							ml.Limit = &limit
+						}
+					}
+					if ml.Limit == nil && ml.UploadLimit == nil {
+						return d.ArgErr()
+					}
+					m.Methods[method] = ml
+				}
+			case "size_bands":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					band, err := parseBandRange(d.Val())
+					if err != nil {
+						return d.Errf("parsing size band: %v", err)
+					}
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					band.Limit, err = parseLimit(d.Val())
+					if err != nil {
+						return d.Errf("parsing size band limit: %v", err)
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+					m.SizeBands = append(m.SizeBands, band)
+				}
+			case "status_limits":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.StatusLimits = make(map[string]float64)
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					status := d.Val()
+					if !validStatus(status) {
+						return d.Errf("invalid status code or class '%s'", status)
+					}
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					limit, err := parseLimit(d.Val())
+					if err != nil {
+						return d.Errf("parsing limit for status %s: %v", status, err)
+					}
+					m.StatusLimits[status] = limit
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				}
+			case "min_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				var err error
+				m.MinSize, err = parseBytes(d.Val())
+				if err != nil {
+					return d.Errf("parsing min_size value: %v", err)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "algorithm":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Algorithm = d.Val()
+				if d.NextArg() {
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("parsing pacing interval: %v", err)
+					}
+					m.PacingInterval = caddy.Duration(dur)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "head_start":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				var err error
+				m.HeadStart, err = parseBytes(d.Val())
+				if err != nil {
+					return d.Errf("parsing head_start value: %v", err)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "nested":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Nested = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "granularity":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Granularity = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "measure":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Measure = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "ramp_up":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("parsing ramp_up value: %v", err)
+				}
+				m.RampUp = caddy.Duration(dur)
+				if d.NextArg() {
+					m.RampCurve = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "ranges":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Ranges = new(RangeShaping)
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					opt := d.Val()
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					switch opt {
+					case "client":
+						m.Ranges.Client = d.Val()
+					case "retain":
+						dur, err := caddy.ParseDuration(d.Val())
+						if err != nil {
+							return d.Errf("parsing retain value: %v", err)
+						}
+						m.Ranges.Retain = caddy.Duration(dur)
+					case "exempt":
+						n, err := parseBytes(d.Val())
+						if err != nil {
+							return d.Errf("parsing exempt value: %v", err)
+						}
+						m.Ranges.Exempt = n
+					default:
+						return d.Errf("unrecognized ranges parameter '%s'", opt)
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				}
+			case "simulate":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Simulate = new(Simulate)
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					opt := d.Val()
+					if opt != "latency" && opt != "jitter" {
+						return d.Errf("unrecognized simulate parameter '%s'", opt)
+					}
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("parsing %s value: %v", opt, err)
+					}
+					if opt == "latency" {
+						m.Simulate.Latency = caddy.Duration(dur)
+					} else {
+						m.Simulate.Jitter = caddy.Duration(dur)
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				}
+			case "adaptive":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Adaptive = new(Adaptive)
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					opt := d.Val()
+					switch opt {
+					case "egress":
+						args := d.RemainingArgs()
+						if len(args) < 1 || len(args) > 2 {
+							return d.ArgErr()
+						}
+						var err error
+						m.Adaptive.EgressHigh, err = parseRate(args[0])
+						if err == nil && len(args) == 2 {
+							m.Adaptive.EgressLow, err = parseRate(args[1])
+						}
+						if err != nil {
+							return d.Errf("parsing egress watermarks: %v", err)
+						}
+					case "streams":
+						args := d.RemainingArgs()
+						if len(args) < 1 || len(args) > 2 {
+							return d.ArgErr()
+						}
+						var err error
+						m.Adaptive.StreamsHigh, err = strconv.Atoi(args[0])
+						if err == nil && len(args) == 2 {
+							m.Adaptive.StreamsLow, err = strconv.Atoi(args[1])
+						}
+						if err != nil {
+							return d.Errf("parsing streams watermarks: %v", err)
+						}
+					case "factor":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						var err error
+						m.Adaptive.Factor, err = strconv.ParseFloat(d.Val(), 64)
+						if err != nil {
+							return d.Errf("parsing factor value: %v", err)
+						}
+						if d.NextArg() {
+							return d.ArgErr()
+						}
+					case "interval":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						dur, err := caddy.ParseDuration(d.Val())
+						if err != nil {
+							return d.Errf("parsing interval value: %v", err)
+						}
+						m.Adaptive.Interval = caddy.Duration(dur)
+						if d.NextArg() {
+							return d.ArgErr()
+						}
+					default:
+						return d.Errf("unrecognized adaptive parameter '%s'", opt)
+					}
+				}
+			case "max_transfer_time", "wait_timeout":
+				opt := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("parsing %s value: %v", opt, err)
+				}
+				if opt == "max_transfer_time" {
+					m.MaxTransferTime = caddy.Duration(dur)
+				} else {
+					m.WaitTimeout = caddy.Duration(dur)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "min_effective_rate":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				var err error
+				m.MinEffectiveRate, err = parseRate(d.Val())
+				if err != nil {
+					return d.Errf("parsing min_effective_rate value: %v", err)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "average_limit":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				var err error
+				m.AverageLimit, err = parseRate(d.Val())
+				if err != nil {
+					return d.Errf("parsing average_limit value: %v", err)
+				}
+				if d.NextArg() {
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("parsing average_limit window: %v", err)
+					}
+					m.AverageWindow = caddy.Duration(dur)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "overage":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Overage = new(Overage)
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "grace":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						grace, err := parseBytes(d.Val())
+						if err != nil {
+							return d.Errf("parsing grace value: %v", err)
+						}
+						m.Overage.Grace = grace
+					case "overage_rate":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						rate, err := parseRate(d.Val())
+						if err != nil {
+							return d.Errf("parsing overage_rate value: %v", err)
+						}
+						m.Overage.Rate = rate
+					case "block":
+						m.Overage.Block = true
+					default:
+						return d.Errf("unrecognized overage parameter '%s'", d.Val())
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				}
+			case "peak", "sustained":
+				opt := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				limit, err := parseRate(d.Val())
+				if err != nil {
+					return d.Errf("parsing %s value: %v", opt, err)
+				}
+				if opt == "peak" {
+					m.Peak = limit
+				} else {
+					m.Sustained = limit
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "peak_duration":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("parsing peak_duration value: %v", err)
+				}
+				m.PeakDuration = caddy.Duration(dur)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "connection_limit", "global_limit":
+				opt := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				limit, err := parseLimit(d.Val())
+				if err != nil {
+					return d.Errf("parsing %s value: %v", opt, err)
+				}
+				if opt == "connection_limit" {
+					m.ConnectionLimit = limit
+				} else {
+					m.GlobalLimit = limit
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "upload_limit":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				var err error
+				m.UploadLimit, err = parseRate(d.Val())
+				if err != nil {
+					return d.Errf("parsing upload_limit value: %v", err)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "upload_max_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				var err error
+				m.UploadMaxSize, err = parseBytes(d.Val())
+				if err != nil {
+					return d.Errf("parsing upload_max_size value: %v", err)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "two_way":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.TwoWay = true
+			case "key":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Key = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "key_cidr_ipv4", "key_cidr_ipv6":
+				opt := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				bits, err := strconv.Atoi(strings.TrimPrefix(d.Val(), "/"))
+				if err != nil {
+					return d.Errf("parsing %s value: %v", opt, err)
+				}
+				if opt == "key_cidr_ipv4" {
+					m.KeyCIDRv4 = bits
+				} else {
+					m.KeyCIDRv6 = bits
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "hash_keys":
+				m.HashKeys = true
+				if d.NextArg() {
+					m.HashSecret = d.Val()
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "sessions":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Sessions = &Sessions{ID: d.Val()}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "link":
+						m.Sessions.Link = true
+					case "ttl":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						dur, err := caddy.ParseDuration(d.Val())
+						if err != nil {
+							return d.Errf("parsing ttl value: %v", err)
+						}
+						m.Sessions.TTL = caddy.Duration(dur)
+					default:
+						return d.Errf("unrecognized sessions parameter '%s'", d.Val())
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				}
+			case "max_inflight":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := parseBytes(d.Val())
+				if err != nil {
+					return d.Errf("parsing max_inflight value: %v", err)
+				}
+				if n > math.MaxInt {
+					return d.Errf("max_inflight value %d is too large", n)
+				}
+				m.MaxInflight = int(n)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "enforce_at":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.EnforceAt = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "previous_limit":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				var err error
+				m.PreviousLimit, err = parseLimit(d.Val())
+				if err != nil {
+					return d.Errf("parsing previous_limit value: %v", err)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "notice_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.NoticeHeader = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "trailers":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Trailers = new(SummaryTrailers)
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					name := d.Val()
+					if name == "server_timing" {
+						if d.NextArg() {
+							return d.ArgErr()
+						}
+						m.Trailers.ServerTiming = true
+						continue
+					}
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					if m.Trailers.Fields == nil {
+						m.Trailers.Fields = make(map[string]string)
+					}
+					m.Trailers.Fields[name] = d.Val()
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				}
+				if len(m.Trailers.Fields) == 0 {
+					// A bare trailers directive adds Server-Timing
+					m.Trailers.ServerTiming = true
+				}
+			case "upstream_feedback":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.UpstreamFeedback = true
+			case "weight":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Weight = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "priority":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Priority = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "progress_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.ProgressHeader = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "max_starts_per_minute":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				var err error
+				m.MaxStartsPerMinute, err = strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("parsing max_starts_per_minute value: %v", err)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "max_streams":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				var err error
+				m.MaxStreams, err = strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("parsing max_streams value: %v", err)
+				}
+				if d.NextArg() {
+					if d.Val() != "queue" {
+						return d.Errf("unrecognized max_streams option '%s'", d.Val())
+					}
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					dur, err := caddy.ParseDuration(d.Val())
+					if err != nil {
+						return d.Errf("parsing queue duration: %v", err)
+					}
+					m.StreamQueue = caddy.Duration(dur)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "reject_when":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.RejectWhen = new(RejectWhen)
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					opt := d.Val()
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					switch opt {
+					case "empty_for":
+						dur, err := caddy.ParseDuration(d.Val())
+						if err != nil {
+							return d.Errf("parsing empty_for value: %v", err)
+						}
+						m.RejectWhen.EmptyFor = caddy.Duration(dur)
+					case "waiters", "status":
+						n, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return d.Errf("parsing %s value: %v", opt, err)
+						}
+						if opt == "waiters" {
+							m.RejectWhen.Waiters = n
+						} else {
+							m.RejectWhen.Status = n
+						}
+					default:
+						return d.Errf("unrecognized reject_when parameter '%s'", opt)
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				}
+			case "reset_flood":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.ResetFlood = new(ResetFlood)
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "max_resets":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						var err error
+						m.ResetFlood.MaxResets, err = strconv.Atoi(d.Val())
+						if err != nil {
+							return d.Errf("parsing max_resets value: %v", err)
+						}
+					case "window", "reject_for":
+						opt := d.Val()
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						dur, err := caddy.ParseDuration(d.Val())
+						if err != nil {
+							return d.Errf("parsing %s value: %v", opt, err)
+						}
+						if opt == "window" {
+							m.ResetFlood.Window = caddy.Duration(dur)
+						} else {
+							m.ResetFlood.RejectFor = caddy.Duration(dur)
+						}
+					default:
+						return d.Errf("unrecognized reset_flood parameter '%s'", d.Val())
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				}
+			case "slow_clients":
+				m.SlowClients = new(SlowClients)
+				if d.NextArg() {
+					ratio, err := strconv.ParseFloat(d.Val(), 64)
 					if err != nil {
-						return nil, h.Errf("parsing limit value: %v", err)
+						return d.Errf("parsing slow_clients ratio: %v", err)
+					}
+					m.SlowClients.Ratio = ratio
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "grace":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						dur, err := caddy.ParseDuration(d.Val())
+						if err != nil {
+							return d.Errf("parsing grace value: %v", err)
+						}
+						m.SlowClients.Grace = caddy.Duration(dur)
+					case "evict":
+						m.SlowClients.Evict = true
+					default:
+						return d.Errf("unrecognized slow_clients parameter '%s'", d.Val())
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				}
+			case "warm_start":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.WarmStart = true
+			case "accounting":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Accounting = new(Accounting)
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "key":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						m.Accounting.Key = d.Val()
+					case "interval":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						dur, err := caddy.ParseDuration(d.Val())
+						if err != nil {
+							return d.Errf("parsing interval value: %v", err)
+						}
+						m.Accounting.Interval = caddy.Duration(dur)
+					case "file":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						m.Accounting.File = d.Val()
+						if d.NextArg() {
+							m.Accounting.Format = d.Val()
+						}
+					case "webhook":
+						if !d.NextArg() {
+							return d.ArgErr()
+						}
+						m.Accounting.Webhook = d.Val()
+					case "storage":
+						m.Accounting.Storage = true
+					case "include_exempt":
+						m.Accounting.IncludeExempt = true
+					default:
+						return d.Errf("unrecognized accounting parameter '%s'", d.Val())
+					}
+					if d.NextArg() {
+						return d.ArgErr()
 					}
 				}
+			case "trusted_proxies":
+				ranges := d.RemainingArgs()
+				if len(ranges) == 0 {
+					return d.ArgErr()
+				}
+				m.TrustedProxies = append(m.TrustedProxies, ranges...)
+			case "override_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.OverrideHeader = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "trace":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				switch d.Val() {
+				case "on":
+					m.Trace = true
+				case "secret":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					m.TraceSecret = d.Val()
+				default:
+					return d.Errf("unrecognized trace mode '%s'", d.Val())
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "log_level":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.LogLevel = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
 			default:
-				return nil, h.Errf("unrecognized parameter '%s'", h.Val())
+				return d.Errf("unrecognized parameter '%s'", d.Val())
 			}
 		}
 	}
 
-	return m, nil
+	return nil
+}
+
+// parseCaddyfile unmarshals tokens from h into a new Middleware.
+func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var m Middleware
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return m, err
 }
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*Middleware)(nil)
+	_ caddy.CleanerUpper          = (*Middleware)(nil)
+	_ caddy.Validator             = (*Middleware)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Middleware)(nil)
+	_ caddyfile.Unmarshaler       = (*Middleware)(nil)
+	_ http.Hijacker               = (*limitedResponseWriter)(nil)
+)
@@ -0,0 +1,31 @@
+package bandwidth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// normalizeFingerprint returns a certificate fingerprint in the form used
+// by the {http.request.tls.client.fingerprint} placeholder: lowercase hex
+// without separators. Fingerprints are commonly printed with colons, e.g.
+// by openssl.
+func normalizeFingerprint(s string) (string, error) {
+	fp := strings.ToLower(strings.ReplaceAll(s, ":", ""))
+	if b, err := hex.DecodeString(fp); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("'%s' is not a SHA-256 fingerprint", s)
+	}
+	return fp, nil
+}
+
+// clientCertFingerprint returns the SHA-256 fingerprint of the client
+// certificate presented over mTLS, or "" if there is none.
+func clientCertFingerprint(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,43 @@
+package bandwidth
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+func validateKeyCIDR(v4, v6 int) error {
+	if v4 < 0 || v4 > 32 {
+		return fmt.Errorf("key_cidr_ipv4 must be between 0 and 32")
+	}
+	if v6 < 0 || v6 > 128 {
+		return fmt.Errorf("key_cidr_ipv6 must be between 0 and 128")
+	}
+	return nil
+}
+
+// aggregateKey returns key with an IP address replaced by its network,
+// e.g. "2001:db8:1:2::/64", if KeyCIDRv4 or KeyCIDRv6 is set for its
+// family, so that a client rotating through the addresses of its network
+// keeps drawing from one bucket. Other keys are returned unchanged.
+func (m Middleware) aggregateKey(key string) string {
+	if m.KeyCIDRv4 == 0 && m.KeyCIDRv6 == 0 {
+		return key
+	}
+	addr, err := netip.ParseAddr(key)
+	if err != nil {
+		return key
+	}
+	addr = addr.Unmap().WithZone("")
+	bits := m.KeyCIDRv6
+	if addr.Is4() {
+		bits = m.KeyCIDRv4
+	}
+	if bits == 0 {
+		return key
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return key
+	}
+	return prefix.String()
+}
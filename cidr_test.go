@@ -0,0 +1,38 @@
+package bandwidth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestWarmStartWithKeyCIDR(t *testing.T) {
+	m := Middleware{
+		Name:      "cidr-warm-start",
+		Key:       "{http.request.remote.host}",
+		KeyCIDRv4: 24,
+		WarmStart: true,
+	}
+	m.Accounting = &Accounting{Key: m.Key}
+	replFor := func(host string) *caddy.Replacer {
+		repl := caddy.NewReplacer()
+		repl.Set("http.request.remote.host", host)
+		return repl
+	}
+
+	// Usage is recorded under the network, like the buckets
+	key := m.accountingKey(replFor("192.0.2.7"))
+	if want := "192.0.2.0/24"; key != want {
+		t.Fatalf("accounting key is %q, want %q", key, want)
+	}
+
+	// so that the buckets of another address of the network warm-start
+	// with the network's demand
+	start := time.Now()
+	demand.observe(m.Name, []accountingRecord{{Key: key, BytesSent: 1000}}, start, start.Add(time.Second))
+	bucket := m.hashKey(m.aggregateKey(replFor("192.0.2.9").ReplaceAll(m.Key, "")))
+	if got := demand.rate(m.Name, bucket); got != 1000 {
+		t.Errorf("demand of bucket %q is %v, want 1000", bucket, got)
+	}
+}
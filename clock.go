@@ -0,0 +1,44 @@
+package bandwidth
+
+import (
+	"context"
+	"time"
+)
+
+// clock is the time source of throttling: the time at which buckets are
+// reserved from and refilled, the sleeps that token waits block in, and
+// the state that follows the buckets, i.e. the idle sweeps of keys and
+// sessions, saturation, reject windows and reset flood escalation. Tests
+// substitute a virtual clock, so that rate behavior can be checked
+// deterministically without sleeping.
+//
+// Real time is kept where it meets the outside world: slow client
+// detection times actual socket writes and sets their deadlines, context
+// deadlines of transfer budgets and wait timeouts are real, and overrides,
+// reservations, enforce_at and accounting intervals follow wall-clock
+// schedules. Statistics and simulated latency use real time too.
+type clock interface {
+	Now() time.Time
+
+	// SleepUntil blocks until t, or until ctx is done, in which case it
+	// returns ctx.Err().
+	SleepUntil(ctx context.Context, t time.Time) error
+}
+
+// clk is the clock of token waits.
+var clk clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) SleepUntil(ctx context.Context, t time.Time) error {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,111 @@
+package bandwidth
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// virtualClock is a clock whose sleeps return right away, moving the
+// clock forward to when they would have ended. Concurrent sleepers move it
+// to the latest of their wake-up times, so that waits which overlap in
+// real life overlap in virtual time too.
+type virtualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *virtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *virtualClock) SleepUntil(ctx context.Context, t time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.After(c.now) {
+		c.now = t
+	}
+	return nil
+}
+
+// useVirtualClock makes token waits use a virtual clock for the rest of
+// the test.
+func useVirtualClock(t *testing.T) *virtualClock {
+	t.Helper()
+	vc := &virtualClock{now: time.Now()}
+	prev := clk
+	clk = vc
+	t.Cleanup(func() { clk = prev })
+	return vc
+}
+
+// elapsed returns how much virtual time f took.
+func (c *virtualClock) elapsed(f func()) time.Duration {
+	start := c.Now()
+	f()
+	return c.Now().Sub(start)
+}
+
+func TestWaitAllVirtualClock(t *testing.T) {
+	vc := useVirtualClock(t)
+	lim := newLimiter(1000)
+	tier := newLimiter(500)
+
+	// The first second's worth is in the bucket, the rest is paced
+	got := vc.elapsed(func() {
+		for range 3 {
+			if _, err := waitAll(context.Background(), 500, lim); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if want := 500 * time.Millisecond; got != want {
+		t.Errorf("waiting on one bucket took %s, want %s", got, want)
+	}
+
+	// Tokens are taken from every bucket at once, so the slower one sets
+	// the pace once its burst is spent
+	got = vc.elapsed(func() {
+		for range 3 {
+			if _, err := waitAll(context.Background(), 500, lim, tier); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if want := 2 * time.Second; got != want {
+		t.Errorf("waiting on two buckets took %s, want %s", got, want)
+	}
+}
+
+func TestWaitAllExceedsBurst(t *testing.T) {
+	useVirtualClock(t)
+	lim := newLimiter(1000)
+	if _, err := waitAll(context.Background(), 1001, lim); err == nil {
+		t.Error("waiting for more than the burst succeeded")
+	}
+	// A failed wait must not take tokens from the other buckets
+	other := newLimiter(2000)
+	if _, err := waitAll(context.Background(), 1500, other, lim); err == nil {
+		t.Error("waiting for more than the burst of one bucket succeeded")
+	}
+	if tokens := other.TokensAt(clk.Now()); tokens != 2000 {
+		t.Errorf("other bucket holds %v tokens after a failed wait, want 2000", tokens)
+	}
+}
+
+func TestWaitAllCanceled(t *testing.T) {
+	useVirtualClock(t)
+	lim := newLimiter(1000)
+	lim.ReserveN(clk.Now(), 1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := waitAll(ctx, 500, lim); err != context.Canceled {
+		t.Errorf("waiting with a canceled context returned %v, want %v", err, context.Canceled)
+	}
+}
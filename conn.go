@@ -0,0 +1,53 @@
+package bandwidth
+
+import (
+	"context"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// limitedConn paces reads and writes on a connection hijacked from a
+// throttled response, e.g. a WebSocket, whose traffic bypasses the
+// response writer and request body.
+type limitedConn struct {
+	net.Conn
+	ctx         context.Context
+	readLimiter *rate.Limiter          // nil if reads are not paced
+	w           *limitedResponseWriter // paces writes like the response's
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if c.readLimiter == nil {
+		return c.Conn.Read(p)
+	}
+	// Never read more than the limiter can grant at once
+	if burst := max(c.readLimiter.Burst(), 1); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if _, werr := waitAll(c.ctx, n, c.readLimiter); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		chunk, err := c.w.acquireConn(c.ctx, len(p))
+		if err != nil {
+			return total, err
+		}
+		n, err := c.Conn.Write(p[:chunk])
+		c.w.releaseConn(chunk)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		p = p[chunk:]
+	}
+	return total, nil
+}
@@ -0,0 +1,97 @@
+package bandwidth
+
+import (
+	"compress/gzip"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// What throttled bytes are measured in, see Middleware.Measure.
+const (
+	// measureWire meters bytes as the handler writes them, i.e. compressed
+	// bytes if the response is encoded by a handler after this one.
+	measureWire = "wire"
+
+	// measureContent meters the decoded size of encoded responses, so that
+	// limits reflect the logical content rate regardless of compression.
+	measureContent = "content"
+)
+
+// contentMeter estimates the decoded size of an encoded response as it is
+// written, by running the written bytes through a decoder that discards
+// its output. Decoding trails the written bytes by the decoder's buffer,
+// so the meter reports the ratio of decoded to encoded bytes so far rather
+// than the exact size of each write.
+type contentMeter struct {
+	pw      *io.PipeWriter
+	encoded int64
+	decoded atomic.Int64
+	done    chan struct{}
+}
+
+// newContentMeter starts a meter for responses with the given
+// Content-Encoding, or returns nil if the encoding is not supported.
+func newContentMeter(encoding string) *contentMeter {
+	var decoder func(io.Reader) (io.ReadCloser, error)
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		decoder = func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }
+	case "zstd":
+		decoder = func(r io.Reader) (io.ReadCloser, error) {
+			zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+			if err != nil {
+				return nil, err
+			}
+			return zr.IOReadCloser(), nil
+		}
+	default:
+		return nil
+	}
+	pr, pw := io.Pipe()
+	cm := &contentMeter{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(cm.done)
+		if zr, err := decoder(pr); err == nil {
+			io.Copy(decodedCounter{&cm.decoded}, zr)
+			zr.Close()
+		}
+		// Keep consuming if the stream could not be decoded, so that the
+		// response is not held up; it is then metered on the wire
+		io.Copy(io.Discard, pr)
+	}()
+	return cm
+}
+
+// feed runs bytes written to the client through the decoder.
+func (cm *contentMeter) feed(p []byte) {
+	n, _ := cm.pw.Write(p)
+	cm.encoded += int64(n)
+}
+
+// ratio returns how many content bytes each written byte stands for, at
+// least 1.
+func (cm *contentMeter) ratio() float64 {
+	if cm == nil || cm.encoded == 0 {
+		return 1
+	}
+	return max(float64(cm.decoded.Load())/float64(cm.encoded), 1)
+}
+
+// close stops the decoder.
+func (cm *contentMeter) close() {
+	if cm == nil {
+		return
+	}
+	cm.pw.Close()
+	<-cm.done
+}
+
+type decodedCounter struct{ n *atomic.Int64 }
+
+func (c decodedCounter) Write(p []byte) (int, error) {
+	c.n.Add(int64(len(p)))
+	return len(p), nil
+}
@@ -0,0 +1,76 @@
+package bandwidth
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// decisionTraceHeader is the request header triggering a decision trace
+// with the configured secret, and the response header carrying it.
+const decisionTraceHeader = "X-Bandwidth-Trace"
+
+// decisionTrace records which limit sources were consulted for a request
+// and what each returned, to debug precedence in production.
+type decisionTrace struct {
+	steps  []string
+	header bool // whether to attach the trace to the response
+	logger *zap.Logger
+	uri    string
+	done   bool
+}
+
+// startTrace returns a decision trace for the request if tracing is on or
+// the request carries the trace secret, or else nil.
+func (m Middleware) startTrace(r *http.Request) *decisionTrace {
+	if m.TraceSecret != "" {
+		if v := r.Header.Get(decisionTraceHeader); v != "" {
+			// Don't pass the secret on to upstreams
+			r.Header.Del(decisionTraceHeader)
+			if subtle.ConstantTimeCompare([]byte(v), []byte(m.TraceSecret)) == 1 {
+				return &decisionTrace{header: true, logger: m.logger, uri: r.RequestURI}
+			}
+		}
+	}
+	if m.Trace {
+		return &decisionTrace{logger: m.logger, uri: r.RequestURI}
+	}
+	return nil
+}
+
+// add records the outcome of consulting a source. It is a no-op on a nil
+// trace.
+func (t *decisionTrace) add(source, format string, args ...any) {
+	if t == nil {
+		return
+	}
+	t.steps = append(t.steps, source+"="+fmt.Sprintf(format, args...))
+}
+
+// emit records the final limit, logs the trace and, if requested, sets it
+// on the response header. Only the first call has an effect.
+func (t *decisionTrace) emit(h http.Header, limit float64) {
+	if t == nil || t.done {
+		return
+	}
+	t.done = true
+	t.add("final", "%s", formatLimit(limit))
+	trace := strings.Join(t.steps, "; ")
+	if t.header {
+		h.Set(decisionTraceHeader, trace)
+	}
+	t.logger.Info("bandwidth decision trace",
+		zap.String("uri", t.uri),
+		zap.String("trace", trace))
+}
+
+// formatLimit formats a limit for humans, where 0 means unlimited.
+func formatLimit(limit float64) string {
+	if limit <= 0 {
+		return "unlimited"
+	}
+	return formatRate(limit)
+}
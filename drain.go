@@ -0,0 +1,46 @@
+package bandwidth
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Fallbacks for new requests of a draining policy, see policySettings.
+const (
+	// drainUnthrottled serves new requests without throttling.
+	drainUnthrottled = "unthrottled"
+
+	// drainReject rejects new requests with 503 Service Unavailable.
+	drainReject = "reject"
+)
+
+func validDrain(mode string) bool {
+	switch mode {
+	case "", drainUnthrottled, drainReject:
+		return true
+	}
+	return false
+}
+
+// serveDrained serves a request of a draining policy with the drain's
+// fallback. Transfers that started before the drain keep their limiters.
+func (m Middleware) serveDrained(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, repl *caddy.Replacer, mode string, trace *decisionTrace) error {
+	trace.add("drain", "%s", mode)
+	trace.emit(w.Header(), 0)
+	m.log("serving request of draining policy",
+		zap.String("uri", r.RequestURI),
+		zap.String("fallback", mode))
+	if mode == drainReject {
+		return caddyhttp.Error(http.StatusServiceUnavailable,
+			fmt.Errorf("bandwidth policy '%s' is draining", m.Name))
+	}
+	repl.Set(placeholderLimit, 0)
+	if m.accounting != nil && m.Accounting.IncludeExempt {
+		return m.serveExempt(w, r, next, repl)
+	}
+	return next.ServeHTTP(w, r)
+}
@@ -0,0 +1,40 @@
+package bandwidth
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// normalizeExtensions returns the extension limits keyed by lower-case
+// extension with a leading dot, checking that no limit is negative.
+func normalizeExtensions(exts map[string]float64) (map[string]float64, error) {
+	normalized := make(map[string]float64, len(exts))
+	for ext, limit := range exts {
+		if ext == "" || ext == "." {
+			return nil, fmt.Errorf("empty extension")
+		}
+		if limit < 0 {
+			return nil, fmt.Errorf("limit for extension '%s' must not be negative", ext)
+		}
+		normalized["."+strings.TrimPrefix(strings.ToLower(ext), ".")] = limit
+	}
+	return normalized, nil
+}
+
+// lookupExtensionLimit returns the limit configured for the extension of
+// the file the request path names, and the extension it matched. The
+// longest listed extension wins, so ".tar.gz" takes precedence over ".gz".
+func lookupExtensionLimit(exts map[string]float64, urlPath string) (float64, string, bool) {
+	name := strings.ToLower(path.Base(urlPath))
+	// A leading dot marks a hidden file, not an extension
+	for i := 1; i < len(name); i++ {
+		if name[i] != '.' {
+			continue
+		}
+		if limit, ok := exts[name[i:]]; ok {
+			return limit, name[i:], true
+		}
+	}
+	return 0, "", false
+}
@@ -0,0 +1,356 @@
+package bandwidth
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// ExternalLimits loads a table mapping keys, such as users, client IPs or
+// hosts, to limits from a file or HTTP endpoint, and refreshes it
+// periodically, so that customer tiers can change without touching the
+// Caddy config. The document is a JSON or YAML object whose values are
+// rates with the same units as Limit, or "unlimited" or "off", e.g.
+// {"alice": "5MB", "203.0.113.7": "unlimited"}.
+type ExternalLimits struct {
+	// File is the path of the document. Exactly one of File and URL is
+	// required.
+	File string `json:"file,omitempty"`
+
+	// URL is fetched with a GET request to load the document.
+	URL string `json:"url,omitempty"`
+
+	// Key is the placeholder looked up in the table. Defaults to the
+	// handler's key, or else the client IP.
+	Key string `json:"key,omitempty"`
+
+	// Refresh is how often the document is reloaded. Files are only
+	// reloaded when their modification time or size changed. Defaults to
+	// 30s.
+	Refresh caddy.Duration `json:"refresh,omitempty"`
+
+	// Fallback is the policy while the document cannot be loaded, e.g.
+	// because the endpoint is down: "stale" (default) keeps the limits
+	// loaded last; "local" ignores the document, so that the handler's
+	// own limits apply; "limit" applies FallbackLimit to every request.
+	// The source is checked every Refresh, and switches back once the
+	// document loads again. Transitions are logged and emitted as
+	// bandwidth_limits_unavailable and bandwidth_limits_recovered events.
+	// With "local" or "limit", the handler also starts if the document
+	// cannot be loaded at first, rather than failing to provision.
+	Fallback string `json:"fallback,omitempty"`
+
+	// FallbackLimit is the limit of every request while the document
+	// cannot be loaded with Fallback "limit". 0 means unlimited.
+	FallbackLimit float64 `json:"fallback_limit,omitempty"`
+}
+
+const defaultExternalRefresh = 30 * time.Second
+
+// Policies while external limits are unavailable, see
+// ExternalLimits.Fallback.
+const (
+	fallbackStale = "stale"
+	fallbackLocal = "local"
+	fallbackLimit = "limit"
+)
+
+func (e *ExternalLimits) provision(handlerKey string) error {
+	if (e.File == "") == (e.URL == "") {
+		return fmt.Errorf("exactly one of file and url is required")
+	}
+	if e.Key == "" {
+		e.Key = handlerKey
+	}
+	if e.Key == "" {
+		e.Key = "{http.request.remote.host}"
+	}
+	if e.Refresh < 0 {
+		return fmt.Errorf("refresh must not be negative")
+	}
+	if e.Refresh == 0 {
+		e.Refresh = caddy.Duration(defaultExternalRefresh)
+	}
+	switch e.Fallback {
+	case "":
+		e.Fallback = fallbackStale
+	case fallbackStale, fallbackLocal, fallbackLimit:
+	default:
+		return fmt.Errorf("unrecognized fallback '%s'", e.Fallback)
+	}
+	if e.FallbackLimit < 0 {
+		return fmt.Errorf("fallback_limit must not be negative")
+	}
+	if e.FallbackLimit > 0 && e.Fallback != fallbackLimit {
+		return fmt.Errorf("fallback_limit requires fallback %s", fallbackLimit)
+	}
+	return nil
+}
+
+// parseLimitTable parses a document of external limits.
+func parseLimitTable(data []byte) (map[string]float64, error) {
+	// YAML is a superset of JSON, so this reads both
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	table := make(map[string]float64, len(doc))
+	for key, v := range doc {
+		var limit float64
+		var err error
+		switch v := v.(type) {
+		case string:
+			limit, err = parseLimit(v)
+		case int:
+			limit = float64(v)
+		case float64:
+			limit = v
+		default:
+			err = fmt.Errorf("unsupported value %v", v)
+		}
+		if err == nil && limit < 0 {
+			err = fmt.Errorf("limit must not be negative")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key '%s': %v", key, err)
+		}
+		table[key] = limit
+	}
+	return table, nil
+}
+
+// externalLimits holds the current table of an ExternalLimits source and
+// keeps it fresh. It lives in the handler's state, so that the table is
+// not reloaded on every config reload.
+type externalLimits struct {
+	cfg    ExternalLimits
+	logger *zap.Logger
+	client *http.Client
+	table  atomic.Pointer[map[string]float64] // nil until loaded
+	down   atomic.Bool                        // set while the table cannot be loaded
+
+	// Where transitions are emitted, updated by every handler provisioned
+	// with this state, so that events reach the current config's app
+	mu     sync.Mutex
+	ctx    caddy.Context
+	events *caddyevents.App
+
+	// Validators of the last load, to skip unchanged documents
+	modTime time.Time
+	size    int64
+	etag    string
+
+	// Canceled by close, which also aborts a fetch in progress
+	stop   context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newExternalLimits loads the table for the first time and starts
+// refreshing it. It fails if the table cannot be loaded, unless the
+// fallback does without it.
+func newExternalLimits(ctx caddy.Context, cfg ExternalLimits, events *caddyevents.App) (*externalLimits, error) {
+	e := &externalLimits{
+		cfg:    cfg,
+		ctx:    ctx,
+		logger: ctx.Logger().Named("external_limits"),
+		events: events,
+		client: &http.Client{Timeout: 30 * time.Second},
+		done:   make(chan struct{}),
+	}
+	e.stop, e.cancel = context.WithCancel(context.Background())
+	if err := e.load(); err != nil {
+		if cfg.Fallback == fallbackStale {
+			e.cancel()
+			return nil, err
+		}
+		e.unavailable(err)
+	}
+	go e.run()
+	return e, nil
+}
+
+// attach makes transitions emit events with ctx and events, those of the
+// config provisioned last, since the table outlives config reloads.
+func (e *externalLimits) attach(ctx caddy.Context, events *caddyevents.App) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.ctx, e.events = ctx, events
+}
+
+// emit emits an event with the events app attached last, if any.
+func (e *externalLimits) emit(name string, data map[string]any) {
+	e.mu.Lock()
+	ctx, events := e.ctx, e.events
+	e.mu.Unlock()
+	if events != nil {
+		events.Emit(ctx, name, data)
+	}
+}
+
+// lookup returns the limit for key, if the table has one, or the fallback
+// limit while the table is unavailable.
+func (e *externalLimits) lookup(key string) (float64, bool) {
+	if e.down.Load() {
+		switch e.cfg.Fallback {
+		case fallbackLocal:
+			return 0, false
+		case fallbackLimit:
+			return e.cfg.FallbackLimit, true
+		}
+	}
+	table := e.table.Load()
+	if table == nil {
+		return 0, false
+	}
+	limit, ok := (*table)[key]
+	return limit, ok
+}
+
+// source names where the table is loaded from, for logs and events.
+func (e *externalLimits) source() string {
+	if e.cfg.File != "" {
+		return e.cfg.File
+	}
+	return e.cfg.URL
+}
+
+// unavailable switches to the fallback after the table failed to load.
+func (e *externalLimits) unavailable(err error) {
+	if e.down.Swap(true) {
+		e.logger.Error("external limits still unavailable", zap.Error(err))
+		return
+	}
+	e.logger.Error("external limits unavailable, falling back",
+		zap.String("source", e.source()),
+		zap.String("fallback", e.cfg.Fallback),
+		zap.Error(err))
+	e.emit("bandwidth_limits_unavailable", map[string]any{
+		"source":   e.source(),
+		"fallback": e.cfg.Fallback,
+		"error":    err.Error(),
+	})
+}
+
+// recovered switches back from the fallback once the table loads again.
+func (e *externalLimits) recovered() {
+	if !e.down.Swap(false) {
+		return
+	}
+	e.logger.Info("external limits available again", zap.String("source", e.source()))
+	e.emit("bandwidth_limits_recovered", map[string]any{
+		"source": e.source(),
+	})
+}
+
+func (e *externalLimits) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(time.Duration(e.cfg.Refresh))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.refresh()
+		case <-e.stop.Done():
+			return
+		}
+	}
+}
+
+// refresh reloads the table, switching to the fallback if that fails and
+// back once it succeeds.
+func (e *externalLimits) refresh() {
+	if err := e.load(); err != nil {
+		e.unavailable(err)
+	} else {
+		e.recovered()
+	}
+}
+
+// close stops refreshing the table.
+func (e *externalLimits) close() {
+	e.cancel()
+	<-e.done
+}
+
+// load reads the document, unless it did not change since the last
+// successful load, and replaces the table with it. The validators of a
+// document are only kept once it parsed, so that an invalid document is
+// not taken for an unchanged valid one on the next refresh.
+func (e *externalLimits) load() error {
+	var data []byte
+	var commit func()
+	var err error
+	if e.cfg.File != "" {
+		data, commit, err = e.readFile()
+	} else {
+		data, commit, err = e.fetch()
+	}
+	if err != nil || data == nil {
+		return err
+	}
+	table, err := parseLimitTable(data)
+	if err != nil {
+		return err
+	}
+	commit()
+	e.table.Store(&table)
+	e.logger.Info("loaded external limits", zap.Int("keys", len(table)))
+	return nil
+}
+
+// readFile returns the contents of the file, or nil if it is unchanged,
+// and a function that keeps its validators.
+func (e *externalLimits) readFile() ([]byte, func(), error) {
+	info, err := os.Stat(e.cfg.File)
+	if err != nil {
+		return nil, nil, err
+	}
+	if e.table.Load() != nil && info.ModTime().Equal(e.modTime) && info.Size() == e.size {
+		return nil, nil, nil
+	}
+	data, err := os.ReadFile(e.cfg.File)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() { e.modTime, e.size = info.ModTime(), info.Size() }, nil
+}
+
+// fetch returns the body of the URL, or nil if it is unchanged, and a
+// function that keeps its validators.
+func (e *externalLimits) fetch() ([]byte, func(), error) {
+	req, err := http.NewRequestWithContext(e.stop, http.MethodGet, e.cfg.URL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if e.etag != "" && e.table.Load() != nil {
+		req.Header.Set("If-None-Match", e.etag)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	etag := resp.Header.Get("ETag")
+	return data, func() { e.etag = etag }, nil
+}
@@ -0,0 +1,101 @@
+package bandwidth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestExternalLimitsInvalidDocument(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	file := filepath.Join(t.TempDir(), "limits.json")
+	write := func(doc string) {
+		if err := os.WriteFile(file, []byte(doc), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"alice": "5MB"}`)
+	e, err := newExternalLimits(ctx, ExternalLimits{
+		File:     file,
+		Refresh:  caddy.Duration(time.Hour),
+		Fallback: fallbackLocal,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.close()
+
+	// An invalid document must keep the source down on every refresh, not
+	// pass for an unchanged valid one after the first
+	write(`{"alice": [`)
+	for tick := range 2 {
+		e.refresh()
+		if !e.down.Load() {
+			t.Fatalf("tick %d: source recovered with an invalid document", tick)
+		}
+		if limit, ok := e.lookup("alice"); ok {
+			t.Errorf("tick %d: got limit %v, want the local fallback", tick, limit)
+		}
+	}
+
+	write(`{"alice": "6MB"}`)
+	e.refresh()
+	if e.down.Load() {
+		t.Fatal("source still down with a valid document")
+	}
+	if limit, ok := e.lookup("alice"); !ok || limit != 6e6 {
+		t.Errorf("got limit %v, %v, want 6000000", limit, ok)
+	}
+}
+
+func TestExternalLimitsCloseAbortsFetch(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	hung := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Write([]byte(`{"alice": "5MB"}`))
+			return
+		}
+		// Refreshes hang until the client gives up
+		if requests == 2 {
+			close(hung)
+		}
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+
+	e, err := newExternalLimits(ctx, ExternalLimits{
+		URL:      srv.URL,
+		Refresh:  caddy.Duration(time.Millisecond),
+		Fallback: fallbackStale,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-hung
+	closed := make(chan struct{})
+	go func() {
+		e.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close blocked on a hung fetch")
+	}
+}
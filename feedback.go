@@ -0,0 +1,160 @@
+package bandwidth
+
+import (
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+func init() {
+	caddy.RegisterModule(StallAwareSelection{})
+}
+
+// stallHalfLife is how quickly an upstream's stall score decays, so that
+// upstreams that stopped receiving traffic are eventually tried again.
+const stallHalfLife = 30 * time.Second
+
+// stallSmoothing is the weight of a single observation in the score.
+const stallSmoothing = 0.2
+
+// upstreamStalls tracks, per upstream address, how much of their time
+// throttled responses proxied from that upstream spent waiting for tokens.
+var upstreamStalls = &stallTracker{scores: make(map[string]stallScore)}
+
+type stallScore struct {
+	value   float64
+	updated time.Time
+}
+
+// decayed returns the score's value as of now.
+func (s stallScore) decayed(now time.Time) float64 {
+	return s.value * math.Exp2(-float64(now.Sub(s.updated))/float64(stallHalfLife))
+}
+
+type stallTracker struct {
+	mu     sync.Mutex
+	scores map[string]stallScore
+}
+
+// observe records a response from upstream that spent waited out of
+// elapsed waiting for tokens.
+func (t *stallTracker) observe(upstream string, waited, elapsed time.Duration) {
+	if upstream == "" || elapsed <= 0 {
+		return
+	}
+	ratio := min(float64(waited)/float64(elapsed), 1)
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prev := t.scores[upstream].decayed(now)
+	t.scores[upstream] = stallScore{
+		value:   prev + stallSmoothing*(ratio-prev),
+		updated: now,
+	}
+}
+
+// score returns the fraction of time, between 0 and 1, that recent
+// throttled responses from upstream spent stalled.
+func (t *stallTracker) score(upstream string) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.scores[upstream].decayed(time.Now())
+}
+
+// StallAwareSelection is a reverse_proxy load balancing policy that steers
+// new requests away from upstreams whose clients are consistently
+// saturated by bandwidth shaping, as reported by bandwidth handlers with
+// upstream_feedback enabled. Among the remaining upstreams, the one with
+// the fewest active requests is chosen.
+type StallAwareSelection struct {
+	// Threshold is the stall score, between 0 and 1, above which an
+	// upstream is avoided if others are available. Defaults to 0.5.
+	Threshold float64 `json:"threshold,omitempty"`
+}
+
+func (StallAwareSelection) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.selection_policies.bandwidth_aware",
+		New: func() caddy.Module { return new(StallAwareSelection) },
+	}
+}
+
+func (s *StallAwareSelection) Provision(ctx caddy.Context) error {
+	if s.Threshold == 0 {
+		s.Threshold = 0.5
+	}
+	return nil
+}
+
+func (s StallAwareSelection) Select(pool reverseproxy.UpstreamPool, _ *http.Request, _ http.ResponseWriter) *reverseproxy.Upstream {
+	var best *reverseproxy.Upstream
+	var bestSaturated bool
+	var bestScore float64
+	var bestReqs, ties int
+	for _, upstream := range pool {
+		if !upstream.Available() {
+			continue
+		}
+		score := upstreamStalls.score(upstream.Dial)
+		saturated := score > s.Threshold
+		reqs := upstream.NumRequests()
+
+		// Prefer unsaturated upstreams with the fewest requests; if all
+		// are saturated, prefer the least stalled one
+		better := best == nil
+		equal := false
+		if !better {
+			switch {
+			case saturated != bestSaturated:
+				better = !saturated
+			case saturated:
+				better = score < bestScore
+			default:
+				better = reqs < bestReqs
+				equal = reqs == bestReqs
+			}
+		}
+		if better {
+			best, bestSaturated, bestScore, bestReqs, ties = upstream, saturated, score, reqs, 1
+		} else if equal {
+			// Break ties randomly using reservoir sampling
+			ties++
+			if rand.IntN(ties) == 0 {
+				best, bestScore = upstream, score
+			}
+		}
+	}
+	return best
+}
+
+// UnmarshalCaddyfile sets up the policy from Caddyfile tokens. Syntax:
+//
+//	lb_policy bandwidth_aware [<threshold>]
+func (s *StallAwareSelection) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume policy name
+	if d.NextArg() {
+		threshold, err := strconv.ParseFloat(d.Val(), 64)
+		if err != nil {
+			return d.Errf("parsing threshold: %v", err)
+		}
+		s.Threshold = threshold
+	}
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*StallAwareSelection)(nil)
+	_ reverseproxy.Selector = (*StallAwareSelection)(nil)
+	_ caddyfile.Unmarshaler = (*StallAwareSelection)(nil)
+)
@@ -0,0 +1,77 @@
+package bandwidth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// ResetFlood detects clients that repeatedly open throttled responses and
+// reset them before completion, such as HTTP/2 rapid-reset abuse of
+// pacing, and escalates their key to reject mode.
+type ResetFlood struct {
+	// MaxResets is the number of resets within Window that escalates a
+	// key. Required.
+	MaxResets int `json:"max_resets,omitempty"`
+
+	// Window over which resets are counted. Defaults to 10s.
+	Window caddy.Duration `json:"window,omitempty"`
+
+	// RejectFor is how long an escalated key is rejected with 429 Too
+	// Many Requests. Defaults to 1m.
+	RejectFor caddy.Duration `json:"reject_for,omitempty"`
+}
+
+func (rf *ResetFlood) provision() error {
+	if rf.MaxResets <= 0 {
+		return fmt.Errorf("max_resets must be positive")
+	}
+	if rf.Window < 0 || rf.RejectFor < 0 {
+		return fmt.Errorf("window and reject_for must not be negative")
+	}
+	if rf.Window == 0 {
+		rf.Window = caddy.Duration(10 * time.Second)
+	}
+	if rf.RejectFor == 0 {
+		rf.RejectFor = caddy.Duration(time.Minute)
+	}
+	return nil
+}
+
+// retain returns how long the reset history of an idle key must be kept.
+func (rf *ResetFlood) retain() time.Duration {
+	return max(time.Duration(rf.Window), time.Duration(rf.RejectFor))
+}
+
+// record counts a reset by the key and reports whether it escalated the
+// key, in which case the key is rejected until the returned time.
+func (rf *ResetFlood) record(ks *keyState, now time.Time) (time.Time, bool) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if now.Before(ks.rejectUntil) {
+		return ks.rejectUntil, false
+	}
+	cutoff := now.Add(-time.Duration(rf.Window))
+	recent := ks.resets[:0]
+	for _, t := range ks.resets {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	ks.resets = append(recent, now)
+	if len(ks.resets) < rf.MaxResets {
+		return time.Time{}, false
+	}
+	ks.resets = nil
+	ks.rejectUntil = now.Add(time.Duration(rf.RejectFor))
+	return ks.rejectUntil, true
+}
+
+// rejecting returns how much longer the key is rejected, or 0 if it is not
+// escalated.
+func (ks *keyState) rejecting(now time.Time) time.Duration {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return max(ks.rejectUntil.Sub(now), 0)
+}
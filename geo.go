@@ -0,0 +1,39 @@
+package bandwidth
+
+import (
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// GeoLimits select the limit by the client's country, as resolved by a
+// geoip module.
+type GeoLimits struct {
+	// Country is a placeholder resolving to the client's ISO 3166-1
+	// alpha-2 country code, e.g. "{geoip2.country_code}".
+	Country string `json:"country,omitempty"`
+
+	// Countries maps country codes to limits in bytes per second. A limit
+	// of 0 leaves clients from that country unthrottled.
+	Countries map[string]float64 `json:"countries,omitempty"`
+
+	// Default is the limit for countries not listed, including clients
+	// whose country could not be resolved. If unset, Limit applies.
+	Default *float64 `json:"default,omitempty"`
+}
+
+// limitFor returns the limit for the country the request resolves to,
+// along with the country.
+func (g *GeoLimits) limitFor(repl *caddy.Replacer) (float64, string, bool) {
+	if g == nil {
+		return 0, "", false
+	}
+	country := strings.ToUpper(strings.TrimSpace(repl.ReplaceAll(g.Country, "")))
+	if limit, ok := g.Countries[country]; ok {
+		return limit, country, true
+	}
+	if g.Default != nil {
+		return *g.Default, country, true
+	}
+	return 0, country, false
+}
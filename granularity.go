@@ -0,0 +1,15 @@
+package bandwidth
+
+// What the limit of a handler that is neither keyed nor static applies to,
+// see Middleware.Granularity.
+const (
+	// granularityStream gives every request its own buckets, so that each
+	// HTTP/2 or HTTP/3 stream gets the full limit.
+	granularityStream = "stream"
+
+	// granularityConnection shares the buckets among the requests in
+	// flight on a client connection, so that a client multiplexing many
+	// streams, e.g. a gRPC channel, gets the limit once rather than once
+	// per stream.
+	granularityConnection = "connection"
+)
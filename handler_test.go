@@ -0,0 +1,40 @@
+package bandwidth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// serve serves r with the handler, responding with size bytes, and
+// returns the response and how much virtual time it took.
+func serve(t *testing.T, vc *virtualClock, m *Middleware, r *http.Request, size int) (*httptest.ResponseRecorder, time.Duration) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r = caddyhttp.PrepareRequest(r, caddy.NewReplacer(), w, nil)
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		_, err := w.Write(make([]byte, size))
+		return err
+	})
+	var err error
+	elapsed := vc.elapsed(func() { err = m.ServeHTTP(w, r, next) })
+	if err != nil {
+		if he, ok := err.(caddyhttp.HandlerError); ok {
+			w.Code = he.StatusCode
+		} else {
+			t.Fatal(err)
+		}
+	}
+	return w, elapsed
+}
+
+// requestFrom returns a request from the given client address.
+func requestFrom(remote string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = remote
+	return r
+}
@@ -0,0 +1,29 @@
+package bandwidth
+
+import (
+	"net"
+	"strings"
+)
+
+// lookupHostLimit returns the limit configured for the request host,
+// matching an exact entry first and then a wildcard entry for the parent
+// domain, such as "*.example.com".
+func lookupHostLimit(hosts map[string]float64, hostport string) (float64, bool) {
+	if len(hosts) == 0 {
+		return 0, false
+	}
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if limit, ok := hosts[host]; ok {
+		return limit, true
+	}
+	if _, parent, ok := strings.Cut(host, "."); ok {
+		if limit, ok := hosts["*."+parent]; ok {
+			return limit, true
+		}
+	}
+	return 0, false
+}
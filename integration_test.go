@@ -0,0 +1,237 @@
+//go:build integration
+
+package bandwidth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddytest"
+)
+
+// integrationConfig serves throttled routes on {http}, a port picked by
+// the test along with {admin} and {https}. Streamed responses come from an
+// upstream that flushes, so that they are chunked and carry trailers.
+const integrationConfig = `
+{
+	skip_install_trust
+	admin localhost:{admin}
+	http_port {http}
+	https_port {https}
+	grace_period 1ns
+	auto_https off
+}
+
+http://localhost:{http} {
+	route /placeholder {
+		bandwidth {
+			limit {http.request.header.X-Limit}
+			trailers {
+				X-Limit {http.bandwidth.limit}
+				X-Sent {http.bandwidth.bytes_sent}
+				X-Wait {http.bandwidth.wait_ms}
+			}
+		}
+		reverse_proxy {upstream}
+	}
+	route /keyed {
+		bandwidth {
+			limit 1000
+			key {http.request.header.X-Key}
+		}
+		reverse_proxy {upstream}
+	}
+	route /upload {
+		bandwidth {
+			upload_limit 1000
+		}
+		reverse_proxy {upstream}
+	}
+}
+`
+
+// integrationTester is Caddy running the integration config.
+type integrationTester struct {
+	*caddytest.Tester
+	base string // URL of the site
+}
+
+// newIntegrationTester starts Caddy with the integration config in front of
+// an upstream that drains request bodies and streams a 3000 byte response.
+// Responses to /keyed are held until two of them are in flight, so that
+// they overlap. Token waits use a virtual clock, which is returned.
+func newIntegrationTester(t *testing.T) (*integrationTester, *virtualClock) {
+	t.Helper()
+	if reflect.TypeOf(json.RawMessage{}).PkgPath() != "encoding/json" {
+		// Caddy recognizes module maps by the package of json.RawMessage,
+		// which moves with encoding/json v2
+		t.Fatal("caddy cannot load configs with encoding/json v2; run the integration tests with GOEXPERIMENT=nojsonv2")
+	}
+	var pair barrier
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			t.Errorf("upstream reading body: %v", err)
+		}
+		if r.URL.Path == "/keyed" {
+			pair.wait(2)
+		}
+		for range 3 {
+			w.Write(bytes.Repeat([]byte("x"), 1000))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	vc := useVirtualClock(t)
+	admin, httpPort, httpsPort := freePort(t), freePort(t), freePort(t)
+	tester := caddytest.NewTester(t).WithDefaultOverrides(caddytest.Config{AdminPort: admin})
+	config := strings.NewReplacer(
+		"{admin}", fmt.Sprint(admin),
+		"{http}", fmt.Sprint(httpPort),
+		"{https}", fmt.Sprint(httpsPort),
+		"{upstream}", strings.TrimPrefix(upstream.URL, "http://"),
+	).Replace(integrationConfig)
+	tester.InitServer(config, "caddyfile")
+	return &integrationTester{Tester: tester, base: fmt.Sprintf("http://localhost:%d", httpPort)}, vc
+}
+
+// freePort returns a port that is free to listen on.
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// barrier releases waiting goroutines in groups.
+type barrier struct {
+	mu      sync.Mutex
+	waiting int
+	release chan struct{}
+}
+
+// wait blocks until n goroutines are waiting.
+func (b *barrier) wait(n int) {
+	b.mu.Lock()
+	if b.release == nil {
+		b.release = make(chan struct{})
+	}
+	release := b.release
+	b.waiting++
+	if b.waiting == n {
+		close(release)
+		b.waiting, b.release = 0, nil
+	}
+	b.mu.Unlock()
+	<-release
+}
+
+func get(t *testing.T, tester *integrationTester, path string, header ...string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, tester.base+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp := tester.AssertResponseCode(req, http.StatusOK)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestIntegration(t *testing.T) {
+	tester, vc := newIntegrationTester(t)
+
+	t.Run("placeholders", func(t *testing.T) {
+		for _, tt := range []struct {
+			limit      string
+			wantLimit  string
+			wantWait   time.Duration
+			wantWaitMs string
+		}{
+			// The first second's worth is sent from the bucket
+			{limit: "1000", wantLimit: "1000", wantWait: 2 * time.Second, wantWaitMs: "2000"},
+			{limit: "500", wantLimit: "500", wantWait: 5 * time.Second, wantWaitMs: "5000"},
+			// An empty limit leaves the response unthrottled
+			{limit: "", wantLimit: "0", wantWait: 0, wantWaitMs: "0"},
+		} {
+			var resp *http.Response
+			var body []byte
+			got := vc.elapsed(func() {
+				resp, body = get(t, tester, "/placeholder", "X-Limit", tt.limit)
+			})
+			if len(body) != 3000 {
+				t.Errorf("limit %q: got %d bytes, want 3000", tt.limit, len(body))
+			}
+			if got != tt.wantWait {
+				t.Errorf("limit %q: took %s, want %s", tt.limit, got, tt.wantWait)
+			}
+			if tt.limit == "" {
+				// Unthrottled responses have no trailers
+				continue
+			}
+			for name, want := range map[string]string{"X-Limit": tt.wantLimit, "X-Sent": "3000", "X-Wait": tt.wantWaitMs} {
+				if v := resp.Trailer.Get(name); v != want {
+					t.Errorf("limit %q: trailer %s is %q, want %q", tt.limit, name, v, want)
+				}
+			}
+		}
+	})
+
+	t.Run("keyed sharing", func(t *testing.T) {
+		both := func(key1, key2 string) time.Duration {
+			return vc.elapsed(func() {
+				var wg sync.WaitGroup
+				for _, key := range []string{key1, key2} {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						get(t, tester, "/keyed", "X-Key", key)
+					}()
+				}
+				wg.Wait()
+			})
+		}
+		// Responses with the same key share one burst and one rate
+		if got, want := both("a", "a"), 5*time.Second; got != want {
+			t.Errorf("two responses with the same key took %s, want %s", got, want)
+		}
+		// With their own buckets they take 2s each, which may or may not
+		// overlap depending on when they start
+		if got, limit := both("b", "c"), 4*time.Second; got > limit {
+			t.Errorf("two responses with different keys took %s, want at most %s", got, limit)
+		}
+	})
+
+	t.Run("upload limiting", func(t *testing.T) {
+		got := vc.elapsed(func() {
+			req, err := http.NewRequest(http.MethodPost, tester.base+"/upload", bytes.NewReader(make([]byte, 3000)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := tester.AssertResponseCode(req, http.StatusOK)
+			resp.Body.Close()
+		})
+		if want := 2 * time.Second; got != want {
+			t.Errorf("upload took %s, want %s", got, want)
+		}
+	})
+}
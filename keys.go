@@ -0,0 +1,284 @@
+package bandwidth
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
+)
+
+// keyState is the state shared by all in-flight requests that resolve to
+// the same key.
+type keyState struct {
+	mu            sync.Mutex
+	limiter       *rate.Limiter
+	uploadLimiter *rate.Limiter
+	avgLimiter    *rate.Limiter // nil if the long-run average is not capped
+	quota         *quota        // nil unless the key may overdraw avgLimiter, see Overage
+	dual          dualBucket    // zero unless peak shaping is configured, see Peak
+	inflight      *semaphore.Weighted
+	streams       *semaphore.Weighted // nil if concurrent responses are not capped
+	starts        *rate.Limiter       // nil if new transfers are not capped
+	sched         scheduler           // orders access to limiter by priority class
+	resets        []time.Time         // recent client resets, see ResetFlood
+	rejectUntil   time.Time           // set while the key is escalated
+	demand        float64             // recent demand to warm-start buckets with, see WarmStart
+	used          bool                // whether a request used the state, see markUsed
+	saturation    saturation          // starvation of the key's responses, see RejectWhen
+	refs          int
+	idleSince     time.Time
+}
+
+// limiterFor returns the key's shared response limiter, creating it on
+// first use. A limit of 0 means the request is not throttled and nil is
+// returned.
+func (ks *keyState) limiterFor(limit float64) *rate.Limiter {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	created := ks.limiter == nil
+	lim := sharedLimiter(&ks.limiter, limit)
+	if created {
+		drain(lim, ks.demand)
+	}
+	return lim
+}
+
+// markUsed records that a request used the state and reports whether an
+// earlier request did already.
+func (ks *keyState) markUsed() bool {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	used := ks.used
+	ks.used = true
+	return used
+}
+
+// uploadLimiterFor is like limiterFor, but for request bodies.
+func (ks *keyState) uploadLimiterFor(limit float64) *rate.Limiter {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return sharedLimiter(&ks.uploadLimiter, limit)
+}
+
+// sharedLimiter returns *lim, creating it on first use. If the resolved
+// limit changed since the limiter was created, the limiter is adjusted in
+// place so that concurrent requests see the new rate.
+func sharedLimiter(lim **rate.Limiter, limit float64) *rate.Limiter {
+	if limit <= 0 {
+		return nil
+	}
+	if *lim == nil {
+		*lim = newLimiter(limit)
+	} else if (*lim).Limit() != rate.Limit(limit) {
+		now := clk.Now()
+		(*lim).SetLimitAt(now, rate.Limit(limit))
+		(*lim).SetBurstAt(now, burstFor(limit))
+	}
+	return *lim
+}
+
+// newLimiter returns a limiter for limit bytes per second.
+func newLimiter(limit float64) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(limit), burstFor(limit))
+}
+
+// burstFor returns the burst for a limiter of limit bytes per second: one
+// second worth of tokens, but at least one byte, so that rates below one
+// byte per second still make progress one byte at a time.
+func burstFor(limit float64) int {
+	if limit >= math.MaxInt {
+		return math.MaxInt
+	}
+	return max(int(limit), 1)
+}
+
+// waitAll blocks until n tokens are available from all limiters and
+// reports whether it had to sleep for them. The tokens are reserved from
+// all buckets at once, so that a request holding tokens of one bucket does
+// not sit on them while waiting for another.
+func waitAll(ctx context.Context, n int, lims ...*rate.Limiter) (bool, error) {
+	now := clk.Now()
+	reservations := make([]*rate.Reservation, 0, len(lims))
+	cancel := func() {
+		now := clk.Now()
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+	}
+	var delay time.Duration
+	for _, lim := range lims {
+		r := lim.ReserveN(now, n)
+		if !r.OK() {
+			cancel()
+			return false, fmt.Errorf("rate: Wait(n=%d) exceeds limiter's burst %d", n, lim.Burst())
+		}
+		reservations = append(reservations, r)
+		delay = max(delay, r.DelayFrom(now))
+	}
+	if delay == 0 {
+		return false, nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		cancel()
+		return false, fmt.Errorf("rate: Wait(n=%d) would exceed context deadline", n)
+	}
+	if err := clk.SleepUntil(ctx, now.Add(delay)); err != nil {
+		cancel()
+		return true, err
+	}
+	return true, nil
+}
+
+// tieredLimit returns the effective rate of limit capped by the limiters
+// of further tiers. A limit of 0 means the tiers alone apply.
+func tieredLimit(limit float64, tiers []*rate.Limiter) float64 {
+	for _, t := range tiers {
+		if tl := float64(t.Limit()); limit <= 0 || tl < limit {
+			limit = tl
+		}
+	}
+	return limit
+}
+
+// avgBurst returns the bucket size that caps the average rate at limit
+// over window: a full window's worth of bytes.
+func avgBurst(limit float64, window time.Duration) int {
+	return burstFor(limit * window.Seconds())
+}
+
+// keyOptions configure the state created for each key.
+type keyOptions struct {
+	maxInflight     int64
+	startsPerMinute int
+	maxStreams      int64
+	avgLimit        float64                  // long-run average rate, 0 if not capped
+	avgWindow       time.Duration            // window over which the average is enforced
+	overageRate     float64                  // rate beyond the average's budget, see Overage
+	overageGrace    int64                    // bytes by which the budget may be overdrawn
+	peak            float64                  // peak rate of the dual bucket, 0 if not configured
+	sustained       float64                  // sustained rate of the dual bucket
+	peakDuration    time.Duration            // how long a full dual bucket lasts at peak
+	retain          time.Duration            // how long to keep the history of idle keys
+	demand          func(key string) float64 // recent demand of a key, nil unless warm-starting
+	sessionTTL      time.Duration            // how long sessions keep their key, see Sessions
+}
+
+// keyRegistry tracks the state of every key with at least one request in
+// flight. State is dropped once the last request for a key completes,
+// unless it has history that must outlive requests, in which case it is
+// kept until the key has been idle for idleTimeout.
+type keyRegistry struct {
+	mu          sync.Mutex
+	states      map[string]*keyState
+	sessions    map[string]*sessionKey // key of each session, see Sessions
+	opts        keyOptions
+	idleTimeout time.Duration
+	lastSweep   time.Time
+}
+
+func newKeyRegistry(opts keyOptions) *keyRegistry {
+	kr := &keyRegistry{
+		states:    make(map[string]*keyState),
+		sessions:  make(map[string]*sessionKey),
+		opts:      opts,
+		lastSweep: clk.Now(),
+	}
+	if opts.startsPerMinute > 0 {
+		// Long enough for the starts bucket to refill completely
+		kr.idleTimeout = time.Minute
+	}
+	if opts.avgLimit > 0 {
+		// Long enough for the average bucket to pay back its overage and
+		// refill completely
+		payback := time.Duration(float64(opts.overageGrace) / opts.avgLimit * float64(time.Second))
+		kr.idleTimeout = max(kr.idleTimeout, opts.avgWindow+payback)
+	}
+	if opts.peak > 0 {
+		// Long enough for the sustained bucket to refill completely
+		kr.idleTimeout = max(kr.idleTimeout, refillTime(opts.peak, opts.sustained, opts.peakDuration))
+	}
+	// Keep the buckets of sessions' keys as long as the sessions
+	kr.idleTimeout = max(kr.idleTimeout, opts.retain, opts.sessionTTL)
+	return kr
+}
+
+// acquire returns the state for key, creating it if needed. Every call must
+// be paired with a call to release.
+func (kr *keyRegistry) acquire(key string) *keyState {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.sweep()
+	ks, ok := kr.states[key]
+	if !ok {
+		ks = new(keyState)
+		if kr.opts.demand != nil {
+			ks.demand = kr.opts.demand(key)
+		}
+		if kr.opts.maxInflight > 0 {
+			ks.inflight = semaphore.NewWeighted(kr.opts.maxInflight)
+		}
+		if kr.opts.maxStreams > 0 {
+			ks.streams = semaphore.NewWeighted(kr.opts.maxStreams)
+		}
+		if n := kr.opts.startsPerMinute; n > 0 {
+			ks.starts = rate.NewLimiter(rate.Every(time.Minute/time.Duration(n)), n)
+		}
+		if kr.opts.avgLimit > 0 {
+			ks.avgLimiter = rate.NewLimiter(rate.Limit(kr.opts.avgLimit), avgBurst(kr.opts.avgLimit, kr.opts.avgWindow))
+			drain(ks.avgLimiter, ks.demand)
+			if kr.opts.overageRate > 0 {
+				ks.quota = &quota{limiter: newLimiter(kr.opts.overageRate)}
+			}
+		}
+		if kr.opts.peak > 0 {
+			ks.dual = newDualBucket(kr.opts.peak, kr.opts.sustained, kr.opts.peakDuration)
+			drain(ks.dual.sustained, ks.demand)
+		}
+		kr.states[key] = ks
+	}
+	ks.refs++
+	return ks
+}
+
+// release drops a reference obtained by acquire.
+func (kr *keyRegistry) release(key string) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	ks, ok := kr.states[key]
+	if !ok {
+		return
+	}
+	ks.refs--
+	if ks.refs <= 0 {
+		ks.saturation.reset()
+		if kr.idleTimeout == 0 {
+			delete(kr.states, key)
+		} else {
+			ks.idleSince = clk.Now()
+		}
+	}
+}
+
+// sweep drops the state of keys that have been idle for longer than the
+// idle timeout. It runs at most once per timeout. kr.mu must be held.
+func (kr *keyRegistry) sweep() {
+	now := clk.Now()
+	if kr.idleTimeout == 0 || now.Sub(kr.lastSweep) < kr.idleTimeout {
+		return
+	}
+	kr.lastSweep = now
+	for key, ks := range kr.states {
+		if ks.refs <= 0 && now.Sub(ks.idleSince) >= kr.idleTimeout {
+			delete(kr.states, key)
+		}
+	}
+	for session, sk := range kr.sessions {
+		if now.Sub(sk.lastSeen) >= kr.opts.sessionTTL {
+			delete(kr.sessions, session)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package bandwidth
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// MethodLimit overrides the limits of requests with a given HTTP method,
+// e.g. to throttle downloads by GET and uploads by PUT differently.
+type MethodLimit struct {
+	// Limit replaces the response limit, in bytes per second. 0 leaves
+	// responses unthrottled; nil keeps the handler's limit.
+	Limit *float64 `json:"limit,omitempty"`
+
+	// UploadLimit replaces the request body limit, in bytes per second. 0
+	// leaves request bodies unthrottled; nil keeps the handler's
+	// UploadLimit.
+	UploadLimit *float64 `json:"upload_limit,omitempty"`
+}
+
+// normalizeMethods returns the method limits keyed by upper-case method,
+// checking that no limit is negative.
+func normalizeMethods(methods map[string]MethodLimit) (map[string]MethodLimit, error) {
+	normalized := make(map[string]MethodLimit, len(methods))
+	for method, ml := range methods {
+		if (ml.Limit != nil && *ml.Limit < 0) || (ml.UploadLimit != nil && *ml.UploadLimit < 0) {
+			return nil, fmt.Errorf("limits for method %s must not be negative", method)
+		}
+		normalized[strings.ToUpper(method)] = ml
+	}
+	return normalized, nil
+}
+
+// uploadLimiterFor returns the upload limiter of a request that is not
+// keyed: shared by all such requests at the handler's upload limit, or of
+// its own if the limit is set for the request's method.
+func (m Middleware) uploadLimiterFor(limit float64, perMethod bool) *rate.Limiter {
+	if perMethod {
+		if limit <= 0 {
+			return nil
+		}
+		return newLimiter(limit)
+	}
+	return m.shared.uploadLimiterFor(limit)
+}
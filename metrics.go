@@ -0,0 +1,111 @@
+package bandwidth
+
+import (
+	"errors"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace, metricsSubsystem = "caddy", "http_bandwidth"
+
+// metrics holds the collectors shared by all bandwidth handlers of a config.
+type metrics struct {
+	announced   prometheus.Counter
+	escalations prometheus.Counter
+
+	// Clients detected reading far below their limit, per policy
+	slowClients *prometheus.CounterVec
+
+	// Capacity reserved through the admin API, per policy
+	reserved *prometheus.GaugeVec
+
+	// Transfers that ended early, per policy and reason
+	partial *prometheus.CounterVec
+
+	// Pacing overhead, per policy
+	chunks  *prometheus.CounterVec
+	waits   *prometheus.CounterVec
+	wakeups *prometheus.CounterVec
+}
+
+func newMetrics(ctx caddy.Context) *metrics {
+	registry := ctx.GetMetricsRegistry()
+	return &metrics{
+		announced: registerCollector(registry, prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "announced_total",
+			Help:      "Requests served under the previous policy during an announcement window.",
+		})),
+		escalations: registerCollector(registry, prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "escalations_total",
+			Help:      "Keys escalated to reject mode for resetting throttled responses.",
+		})),
+		slowClients: registerCollector(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "slow_clients_total",
+			Help:      "Clients detected reading throttled responses far below their limit, per policy.",
+		}, []string{"policy"})),
+		reserved: registerCollector(registry, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "reserved_bytes_per_second",
+			Help:      "Capacity reserved for particular keys by active reservations, per policy.",
+		}, []string{"policy"})),
+		partial: registerCollector(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "partial_transfers_total",
+			Help:      "Throttled responses that ended early, per policy and reason.",
+		}, []string{"policy", "reason"})),
+		chunks: registerCollector(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "chunks_total",
+			Help:      "Chunks written by throttled responses, per policy.",
+		}, []string{"policy"})),
+		waits: registerCollector(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "waits_total",
+			Help:      "Chunks of throttled responses that had to wait for tokens, per policy.",
+		}, []string{"policy"})),
+		wakeups: registerCollector(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "wakeups_total",
+			Help:      "Times throttled responses blocked and were woken up again, per policy.",
+		}, []string{"policy"})),
+	}
+}
+
+// observePacing adds the pacing counters of a finished response to the
+// totals of its policy. Counting happens per response rather than per
+// chunk, to keep the pacing loop free of shared state.
+func (m *metrics) observePacing(policy string, lw *limitedResponseWriter) {
+	m.chunks.WithLabelValues(policy).Add(float64(lw.chunks))
+	m.waits.WithLabelValues(policy).Add(float64(lw.waits))
+	m.wakeups.WithLabelValues(policy).Add(float64(lw.wakeups))
+}
+
+// registerCollector registers c with registry and returns it. If an
+// identical collector was already registered by another handler, the
+// existing one is returned instead, so that handlers share their series.
+func registerCollector[T prometheus.Collector](registry *prometheus.Registry, c T) T {
+	if registry == nil {
+		return c
+	}
+	if err := registry.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(T); ok {
+				return existing
+			}
+		}
+	}
+	return c
+}
@@ -0,0 +1,52 @@
+package bandwidth
+
+import (
+	"net/http"
+
+	"golang.org/x/time/rate"
+)
+
+// How a handler behaves inside the response of another bandwidth handler,
+// see Middleware.Nested.
+const (
+	// nestedStack wraps the response again, so that it waits on the
+	// buckets of each handler in turn.
+	nestedStack = "stack"
+
+	// nestedCompose adds the handler's buckets to the enclosing handler's
+	// response, so that the outer limit is a ceiling that inner handlers
+	// can only lower.
+	nestedCompose = "compose"
+)
+
+// outerWriter returns the throttled response writer of an enclosing
+// bandwidth handler that w wraps, or nil if there is none.
+func outerWriter(w http.ResponseWriter) *limitedResponseWriter {
+	for {
+		if lw, ok := w.(*limitedResponseWriter); ok {
+			return lw
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = u.Unwrap()
+	}
+}
+
+// compose adds the buckets of a nested handler's response to the
+// writer, so that every chunk waits on both handlers' buckets at once and
+// the lower limit wins. The nested buckets stay in effect for the rest of
+// the response, even if the writer's own limit is lifted by a status
+// limit or min_size.
+func (l *limitedResponseWriter) compose(inner *limitedResponseWriter) {
+	for _, lim := range []*rate.Limiter{inner.limiter, inner.avgLimiter, inner.sustained} {
+		if lim != nil {
+			l.nested = append(l.nested, lim)
+		}
+	}
+	l.nested = append(l.nested, inner.tiers...)
+	if inner.limit > 0 && (l.limit <= 0 || inner.limit < l.limit) {
+		l.limit = inner.limit
+	}
+}
@@ -0,0 +1,265 @@
+package bandwidth
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// Overage configures what happens once a key has spent the budget of its
+// average limit, i.e. its quota of AverageLimit times AverageWindow bytes.
+// Without it, the key is held to the average limit. With it, the key may
+// overdraw the budget by Grace bytes at a reduced Rate, and is blocked or
+// held back once those are spent too. Overdrawn bytes are paid back as the
+// budget refills at the average limit.
+type Overage struct {
+	// Grace is how many bytes a key may send beyond its quota. With 0, the
+	// default, overage is not capped unless Block is set, in which case
+	// the key is blocked as soon as the quota is spent.
+	Grace int64 `json:"grace,omitempty"`
+
+	// Rate paces the bytes a key sends beyond its quota, in bytes per
+	// second. Defaults to the average limit.
+	Rate float64 `json:"rate,omitempty"`
+
+	// Block rejects requests of a key with 429 Too Many Requests and a
+	// Retry-After header once its grace is spent, and cuts off its
+	// responses in flight, instead of holding it back until its budget has
+	// recovered. The error can be rendered by handle_errors, e.g. with
+	// templates.
+	Block bool `json:"block,omitempty"`
+}
+
+func (o *Overage) provision(averageLimit float64) error {
+	if o.Grace < 0 || o.Rate < 0 {
+		return fmt.Errorf("grace and rate must not be negative")
+	}
+	if o.Rate == 0 {
+		o.Rate = averageLimit
+	}
+	return nil
+}
+
+// QuotaExceededError is the error of a request whose key has spent its
+// quota and grace with Overage.Block set. It is served with status 429 if
+// the response has not started yet, and the response's outcome is
+// "quota_exceeded".
+type QuotaExceededError struct {
+	// Key is the key that exceeded its quota.
+	Key string
+	// RetryAfter is how long until the key may send again.
+	RetryAfter time.Duration
+	// Written is the number of bytes sent before the response was cut off.
+	Written int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	if e.Written == 0 {
+		return fmt.Sprintf("key '%s' exceeded its quota, retry in %s", e.Key, e.RetryAfter)
+	}
+	return fmt.Sprintf("throttled transfer aborted after key '%s' exceeded its quota with %d bytes sent", e.Key, e.Written)
+}
+
+// quota is the overage state of a key.
+type quota struct {
+	limiter *rate.Limiter // paces the key while it is over its quota
+
+	mu      sync.Mutex
+	over    bool // set once the budget ran short, until it has recovered
+	blocked bool // set once the grace is spent with Block, until then too
+}
+
+// state is the quota state of a key whose budget is avg, given that it
+// needs n more tokens of it. A key goes over its quota once the budget
+// runs short, and stays over until the budget has refilled completely, so
+// that it is paced at the overage rate for the rest of the quota period
+// even if that is below the average limit. beyond is how many bytes the
+// key would overdraw its budget by on top of the grace, 0 if none.
+func (q *quota) state(o *Overage, avg *rate.Limiter, n int, now time.Time) (over, blocked bool, beyond float64) {
+	tokens := avg.TokensAt(now)
+	if o.Grace > 0 || o.Block {
+		beyond = max(float64(n)-tokens-float64(o.Grace), 0)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if tokens >= float64(avg.Burst()) {
+		q.over, q.blocked = false, false
+	}
+	if tokens < float64(n) {
+		q.over = true
+	}
+	if q.over && o.Block && beyond > 0 {
+		q.blocked = true
+	}
+	return q.over, q.blocked, beyond
+}
+
+// recovery returns how long the budget avg takes to refill completely,
+// which ends the quota period of a key over its quota.
+func recovery(avg *rate.Limiter, now time.Time) time.Duration {
+	missing := float64(avg.Burst()) - avg.TokensAt(now)
+	return time.Duration(max(missing, 0) / float64(avg.Limit()) * float64(time.Second))
+}
+
+// checkQuota rejects the request if its key is blocked for having spent
+// its quota and grace, see Overage.Block.
+func (m Middleware) checkQuota(w http.ResponseWriter, ks *keyState, key string) error {
+	if ks.quota == nil || ks.avgLimiter == nil || !m.Overage.Block {
+		return nil
+	}
+	now := clk.Now()
+	if _, blocked, _ := ks.quota.state(m.Overage, ks.avgLimiter, 1, now); !blocked {
+		return nil
+	}
+	delay := recovery(ks.avgLimiter, now)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	m.log("key exceeded its quota",
+		zap.String("key", key),
+		zap.Duration("retry_after", delay))
+	return caddyhttp.Error(http.StatusTooManyRequests, &QuotaExceededError{Key: key, RetryAfter: delay})
+}
+
+// overdraw decides how a chunk of n tokens is paced while the key is over
+// its quota. Within the grace, the chunk waits on the overage limiter
+// instead of the budget, which is charged afterwards by the returned
+// function. Beyond the grace, it fails with a *QuotaExceededError if the
+// key is blocked, or else waits on the budget like any other chunk.
+func (l *limitedResponseWriter) overdraw(lims []*rate.Limiter, n int) ([]*rate.Limiter, func(), error) {
+	avg := l.avgLimiter
+	now := clk.Now()
+	over, blocked, beyond := l.quota.state(l.overage, avg, n, now)
+	switch {
+	case blocked:
+		return nil, nil, &QuotaExceededError{Key: l.key, RetryAfter: recovery(avg, now), Written: l.written}
+	case !over || beyond > 0:
+		return lims, nil, nil
+	}
+	paced := make([]*rate.Limiter, 0, len(lims))
+	for _, lim := range lims {
+		if lim != avg {
+			paced = append(paced, lim)
+		}
+	}
+	paced = append(paced, l.quota.limiter)
+	return paced, func() { avg.ReserveN(clk.Now(), n) }, nil
+}
+
+// quotaState is the state of a key's quota, as exported and imported by
+// the quotas admin endpoint to carry it across instances.
+type quotaState struct {
+	// Spent is how many bytes of the budget the key has spent, more than
+	// the budget if it overdrew it under Overage
+	Spent int64 `json:"spent"`
+	// Over and Blocked are the key's Overage state
+	Over    bool `json:"over,omitempty"`
+	Blocked bool `json:"blocked,omitempty"`
+}
+
+func (s quotaState) validate() error {
+	if s.Spent < 0 {
+		return fmt.Errorf("spent must not be negative")
+	}
+	return nil
+}
+
+// exportQuotas returns the state of the keys of named policies that have
+// spent some of their budget, by policy and key. Keys of a policy shared by
+// several handlers are listed with the most spent budget.
+func exportQuotas() map[string]map[string]quotaState {
+	now := clk.Now()
+	all := make(map[string]map[string]quotaState)
+	handlerStates.Range(func(_, value any) bool {
+		state := value.(*handlerState)
+		if state.policy == "" || state.keys == nil {
+			return true
+		}
+		state.keys.mu.Lock()
+		defer state.keys.mu.Unlock()
+		for key, ks := range state.keys.states {
+			s, ok := ks.quotaState(now)
+			if !ok {
+				continue
+			}
+			if all[state.policy] == nil {
+				all[state.policy] = make(map[string]quotaState)
+			}
+			if prev, ok := all[state.policy][key]; !ok || s.Spent > prev.Spent {
+				all[state.policy][key] = s
+			}
+		}
+		return true
+	})
+	return all
+}
+
+// importQuotas applies the quota states of batch to the keys of every
+// handler of their policies with an average limit, creating keys as
+// needed. Budgets are only ever spent by an import, never refilled, so
+// that a key cannot regain budget by being imported.
+func importQuotas(batch map[string]map[string]quotaState) {
+	now := clk.Now()
+	handlerStates.Range(func(_, value any) bool {
+		state := value.(*handlerState)
+		byKey, ok := batch[state.policy]
+		if !ok || state.policy == "" || state.keys == nil || state.keys.opts.avgLimit <= 0 {
+			return true
+		}
+		for key, s := range byKey {
+			ks := state.keys.acquire(key)
+			ks.restoreQuota(s, now)
+			state.keys.release(key)
+		}
+		return true
+	})
+}
+
+// quotaState returns the state of the key's quota, if it has spent some
+// of its budget.
+func (ks *keyState) quotaState(now time.Time) (quotaState, bool) {
+	status := quotaStatusOf(ks, now)
+	if status == nil {
+		return quotaState{}, false
+	}
+	ks.mu.Lock()
+	burst := ks.avgLimiter.Burst()
+	ks.mu.Unlock()
+	s := quotaState{
+		Spent:   int64(burst) - status.Remaining + status.Overdrawn,
+		Over:    status.Over,
+		Blocked: status.Blocked,
+	}
+	return s, s.Spent > 0 || s.Over || s.Blocked
+}
+
+// restoreQuota spends the key's budget until it has spent as much as s,
+// and carries over its Overage state.
+func (ks *keyState) restoreQuota(s quotaState, now time.Time) {
+	ks.mu.Lock()
+	avg, q := ks.avgLimiter, ks.quota
+	ks.mu.Unlock()
+	if avg == nil {
+		return
+	}
+	burst := avg.Burst()
+	// Reservations may not exceed the burst, so overdrawn budgets are
+	// spent in several
+	missing := float64(s.Spent) - (float64(burst) - avg.TokensAt(now))
+	for missing >= 1 {
+		n := min(int(missing), burst)
+		avg.ReserveN(now, n)
+		missing -= float64(n)
+	}
+	if q != nil {
+		q.mu.Lock()
+		q.over = q.over || s.Over
+		q.blocked = q.blocked || s.Blocked
+		q.mu.Unlock()
+	}
+}
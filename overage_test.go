@@ -0,0 +1,120 @@
+package bandwidth
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestOverageCaddyfile(t *testing.T) {
+	var m Middleware
+	err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`bandwidth {
+		key {http.request.header.X-User}
+		average_limit 1MB 1h
+		overage {
+			grace 1GB
+			overage_rate 500KB
+			block
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Overage{Grace: 1e9, Rate: 500e3, Block: true}
+	if m.Overage == nil || *m.Overage != want {
+		t.Errorf("got %+v, want %+v", m.Overage, want)
+	}
+
+	for _, input := range []string{
+		`bandwidth {
+			overage on
+		}`,
+		`bandwidth {
+			overage {
+				grace lots
+			}
+		}`,
+		`bandwidth {
+			overage {
+				block now
+			}
+		}`,
+		`bandwidth {
+			overage {
+				refund
+			}
+		}`,
+	} {
+		var m Middleware
+		if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("%s: parsed, want an error", input)
+		}
+	}
+}
+
+func TestOverageProvision(t *testing.T) {
+	for _, tt := range []struct {
+		config  string
+		wantErr bool
+	}{
+		{config: `{"key": "{http.request.header.X-User}", "average_limit": 1000, "overage": {"grace": 1000}}`},
+		// Overage is about the budget of the average limit
+		{config: `{"key": "{http.request.header.X-User}", "limit": 1000, "overage": {"grace": 1000}}`, wantErr: true},
+		{config: `{"key": "{http.request.header.X-User}", "average_limit": 1000, "overage": {"grace": -1}}`, wantErr: true},
+		{config: `{"key": "{http.request.header.X-User}", "average_limit": 1000, "overage": {"rate": -1}}`, wantErr: true},
+	} {
+		m, err := loadHandler(t, tt.config)
+		if err == nil {
+			m.Cleanup()
+		}
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: loaded, want an error", tt.config)
+		} else if !tt.wantErr && err != nil {
+			t.Errorf("%s: %v", tt.config, err)
+		}
+	}
+}
+
+func TestOverageThrottling(t *testing.T) {
+	vc := useVirtualClock(t)
+	// A budget of 10000 bytes, overdrawn by at most 2000 at 500 B/s
+	m, err := loadHandler(t, `{"key": "{http.request.header.X-User}", "limit": 10000,
+		"average_limit": 1000, "average_window": "10s", "overage": {"grace": 2000, "rate": 500}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Cleanup()
+
+	if _, got := serve(t, vc, m, requestBy("alice"), 10000); got != 0 {
+		t.Errorf("spending the budget took %s, want 0s", got)
+	}
+	// The first 500 bytes of the grace come from the overage bucket
+	if _, got := serve(t, vc, m, requestBy("alice"), 1500); got != 2*time.Second {
+		t.Errorf("overdrawing the budget took %s, want 2s", got)
+	}
+}
+
+func TestOverageBlock(t *testing.T) {
+	vc := useVirtualClock(t)
+	m, err := loadHandler(t, `{"key": "{http.request.header.X-User}", "limit": 10000,
+		"average_limit": 1000, "average_window": "10s", "overage": {"block": true}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Cleanup()
+
+	serve(t, vc, m, requestBy("alice"), 10000)
+	w, _ := serve(t, vc, m, requestBy("alice"), 1000)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d for a key over its quota, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got == "" {
+		t.Error("no Retry-After header")
+	}
+	// Other keys have budgets of their own
+	if w, _ := serve(t, vc, m, requestBy("bob"), 1000); w.Code != http.StatusOK {
+		t.Errorf("got status %d for another key, want 200", w.Code)
+	}
+}
@@ -0,0 +1,151 @@
+package bandwidth
+
+import (
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+)
+
+// keyOverride replaces a named policy's limit for a single key, e.g. to
+// grant a customer more bandwidth or to penalize an abusive client.
+type keyOverride struct {
+	// Limit is the rate in bytes per second for the key. 0 leaves the key
+	// unthrottled.
+	Limit float64 `json:"limit"`
+
+	// Expires is when the override lapses. It never does if zero.
+	Expires time.Time `json:"expires,omitempty"`
+
+	// Annotations are freeform notes stored with the override, such as a
+	// ticket ID or the reason it was put in place, so actions are
+	// auditable later.
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Created is when the override was last set.
+	Created time.Time `json:"created"`
+}
+
+func (o keyOverride) expired(now time.Time) bool {
+	return !o.Expires.IsZero() && !now.Before(o.Expires)
+}
+
+func (o keyOverride) validate() error {
+	if o.Limit < 0 {
+		return fmt.Errorf("limit must not be negative")
+	}
+	return nil
+}
+
+// overrideStore holds per-key overrides of named policies. Overrides are
+// kept in memory for the lifetime of the process, across config reloads.
+type overrideStore struct {
+	mu       sync.RWMutex
+	byPolicy map[string]map[string]keyOverride
+}
+
+var overrides = &overrideStore{byPolicy: make(map[string]map[string]keyOverride)}
+
+// get returns the override for key in the named policy, unless it expired.
+func (s *overrideStore) get(policy, key string) (keyOverride, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	o, ok := s.byPolicy[policy][key]
+	if !ok || o.expired(time.Now()) {
+		return keyOverride{}, false
+	}
+	return o, true
+}
+
+// list returns all overrides of the named policy that have not expired.
+func (s *overrideStore) list(policy string) map[string]keyOverride {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for key, o := range s.byPolicy[policy] {
+		if o.expired(now) {
+			delete(s.byPolicy[policy], key)
+		}
+	}
+	list := maps.Clone(s.byPolicy[policy])
+	if list == nil {
+		list = make(map[string]keyOverride)
+	}
+	return list
+}
+
+// set stores an override, returning the one it replaced, if any.
+func (s *overrideStore) set(policy, key string, o keyOverride) (keyOverride, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.byPolicy[policy] == nil {
+		s.byPolicy[policy] = make(map[string]keyOverride)
+	}
+	prev, ok := s.byPolicy[policy][key]
+	s.byPolicy[policy][key] = o
+	return prev, ok
+}
+
+// remove deletes an override, returning it if it existed.
+func (s *overrideStore) remove(policy, key string) (keyOverride, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := s.byPolicy[policy][key]
+	delete(s.byPolicy[policy], key)
+	return prev, ok
+}
+
+// all returns the overrides of every policy that have not expired.
+func (s *overrideStore) all() map[string]map[string]keyOverride {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.snapshot()
+}
+
+// snapshot is like all, but s.mu must be held.
+func (s *overrideStore) snapshot() map[string]map[string]keyOverride {
+	now := time.Now()
+	all := make(map[string]map[string]keyOverride)
+	for policy, byKey := range s.byPolicy {
+		for key, o := range byKey {
+			if o.expired(now) {
+				continue
+			}
+			if all[policy] == nil {
+				all[policy] = make(map[string]keyOverride)
+			}
+			all[policy][key] = o
+		}
+	}
+	return all
+}
+
+// load stores a batch of overrides, typically exported from another
+// instance, all at once. Unless merge is set, existing overrides are
+// dropped first; otherwise imported overrides replace existing ones for
+// the same key. Expired overrides are skipped. It returns the overrides
+// in place before.
+func (s *overrideStore) load(batch map[string]map[string]keyOverride, merge bool) map[string]map[string]keyOverride {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := s.snapshot()
+	if !merge {
+		s.byPolicy = make(map[string]map[string]keyOverride)
+	}
+	now := time.Now()
+	for policy, byKey := range batch {
+		for key, o := range byKey {
+			if o.expired(now) {
+				continue
+			}
+			if o.Created.IsZero() {
+				o.Created = now.UTC()
+			}
+			if s.byPolicy[policy] == nil {
+				s.byPolicy[policy] = make(map[string]keyOverride)
+			}
+			s.byPolicy[policy][key] = o
+		}
+	}
+	return before
+}
@@ -0,0 +1,36 @@
+package bandwidth
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Pacing algorithms.
+const (
+	// algorithmTokenBucket lets responses burst up to a second worth of
+	// bytes at once, then waits for the bucket to refill.
+	algorithmTokenBucket = "token_bucket"
+
+	// algorithmLeakyBucket spreads the writes of each response evenly,
+	// in small chunks on a fixed interval.
+	algorithmLeakyBucket = "leaky_bucket"
+)
+
+// defaultPacingInterval is the interval between writes of the leaky
+// bucket algorithm when none is configured.
+const defaultPacingInterval = 20 * time.Millisecond
+
+// pacerFor returns a limiter draining a response evenly at limit bytes per
+// second, one chunk per interval, reusing pacer if its rate still matches.
+// It returns nil if the response is not limited.
+func pacerFor(pacer *rate.Limiter, limit float64, interval time.Duration) *rate.Limiter {
+	if limit <= 0 {
+		return nil
+	}
+	if pacer != nil && pacer.Limit() == rate.Limit(limit) {
+		return pacer
+	}
+	chunk := burstFor(limit * interval.Seconds())
+	return rate.NewLimiter(rate.Limit(limit), chunk)
+}
@@ -0,0 +1,43 @@
+package bandwidth
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// PathLimit selects a limit for requests whose path matches a pattern.
+type PathLimit struct {
+	// Path is a path pattern with the syntax of the path matcher, e.g.
+	// "/downloads/*" or "*.mp4".
+	Path string `json:"path"`
+
+	// Limit is the rate in bytes per second applied to matching requests.
+	// Matching requests are not throttled when 0.
+	Limit float64 `json:"limit,omitempty"`
+
+	matcher caddyhttp.MatchPath
+}
+
+func (p *PathLimit) provision(ctx caddy.Context) error {
+	if p.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	if p.Limit < 0 {
+		return fmt.Errorf("limit for path '%s' must not be negative", p.Path)
+	}
+	p.matcher = caddyhttp.MatchPath{p.Path}
+	return p.matcher.Provision(ctx)
+}
+
+// matchPath returns the first entry whose pattern matches the request path.
+func matchPath(paths []PathLimit, r *http.Request) (PathLimit, bool) {
+	for _, p := range paths {
+		if p.matcher.Match(r) {
+			return p, true
+		}
+	}
+	return PathLimit{}, false
+}
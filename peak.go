@@ -0,0 +1,66 @@
+package bandwidth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.org/x/time/rate"
+)
+
+const defaultPeakDuration = 5 * time.Second
+
+// validatePeak checks the dual bucket settings, see Middleware.Peak, and
+// fills in the default duration.
+func (m *Middleware) validatePeak() error {
+	if m.Peak < 0 || m.Sustained < 0 || m.PeakDuration < 0 {
+		return fmt.Errorf("peak, peak_duration and sustained must not be negative")
+	}
+	if m.Peak == 0 && m.Sustained == 0 {
+		if m.PeakDuration > 0 {
+			return fmt.Errorf("peak_duration requires peak and sustained")
+		}
+		return nil
+	}
+	if m.Peak == 0 || m.Sustained == 0 {
+		return fmt.Errorf("peak and sustained must be set together")
+	}
+	if m.Sustained >= m.Peak {
+		return fmt.Errorf("sustained must be lower than peak")
+	}
+	if m.PeakDuration == 0 {
+		m.PeakDuration = caddy.Duration(defaultPeakDuration)
+	}
+	return nil
+}
+
+// dualBucket is a two-bucket shaper, like the boost of cable modems: a
+// small bucket at the peak rate caps the instantaneous rate like a tier,
+// and a large bucket at the sustained rate holds enough tokens for the
+// peak duration, like the bucket of AverageLimit. A transfer that finds
+// both full runs at the peak rate until the large bucket is drained, then
+// at the sustained rate. Idle time refills the large bucket, so the next
+// burst runs at the peak rate again.
+type dualBucket struct {
+	peak      *rate.Limiter
+	sustained *rate.Limiter
+}
+
+func newDualBucket(peak, sustained float64, duration time.Duration) dualBucket {
+	return dualBucket{
+		peak:      newLimiter(peak),
+		sustained: rate.NewLimiter(rate.Limit(sustained), boostBurst(peak, sustained, duration)),
+	}
+}
+
+// boostBurst returns the size of the sustained bucket: the bytes that a
+// transfer at peak takes beyond the sustained rate over duration, but at
+// least a second's worth of the sustained rate.
+func boostBurst(peak, sustained float64, duration time.Duration) int {
+	return max(burstFor((peak-sustained)*duration.Seconds()), burstFor(sustained))
+}
+
+// refillTime returns how long an idle sustained bucket takes to fill up.
+func refillTime(peak, sustained float64, duration time.Duration) time.Duration {
+	return time.Duration(float64(boostBurst(peak, sustained, duration)) / sustained * float64(time.Second))
+}
@@ -0,0 +1,35 @@
+package bandwidth
+
+import (
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Placeholders describing how a request was throttled, for access logs
+// (e.g. with log_append) and for handlers running after the response, such
+// as templates of error pages. The limit and key are set before the
+// response is written, and all values are final once it is finished.
+const (
+	placeholderLimit         = "http.bandwidth.limit"
+	placeholderKey           = "http.bandwidth.key"
+	placeholderBytesSent     = "http.bandwidth.bytes_sent"
+	placeholderWaitMs        = "http.bandwidth.wait_ms"
+	placeholderBytesReceived = "http.bandwidth.bytes_received"
+	placeholderUploadWaitMs  = "http.bandwidth.upload_wait_ms"
+	placeholderOutcome       = "http.bandwidth.outcome"
+	placeholderRate          = "http.bandwidth.rate"
+)
+
+// setPlaceholders sets the placeholders of a finished throttled response.
+func setPlaceholders(repl *caddy.Replacer, lw *limitedResponseWriter, body *limitedBody, outcome string, elapsed time.Duration) {
+	repl.Set(placeholderLimit, lw.limit)
+	repl.Set(placeholderBytesSent, lw.written)
+	repl.Set(placeholderWaitMs, lw.waited.Milliseconds())
+	repl.Set(placeholderRate, int64(deliveryRate(lw.written, elapsed)))
+	repl.Set(placeholderOutcome, outcome)
+	if body != nil {
+		repl.Set(placeholderBytesReceived, body.read)
+		repl.Set(placeholderUploadWaitMs, body.waited.Milliseconds())
+	}
+}
@@ -0,0 +1,198 @@
+package bandwidth
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// policySettings are the settings of a named handler that can be changed
+// at runtime through the admin API.
+type policySettings struct {
+	Limit       float64 `json:"limit"`
+	UploadLimit float64 `json:"upload_limit"`
+
+	// Drain is set while the policy is draining: transfers in progress
+	// finish at their rates, and new requests are served "unthrottled" or
+	// rejected ("reject"). Empty when the policy is not draining.
+	Drain string `json:"drain,omitempty"`
+}
+
+// policyUpdate changes the settings of a policy. Nil fields are left
+// unchanged.
+type policyUpdate struct {
+	Limit       *float64 `json:"limit,omitempty"`
+	UploadLimit *float64 `json:"upload_limit,omitempty"`
+	Drain       *string  `json:"drain,omitempty"`
+}
+
+func (u policyUpdate) validate() error {
+	if u.Limit != nil && *u.Limit < 0 {
+		return fmt.Errorf("limit must not be negative")
+	}
+	if u.UploadLimit != nil && *u.UploadLimit < 0 {
+		return fmt.Errorf("upload_limit must not be negative")
+	}
+	if u.Drain != nil && !validDrain(*u.Drain) {
+		return fmt.Errorf("unrecognized drain fallback '%s'", *u.Drain)
+	}
+	return nil
+}
+
+func (u policyUpdate) apply(s policySettings) policySettings {
+	if u.Limit != nil {
+		s.Limit = *u.Limit
+	}
+	if u.UploadLimit != nil {
+		s.UploadLimit = *u.UploadLimit
+	}
+	if u.Drain != nil {
+		s.Drain = *u.Drain
+	}
+	return s
+}
+
+// policyRegistration is a handler's reference to a named policy.
+type policyRegistration struct {
+	configured policySettings
+
+	// changed is set if the registration changed the live limits, which
+	// were replaced before.
+	changed  bool
+	replaced policySettings
+}
+
+// policyRegistry holds the settings of all named handlers in the process.
+// Readers load an immutable snapshot, so a batch of updates becomes
+// visible to all requests at once.
+type policyRegistry struct {
+	mu       sync.Mutex                       // serializes writers
+	regs     map[string][]*policyRegistration // oldest first
+	settings atomic.Pointer[map[string]policySettings]
+}
+
+// policies is the process-wide policy registry, shared across config
+// reloads so the admin API can reach handlers of the running config.
+var policies = newPolicyRegistry()
+
+func newPolicyRegistry() *policyRegistry {
+	pr := &policyRegistry{regs: make(map[string][]*policyRegistration)}
+	pr.settings.Store(&map[string]policySettings{})
+	return pr
+}
+
+// register adds a reference to the named policy with the configured
+// settings. Handlers sharing a name share their settings; the most
+// recently registered configuration wins. The live limits only change
+// when the configured ones do, so a reload keeps limits set through the
+// admin API, and a drain always stays in effect, so that a deployment
+// reloading the config does not end it.
+func (pr *policyRegistry) register(name string, s policySettings) *policyRegistration {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	s.Drain = ""
+	reg := &policyRegistration{configured: s}
+	regs := pr.regs[name]
+	pr.swap(func(all map[string]policySettings) {
+		live, ok := all[name]
+		switch {
+		case !ok:
+			all[name] = s
+		case !sameLimits(regs[len(regs)-1].configured, s):
+			reg.changed, reg.replaced = true, live
+			live.Limit, live.UploadLimit = s.Limit, s.UploadLimit
+			all[name] = live
+		}
+	})
+	pr.regs[name] = append(regs, reg)
+	return reg
+}
+
+// unregister drops a reference obtained by register. Dropping the most
+// recent registration, as when a reload fails after it registered,
+// restores the limits it replaced.
+func (pr *policyRegistry) unregister(name string, reg *policyRegistration) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	regs := pr.regs[name]
+	i := slices.Index(regs, reg)
+	if i < 0 {
+		return
+	}
+	regs = slices.Delete(regs, i, i+1)
+	if len(regs) == 0 {
+		delete(pr.regs, name)
+		pr.swap(func(all map[string]policySettings) { delete(all, name) })
+		return
+	}
+	pr.regs[name] = regs
+	if !reg.changed {
+		return
+	}
+	if i < len(regs) {
+		// A later registration of the same configuration now stands for
+		// the change
+		if next := regs[i]; !next.changed {
+			next.changed, next.replaced = true, reg.replaced
+		}
+		return
+	}
+	pr.swap(func(all map[string]policySettings) {
+		live := all[name]
+		live.Limit, live.UploadLimit = reg.replaced.Limit, reg.replaced.UploadLimit
+		all[name] = live
+	})
+}
+
+func sameLimits(a, b policySettings) bool {
+	return a.Limit == b.Limit && a.UploadLimit == b.UploadLimit
+}
+
+// get returns the current settings of the named policy.
+func (pr *policyRegistry) get(name string) (policySettings, bool) {
+	s, ok := (*pr.settings.Load())[name]
+	return s, ok
+}
+
+// all returns the current settings of every policy. The returned map must
+// not be modified.
+func (pr *policyRegistry) all() map[string]policySettings {
+	return *pr.settings.Load()
+}
+
+// update applies all updates atomically: either every policy is updated,
+// or, if any update is invalid or names an unknown policy, none are. It
+// returns the settings of the updated policies before and after.
+func (pr *policyRegistry) update(updates map[string]policyUpdate) (before, after map[string]policySettings, err error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	current := pr.all()
+	for name, u := range updates {
+		if _, ok := current[name]; !ok {
+			return nil, nil, fmt.Errorf("unknown policy '%s'", name)
+		}
+		if err := u.validate(); err != nil {
+			return nil, nil, fmt.Errorf("policy '%s': %v", name, err)
+		}
+	}
+	before = make(map[string]policySettings, len(updates))
+	after = make(map[string]policySettings, len(updates))
+	pr.swap(func(all map[string]policySettings) {
+		for name, u := range updates {
+			before[name] = all[name]
+			all[name] = u.apply(all[name])
+			after[name] = all[name]
+		}
+	})
+	return before, after, nil
+}
+
+// swap replaces the settings snapshot with a modified copy. pr.mu must be
+// held.
+func (pr *policyRegistry) swap(modify func(map[string]policySettings)) {
+	next := maps.Clone(pr.all())
+	modify(next)
+	pr.settings.Store(&next)
+}
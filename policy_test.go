@@ -0,0 +1,93 @@
+package bandwidth
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// loadHandler loads a handler the way Caddy does: provisioning, then
+// validation, cleaning up if either fails.
+func loadHandler(t *testing.T, config string) (*Middleware, error) {
+	t.Helper()
+	m := new(Middleware)
+	if err := json.Unmarshal([]byte(config), m); err != nil {
+		t.Fatalf("%s: %v", config, err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	err := m.Provision(ctx)
+	if err == nil {
+		err = m.Validate()
+	}
+	if err != nil {
+		m.Cleanup()
+		return nil, err
+	}
+	return m, nil
+}
+
+func TestPolicyReload(t *testing.T) {
+	limit := func(want float64) {
+		t.Helper()
+		s, ok := policies.get("reload")
+		if !ok {
+			t.Fatal("policy is not registered")
+		}
+		if s.Limit != want {
+			t.Errorf("got limit %v, want %v", s.Limit, want)
+		}
+	}
+	set := func(v float64) {
+		t.Helper()
+		if _, _, err := policies.update(map[string]policyUpdate{"reload": {Limit: &v}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reload := func(old *Middleware, config string) *Middleware {
+		t.Helper()
+		m, err := loadHandler(t, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		old.Cleanup()
+		return m
+	}
+
+	m, err := loadHandler(t, `{"name": "reload", "limit": 1000}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit(1000)
+
+	// Reloading the same configuration keeps the runtime limit
+	set(5000)
+	m = reload(m, `{"name": "reload", "limit": 1000}`)
+	limit(5000)
+
+	// A new configured limit replaces it
+	m = reload(m, `{"name": "reload", "limit": 2000}`)
+	limit(2000)
+
+	// A config failing validation does not touch the live policy
+	set(7000)
+	if _, err := loadHandler(t, `{"name": "reload", "limit": 3000, "algorithm": "leaky_bucket", "pacing_interval": "2s"}`); err == nil {
+		t.Fatal("invalid config loaded")
+	}
+	limit(7000)
+
+	// Nor does one failing after the handler loaded, once cleaned up
+	failed, err := loadHandler(t, `{"name": "reload", "limit": 3000}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed.Cleanup()
+	limit(7000)
+
+	m.Cleanup()
+	if _, ok := policies.get("reload"); ok {
+		t.Error("policy is still registered after its last handler was cleaned up")
+	}
+}
@@ -0,0 +1,98 @@
+package bandwidth
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// Priority classes, from the highest to the lowest.
+const (
+	priorityHigh = iota
+	priorityNormal
+	priorityLow
+	numPriorities
+)
+
+// parsePriority returns the priority class with the given name.
+func parsePriority(s string) (int, error) {
+	switch s {
+	case "high":
+		return priorityHigh, nil
+	case "", "normal":
+		return priorityNormal, nil
+	case "low":
+		return priorityLow, nil
+	}
+	return 0, fmt.Errorf("unknown priority class '%s'", s)
+}
+
+// scheduler orders access to a shared limiter by priority class. Waiters
+// take turns drawing tokens, and whenever a turn ends, the longest waiting
+// request of the highest class goes next. While the pool keeps up,
+// requests pass straight through; once it is saturated, lower classes only
+// get tokens when no higher class is waiting.
+type scheduler struct {
+	mu     sync.Mutex
+	busy   bool
+	queues [numPriorities][]chan struct{}
+}
+
+// do runs wait, typically a WaitN on the shared limiter, once it is the
+// turn of a request of the given class. It reports whether the request had
+// to queue for its turn.
+func (s *scheduler) do(ctx context.Context, class int, wait func() error) (bool, error) {
+	s.mu.Lock()
+	queued := s.busy
+	if queued {
+		turn := make(chan struct{})
+		s.queues[class] = append(s.queues[class], turn)
+		s.mu.Unlock()
+		select {
+		case <-turn:
+		case <-ctx.Done():
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			select {
+			case <-turn:
+				// Handed the turn while giving up, so pass it on
+				s.next()
+			default:
+				s.dequeue(class, turn)
+			}
+			return true, ctx.Err()
+		}
+	} else {
+		s.busy = true
+		s.mu.Unlock()
+	}
+
+	err := wait()
+	s.mu.Lock()
+	s.next()
+	s.mu.Unlock()
+	return queued, err
+}
+
+// next hands the turn to the next waiter, if any. s.mu must be held.
+func (s *scheduler) next() {
+	for class, queue := range s.queues {
+		if len(queue) > 0 {
+			close(queue[0])
+			s.queues[class] = queue[1:]
+			return
+		}
+	}
+	s.busy = false
+}
+
+// dequeue removes a waiter that gave up. s.mu must be held.
+func (s *scheduler) dequeue(class int, turn chan struct{}) {
+	for i, t := range s.queues[class] {
+		if t == turn {
+			s.queues[class] = slices.Delete(s.queues[class], i, i+1)
+			return
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package bandwidth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestPriorityCaddyfile(t *testing.T) {
+	var m Middleware
+	err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`bandwidth {
+		limit 1MB
+		priority {http.request.header.X-Priority}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Priority != "{http.request.header.X-Priority}" {
+		t.Errorf("got priority %q", m.Priority)
+	}
+	for _, input := range []string{
+		`bandwidth {
+			priority
+		}`,
+		`bandwidth {
+			priority high low
+		}`,
+	} {
+		var m Middleware
+		if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("%s: parsed, want an error", input)
+		}
+	}
+	if _, err := loadHandler(t, `{"limit": 1000, "priority": "urgent"}`); err == nil {
+		t.Error("loaded an unknown priority class")
+	}
+}
+
+// queued returns the number of waiters of each class.
+func (s *scheduler) queued() [numPriorities]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n [numPriorities]int
+	for class, queue := range s.queues {
+		n[class] = len(queue)
+	}
+	return n
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	var s scheduler
+	ctx := context.Background()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.do(ctx, priorityLow, func() error {
+			close(started)
+			<-release
+			return nil
+		})
+		close(done)
+	}()
+	<-started
+
+	// Waiters queue by class while the turn is taken
+	order := make(chan int, 3)
+	enqueue := func(class int, want [numPriorities]int) {
+		go s.do(ctx, class, func() error {
+			order <- class
+			return nil
+		})
+		for s.queued() != want {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	enqueue(priorityLow, [numPriorities]int{0, 0, 1})
+	enqueue(priorityNormal, [numPriorities]int{0, 1, 1})
+	enqueue(priorityHigh, [numPriorities]int{1, 1, 1})
+
+	// A waiter giving up leaves the queue
+	cancelCtx, cancel := context.WithCancel(ctx)
+	gaveUp := make(chan error)
+	go func() {
+		_, err := s.do(cancelCtx, priorityHigh, func() error { return nil })
+		gaveUp <- err
+	}()
+	for s.queued() != [numPriorities]int{2, 1, 1} {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-gaveUp; err != context.Canceled {
+		t.Errorf("waiter gave up with %v, want context.Canceled", err)
+	}
+
+	close(release)
+	<-done
+	for _, want := range []int{priorityHigh, priorityNormal, priorityLow} {
+		if got := <-order; got != want {
+			t.Errorf("class %d went next, want %d", got, want)
+		}
+	}
+}
+
+func TestPriorityThrottling(t *testing.T) {
+	vc := useVirtualClock(t)
+	m, err := loadHandler(t, `{"limit": 1000, "priority": "{http.request.header.X-Priority}"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Cleanup()
+
+	// Classes only order waiters; alone, every class gets the full limit
+	serve(t, vc, m, requestFrom("192.0.2.1:1000"), 1000)
+	for _, class := range []string{"high", "low", "invalid"} {
+		r := requestFrom("192.0.2.1:1000")
+		r.Header.Set("X-Priority", class)
+		if _, got := serve(t, vc, m, r, 2000); got != 2*time.Second {
+			t.Errorf("priority %s: took %s, want 2s", class, got)
+		}
+	}
+}
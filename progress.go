@@ -0,0 +1,144 @@
+package bandwidth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(Progress{})
+	httpcaddyfile.RegisterHandlerDirective("bandwidth_progress", parseProgressCaddyfile)
+}
+
+// defaultProgressInterval is how often progress events are sent when no
+// interval is configured.
+const defaultProgressInterval = time.Second
+
+// Progress is a terminal handler streaming the progress of a throttled
+// download as server-sent events. Clients subscribe with the token the
+// bandwidth handler issued in its ProgressHeader, passed in the "token"
+// query parameter. The token is the only credential: anyone holding it can
+// follow the transfer, but tokens are unguessable and only handed to the
+// client receiving the download.
+type Progress struct {
+	// Interval between progress events. Defaults to 1s.
+	Interval caddy.Duration `json:"interval,omitempty"`
+}
+
+func (Progress) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.bandwidth_progress",
+		New: func() caddy.Module { return new(Progress) },
+	}
+}
+
+func (p *Progress) Provision(ctx caddy.Context) error {
+	if p.Interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	}
+	if p.Interval == 0 {
+		p.Interval = caddy.Duration(defaultProgressInterval)
+	}
+	return nil
+}
+
+// progressEvent is the payload of a progress event.
+type progressEvent struct {
+	BytesSent int64 `json:"bytes_sent"`
+	// Size is the total length of the response, -1 if unknown
+	Size int64 `json:"size"`
+	// Rate is the average rate since the transfer started, in bytes per second
+	Rate int64 `json:"rate"`
+	// ETA is the estimated number of seconds remaining, -1 if unknown
+	ETA  float64 `json:"eta"`
+	Done bool    `json:"done"`
+}
+
+func (p Progress) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("missing token"))
+	}
+	t := stats.lookup(token)
+	if t == nil {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("no active transfer for token"))
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	ticker := time.NewTicker(time.Duration(p.Interval))
+	defer ticker.Stop()
+	for {
+		var done bool
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-t.done:
+			done = true
+		case <-ticker.C:
+		}
+
+		sent := t.sent.Load()
+		ev := progressEvent{BytesSent: sent, Size: t.size.Load(), ETA: -1, Done: done}
+		if elapsed := time.Since(t.started).Seconds(); elapsed > 0 {
+			ev.Rate = int64(float64(sent) / elapsed)
+		}
+		if ev.Size >= 0 && ev.Rate > 0 {
+			ev.ETA = float64(max(ev.Size-sent, 0)) / float64(ev.Rate)
+		}
+		if done {
+			ev.ETA = 0
+		}
+
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data); err != nil {
+			return nil
+		}
+		if err := rc.Flush(); err != nil {
+			return nil
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+func parseProgressCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var p Progress
+
+	for h.Next() {
+		if h.NextArg() {
+			d, err := caddy.ParseDuration(h.Val())
+			if err != nil {
+				return nil, h.Errf("parsing interval value: %v", err)
+			}
+			p.Interval = caddy.Duration(d)
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+		}
+		if h.NextBlock(0) {
+			return nil, h.Errf("unrecognized parameter '%s'", h.Val())
+		}
+	}
+
+	return p, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*Progress)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Progress)(nil)
+)
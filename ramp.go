@@ -0,0 +1,58 @@
+package bandwidth
+
+import (
+	"math"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Ramp-up curves.
+const (
+	rampLinear      = "linear"
+	rampExponential = "exponential"
+)
+
+// rampStartFraction is the fraction of the limit a transfer starts at
+// during ramp-up.
+const rampStartFraction = 0.1
+
+// rampRate returns the rate for a transfer that has completed progress
+// (between 0 and 1) of its ramp-up towards limit.
+func rampRate(limit float64, progress float64, curve string) float64 {
+	start := float64(limit) * rampStartFraction
+	if curve == rampExponential {
+		return start * math.Pow(float64(limit)/start, progress)
+	}
+	return start + (float64(limit)-start)*progress
+}
+
+// ramper slows down the start of a transfer, raising its rate from a
+// fraction of the limit to the full limit over a duration.
+type ramper struct {
+	duration time.Duration
+	curve    string
+	started  time.Time
+	limiter  *rate.Limiter
+}
+
+// update adjusts the ramp limiter to the current point of the ramp and
+// returns it, or nil once the ramp is complete.
+func (rp *ramper) update(limit float64) *rate.Limiter {
+	if rp == nil || limit <= 0 {
+		return nil
+	}
+	now := clk.Now()
+	if rp.limiter == nil {
+		rp.started = now
+		rp.limiter = rate.NewLimiter(0, 1)
+	}
+	progress := float64(now.Sub(rp.started)) / float64(rp.duration)
+	if progress >= 1 {
+		return nil
+	}
+	r := rampRate(limit, progress, rp.curve)
+	rp.limiter.SetLimitAt(now, rate.Limit(r))
+	rp.limiter.SetBurstAt(now, max(int(r), 1))
+	return rp.limiter
+}
@@ -0,0 +1,53 @@
+package bandwidth
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// RangeShaping makes Range requests by the same client for the same
+// resource, such as a video player seeking through a file, share one
+// bucket that stays warm between requests, instead of each getting a
+// fresh per-request limiter and ramp-up.
+type RangeShaping struct {
+	// Client identifies the client owning the bucket of a resource.
+	// Defaults to "{http.request.remote.host}".
+	Client string `json:"client,omitempty"`
+
+	// Retain is how long the bucket of a resource stays warm after its
+	// last Range request finished. Defaults to 1m.
+	Retain caddy.Duration `json:"retain,omitempty"`
+
+	// Exempt is the number of leading bytes of each range that are served
+	// unthrottled, so that seeking starts playback quickly.
+	Exempt int64 `json:"exempt,omitempty"`
+}
+
+const defaultRangeRetain = time.Minute
+
+func (rs *RangeShaping) provision() error {
+	if rs.Client == "" {
+		rs.Client = "{http.request.remote.host}"
+	}
+	if rs.Retain < 0 || rs.Exempt < 0 {
+		return fmt.Errorf("retain and exempt must not be negative")
+	}
+	if rs.Retain == 0 {
+		rs.Retain = caddy.Duration(defaultRangeRetain)
+	}
+	return nil
+}
+
+// key returns the key of the bucket shared by Range requests of the
+// client for the requested resource.
+func (rs *RangeShaping) key(r *http.Request, repl *caddy.Replacer) string {
+	return repl.ReplaceAll(rs.Client, "") + " " + r.Host + r.URL.Path
+}
+
+// isRangeRequest reports whether r asks for part of a resource.
+func isRangeRequest(r *http.Request) bool {
+	return r.Header.Get("Range") != ""
+}
@@ -0,0 +1,102 @@
+package bandwidth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"golang.org/x/time/rate"
+)
+
+// limitedBody paces reads from a request body, so that clients uploading
+// faster than the limit are slowed down by TCP backpressure.
+type limitedBody struct {
+	io.ReadCloser
+	limiter *rate.Limiter
+	ctx     context.Context
+	maxSize int64 // maximum body size, 0 if unlimited
+
+	read     int64         // bytes read from the client
+	waited   time.Duration // total time spent waiting for tokens
+	aborted  bool          // whether a wait was interrupted before completion
+	rejected bool          // whether the body exceeded the maximum size
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	// Never read more than the limiter can grant at once
+	if burst := max(b.limiter.Burst(), 1); len(p) > burst {
+		p = p[:burst]
+	}
+	// Read one byte past the maximum size to detect bodies exceeding it
+	if b.maxSize > 0 && int64(len(p)) > b.maxSize-b.read+1 {
+		p = p[:b.maxSize-b.read+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.maxSize > 0 && b.read+int64(n) > b.maxSize {
+		n = int(b.maxSize - b.read)
+		err = &http.MaxBytesError{Limit: b.maxSize}
+	}
+	b.read += int64(n)
+	// Bodies exceeding the maximum size, whether enforced here or by
+	// request_body, are rejected right away instead of being paced first
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		b.rejected = true
+		return n, caddyhttp.Error(http.StatusRequestEntityTooLarge,
+			&UploadTooLargeError{Limit: mbe.Limit, Declared: -1, Read: b.read})
+	}
+	if n > 0 {
+		start := clk.Now()
+		_, werr := waitAll(b.ctx, n, b.limiter)
+		b.waited += clk.Now().Sub(start)
+		if werr != nil {
+			b.aborted = true
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// UploadTooLargeError is the error of a request whose body exceeds the
+// maximum upload size, either as declared by its Content-Length, or while
+// it is being read. Bodies rejected by request_body's max_size surface as
+// the same error when they are paced. It is served with status 413 and
+// unwraps to *http.MaxBytesError.
+type UploadTooLargeError struct {
+	// Limit is the maximum body size in bytes.
+	Limit int64
+	// Declared is the Content-Length of the request, -1 if unknown or
+	// not exceeding Limit.
+	Declared int64
+	// Read is the number of bytes read and accepted before the body was
+	// rejected.
+	Read int64
+}
+
+func (e *UploadTooLargeError) Error() string {
+	if e.Declared >= 0 {
+		return fmt.Sprintf("request body of %d bytes exceeds the maximum upload size of %d bytes", e.Declared, e.Limit)
+	}
+	return fmt.Sprintf("request body exceeds the maximum upload size of %d bytes after %d bytes", e.Limit, e.Read)
+}
+
+func (e *UploadTooLargeError) Unwrap() error {
+	return &http.MaxBytesError{Limit: e.Limit}
+}
+
+// countingBody counts the bytes read from a request body that is not
+// paced.
+type countingBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
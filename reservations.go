@@ -0,0 +1,217 @@
+package bandwidth
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// reservation sets aside part of a named policy's capacity for a key
+// during a time window, e.g. for a nightly backup job. While it is
+// active, requests of the key draw from a bucket of their own at Limit,
+// and the policy's shared limit is reduced by Limit for everyone else.
+type reservation struct {
+	// ID identifies the reservation. Assigned when it is created.
+	ID string `json:"id"`
+
+	// Key is the key the capacity is reserved for: the value of the
+	// handler's key, or the client IP if the handler is not keyed.
+	Key string `json:"key"`
+
+	// Limit is the reserved rate in bytes per second.
+	Limit float64 `json:"limit"`
+
+	// Start and End delimit the window in which the reservation is active.
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// Daily repeats the window every day at the same times, starting at
+	// Start. The window must be shorter than a day.
+	Daily bool `json:"daily,omitempty"`
+
+	// Annotations are freeform notes stored with the reservation, such as
+	// the job it is for.
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Created is when the reservation was made.
+	Created time.Time `json:"created"`
+
+	limiter *rate.Limiter // shared by the key's requests, created on first use
+}
+
+func (res *reservation) validate() error {
+	if res.Key == "" {
+		return fmt.Errorf("key is required")
+	}
+	if res.Limit <= 0 {
+		return fmt.Errorf("limit must be positive")
+	}
+	if !res.End.After(res.Start) {
+		return fmt.Errorf("end must be after start")
+	}
+	if res.Daily && res.End.Sub(res.Start) >= 24*time.Hour {
+		return fmt.Errorf("daily windows must be shorter than a day")
+	}
+	return nil
+}
+
+// active reports whether now falls within the reservation's window.
+func (res *reservation) active(now time.Time) bool {
+	if now.Before(res.Start) {
+		return false
+	}
+	if res.Daily {
+		return now.Sub(res.Start)%(24*time.Hour) < res.End.Sub(res.Start)
+	}
+	return now.Before(res.End)
+}
+
+// expired reports whether the reservation's window will never open again.
+func (res *reservation) expired(now time.Time) bool {
+	return !res.Daily && !now.Before(res.End)
+}
+
+// overlaps reports whether the windows of two reservations may overlap.
+// Daily windows are assumed to overlap with any window after their start.
+func (res *reservation) overlaps(other *reservation) bool {
+	end, otherEnd := res.End, other.End
+	if res.Daily || other.Daily {
+		end, otherEnd = time.Unix(1<<62, 0), time.Unix(1<<62, 0)
+	}
+	return res.Start.Before(otherEnd) && other.Start.Before(end)
+}
+
+// reservationStore holds the capacity reservations of named policies.
+// Like overrides, reservations are kept in memory for the lifetime of the
+// process, across config reloads.
+type reservationStore struct {
+	mu       sync.Mutex
+	byPolicy map[string]map[string]*reservation
+}
+
+var reservations = &reservationStore{byPolicy: make(map[string]map[string]*reservation)}
+
+// add stores a new reservation, unless together with the reservations
+// that overlap it, it would take up the policy's entire capacity. A
+// capacity of 0 means the policy is not limited, so any reservation fits.
+func (s *reservationStore) add(policy string, res *reservation, capacity float64) error {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(policy, time.Now())
+	if capacity > 0 {
+		total := res.Limit
+		for _, other := range s.byPolicy[policy] {
+			if res.overlaps(other) {
+				total += other.Limit
+			}
+		}
+		if total >= capacity {
+			return fmt.Errorf("reservations of %s B/s would take up the policy's entire capacity of %s B/s",
+				formatRate(total), formatRate(capacity))
+		}
+	}
+	res.ID = hex.EncodeToString(b)
+	if s.byPolicy[policy] == nil {
+		s.byPolicy[policy] = make(map[string]*reservation)
+	}
+	s.byPolicy[policy][res.ID] = res
+	return nil
+}
+
+// list returns the reservations of the named policy that have not
+// expired, ordered by start.
+func (s *reservationStore) list(policy string) []reservation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(policy, time.Now())
+	list := make([]reservation, 0, len(s.byPolicy[policy]))
+	for _, res := range s.byPolicy[policy] {
+		list = append(list, *res)
+	}
+	slices.SortFunc(list, func(a, b reservation) int {
+		return cmp.Or(a.Start.Compare(b.Start), cmp.Compare(a.ID, b.ID))
+	})
+	return list
+}
+
+// get returns a reservation by ID, unless it expired.
+func (s *reservationStore) get(policy, id string) (reservation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res, ok := s.byPolicy[policy][id]
+	if !ok || res.expired(time.Now()) {
+		return reservation{}, false
+	}
+	return *res, true
+}
+
+// remove deletes a reservation, returning it if it existed.
+func (s *reservationStore) remove(policy, id string) (reservation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res, ok := s.byPolicy[policy][id]
+	if !ok {
+		return reservation{}, false
+	}
+	delete(s.byPolicy[policy], id)
+	return *res, true
+}
+
+// reserved returns the total rate reserved in the named policy at now.
+func (s *reservationStore) reserved(policy string, now time.Time) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total float64
+	for _, res := range s.byPolicy[policy] {
+		if res.active(now) {
+			total += res.Limit
+		}
+	}
+	return total
+}
+
+// limiterFor returns the bucket of the reservation active for key in the
+// named policy at now, and the reserved rate, or nil if there is none.
+func (s *reservationStore) limiterFor(policy, key string, now time.Time) (*rate.Limiter, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, res := range s.byPolicy[policy] {
+		if res.Key == key && res.active(now) {
+			if res.limiter == nil {
+				res.limiter = newLimiter(res.Limit)
+			}
+			return res.limiter, res.Limit
+		}
+	}
+	return nil, 0
+}
+
+// prune drops the expired reservations of a policy. s.mu must be held.
+func (s *reservationStore) prune(policy string, now time.Time) {
+	for id, res := range s.byPolicy[policy] {
+		if res.expired(now) {
+			delete(s.byPolicy[policy], id)
+		}
+	}
+}
+
+// unreserved returns what is left of limit once reserved is set aside,
+// but at least a byte per second, so that the rest of the policy keeps
+// making progress even if the policy's limit was lowered below what is
+// reserved.
+func unreserved(limit, reserved float64) float64 {
+	if limit <= 0 || reserved <= 0 {
+		return limit
+	}
+	return max(limit-reserved, 1)
+}
@@ -0,0 +1,75 @@
+package bandwidth
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// RejectWhen refuses new requests of a saturated key right away instead
+// of letting them join the slow queue, for services where refusing is
+// better than trickling. Rejected requests get a Retry-After header
+// estimating when the key's backlog will have drained.
+type RejectWhen struct {
+	// EmptyFor rejects requests once the key's responses have been
+	// waiting for tokens continuously for this long.
+	EmptyFor caddy.Duration `json:"empty_for,omitempty"`
+
+	// Waiters rejects requests once this many responses of the key are
+	// waiting for tokens at the same time.
+	Waiters int `json:"waiters,omitempty"`
+
+	// Status is the status code of rejections: 429 (default) or 503.
+	Status int `json:"status,omitempty"`
+}
+
+func (rw *RejectWhen) provision() error {
+	if rw.EmptyFor < 0 || rw.Waiters < 0 {
+		return fmt.Errorf("empty_for and waiters must not be negative")
+	}
+	if rw.EmptyFor == 0 && rw.Waiters == 0 {
+		return fmt.Errorf("empty_for or waiters is required")
+	}
+	switch rw.Status {
+	case 0:
+		rw.Status = http.StatusTooManyRequests
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+	default:
+		return fmt.Errorf("status must be 429 or 503")
+	}
+	return nil
+}
+
+// saturation tracks whether the responses of a key are starved of tokens.
+type saturation struct {
+	waiters    atomic.Int64 // responses waiting for tokens
+	emptySince atomic.Int64 // since when writes have had to wait, in Unix nanoseconds, 0 if they don't
+}
+
+// observe records that a write waited for tokens or got them right away.
+func (s *saturation) observe(start time.Time, slept bool) {
+	if slept {
+		s.emptySince.CompareAndSwap(0, start.UnixNano())
+	} else {
+		s.emptySince.Store(0)
+	}
+}
+
+// reset forgets that writes had to wait once the key has no responses
+// in flight, so that the state kept for an idle key does not go on
+// rejecting it.
+func (s *saturation) reset() {
+	s.emptySince.Store(0)
+}
+
+// saturated reports whether the key meets a condition of rw.
+func (s *saturation) saturated(rw *RejectWhen, now time.Time) bool {
+	if rw.Waiters > 0 && s.waiters.Load() >= int64(rw.Waiters) {
+		return true
+	}
+	since := s.emptySince.Load()
+	return rw.EmptyFor > 0 && since != 0 && now.Sub(time.Unix(0, since)) >= time.Duration(rw.EmptyFor)
+}
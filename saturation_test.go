@@ -0,0 +1,27 @@
+package bandwidth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestSaturationRecoversWhenDrained(t *testing.T) {
+	// The average limit keeps the state of idle keys
+	kr := newKeyRegistry(keyOptions{avgLimit: 1000, avgWindow: time.Minute})
+	rw := &RejectWhen{EmptyFor: caddy.Duration(time.Second)}
+
+	ks := kr.acquire("a")
+	ks.saturation.observe(time.Now().Add(-time.Minute), true)
+	if !ks.saturation.saturated(rw, time.Now()) {
+		t.Fatal("key starved for a minute is not saturated")
+	}
+	kr.release("a")
+
+	ks = kr.acquire("a")
+	defer kr.release("a")
+	if ks.saturation.saturated(rw, time.Now()) {
+		t.Error("key is still saturated after its responses drained")
+	}
+}
@@ -0,0 +1,75 @@
+package bandwidth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Sessions keeps a client's bucket when the key of its requests changes
+// within the same session, e.g. a mobile client roaming between networks
+// while keyed by IP address. Requests carrying a known session continue
+// to use the key the session started with, so roaming neither resets the
+// client's budget nor grants it a second one.
+type Sessions struct {
+	// ID is the placeholder identifying the session, e.g. a session
+	// cookie or an authenticated user. Requests it resolves to an empty
+	// string for are keyed as usual. Required.
+	ID string `json:"id,omitempty"`
+
+	// Link also makes requests of a session share its bucket when they
+	// arrive from several keys at once, e.g. a client using two networks
+	// simultaneously. Otherwise, requests from a new key get the bucket of
+	// their own key until the session has no requests in flight from its
+	// previous key.
+	Link bool `json:"link,omitempty"`
+
+	// TTL is how long a session keeps its key after its last request.
+	// Defaults to 10m.
+	TTL caddy.Duration `json:"ttl,omitempty"`
+}
+
+const defaultSessionTTL = 10 * time.Minute
+
+func (s *Sessions) provision() error {
+	if s.ID == "" {
+		return fmt.Errorf("id is required")
+	}
+	if s.TTL < 0 {
+		return fmt.Errorf("ttl must not be negative")
+	}
+	if s.TTL == 0 {
+		s.TTL = caddy.Duration(defaultSessionTTL)
+	}
+	return nil
+}
+
+// sessionKey is the key a session is bound to.
+type sessionKey struct {
+	key      string
+	lastSeen time.Time
+}
+
+// resolveSession returns the key a request of session, whose own key is
+// key, should use, binding the session to key if it has none yet.
+func (kr *keyRegistry) resolveSession(session, key string, link bool) string {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	now := clk.Now()
+	sk, ok := kr.sessions[session]
+	if !ok || now.Sub(sk.lastSeen) >= kr.opts.sessionTTL {
+		kr.sessions[session] = &sessionKey{key: key, lastSeen: now}
+		return key
+	}
+	sk.lastSeen = now
+	if sk.key == key || link {
+		return sk.key
+	}
+	// Without linking, the bucket only follows the client once the
+	// previous key is idle
+	if ks, ok := kr.states[sk.key]; ok && ks.refs > 0 {
+		return key
+	}
+	return sk.key
+}
@@ -0,0 +1,118 @@
+package bandwidth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestSessionsCaddyfile(t *testing.T) {
+	var m Middleware
+	err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`bandwidth {
+		limit 1MB
+		key {http.request.remote.host}
+		sessions {http.request.cookie.session} {
+			link
+			ttl 5m
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Sessions{ID: "{http.request.cookie.session}", Link: true, TTL: caddy.Duration(5 * time.Minute)}
+	if m.Sessions == nil || *m.Sessions != want {
+		t.Errorf("got %+v, want %+v", m.Sessions, want)
+	}
+
+	for _, input := range []string{
+		`bandwidth {
+			sessions
+		}`,
+		`bandwidth {
+			sessions {http.request.cookie.session} {
+				ttl soon
+			}
+		}`,
+		`bandwidth {
+			sessions {http.request.cookie.session} {
+				link always
+			}
+		}`,
+		`bandwidth {
+			sessions {http.request.cookie.session} {
+				sticky
+			}
+		}`,
+	} {
+		var m Middleware
+		if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("%s: parsed, want an error", input)
+		}
+	}
+
+	for _, config := range []string{
+		`{"limit": 1000, "sessions": {"id": "{http.request.cookie.session}"}}`,
+		`{"limit": 1000, "key": "{http.request.remote.host}", "sessions": {}}`,
+		`{"limit": 1000, "key": "{http.request.remote.host}", "sessions": {"id": "{http.request.cookie.session}", "ttl": -1}}`,
+	} {
+		if _, err := loadHandler(t, config); err == nil {
+			t.Errorf("%s: loaded, want an error", config)
+		}
+	}
+}
+
+func TestSessionsThrottling(t *testing.T) {
+	vc := useVirtualClock(t)
+	m, err := loadHandler(t, `{"limit": 1000, "key": "{http.request.remote.host}",
+		"sessions": {"id": "{http.request.header.X-Session}"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Cleanup()
+	request := func(remote, session string) time.Duration {
+		r := requestFrom(remote)
+		r.Header.Set("X-Session", session)
+		_, got := serve(t, vc, m, r, 1000)
+		return got
+	}
+
+	// A client roaming to another address keeps its drained bucket
+	request("192.0.2.1:1000", "s1")
+	if got := request("198.51.100.1:1000", "s1"); got != time.Second {
+		t.Errorf("roamed request took %s, want 1s", got)
+	}
+	// while another session from there gets the bucket of its own key
+	if got := request("198.51.100.1:1000", "s2"); got != 0 {
+		t.Errorf("request of another session took %s, want 0s", got)
+	}
+}
+
+func TestSessionsTTL(t *testing.T) {
+	vc := useVirtualClock(t)
+	kr := newKeyRegistry(keyOptions{sessionTTL: time.Minute})
+	if got := kr.resolveSession("s", "a", false); got != "a" {
+		t.Fatalf("new session got key %q, want its own", got)
+	}
+	if got := kr.resolveSession("s", "b", false); got != "a" {
+		t.Errorf("session got key %q, want the one it started with", got)
+	}
+
+	// Without linking, a new key gets its own bucket while the previous
+	// one has requests in flight
+	kr.acquire("a")
+	if got := kr.resolveSession("s", "b", false); got != "b" {
+		t.Errorf("session got key %q while its key is busy, want its own", got)
+	}
+	if got := kr.resolveSession("s", "b", true); got != "a" {
+		t.Errorf("linked session got key %q, want the one it started with", got)
+	}
+	kr.release("a")
+
+	vc.SleepUntil(context.Background(), vc.Now().Add(time.Minute))
+	if got := kr.resolveSession("s", "b", false); got != "b" {
+		t.Errorf("expired session got key %q, want its own", got)
+	}
+}
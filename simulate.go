@@ -0,0 +1,53 @@
+package bandwidth
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Simulate adds latency to every chunk of a response on top of rate
+// limiting, so that the handler can stand in for slow or unreliable
+// networks, such as mobile connections, in development and staging.
+type Simulate struct {
+	// Latency added before each chunk is written.
+	Latency caddy.Duration `json:"latency,omitempty"`
+
+	// Jitter varies the latency of each chunk randomly by up to this much
+	// in either direction.
+	Jitter caddy.Duration `json:"jitter,omitempty"`
+}
+
+func (s *Simulate) provision() error {
+	if s.Latency < 0 || s.Jitter < 0 {
+		return fmt.Errorf("latency and jitter must not be negative")
+	}
+	if s.Latency == 0 && s.Jitter == 0 {
+		return fmt.Errorf("latency or jitter is required")
+	}
+	return nil
+}
+
+// delay returns the latency of the next chunk.
+func (s *Simulate) delay() time.Duration {
+	d := time.Duration(s.Latency)
+	if s.Jitter > 0 {
+		d += time.Duration(rand.Int64N(2*int64(s.Jitter)+1)) - time.Duration(s.Jitter)
+	}
+	return max(d, 0)
+}
+
+// sleep waits for the latency of the next chunk, or until ctx is done.
+func (s *Simulate) sleep(ctx context.Context) error {
+	t := time.NewTimer(s.delay())
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
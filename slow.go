@@ -0,0 +1,146 @@
+package bandwidth
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// SlowClients detects clients that read throttled responses far below
+// their allocation, such as stalled connections or malicious slow
+// readers, which pin goroutines and per-key stream slots. A client's
+// delivery rate is the rate at which it accepts bytes while the response
+// waits on it, so time spent waiting for tokens does not count against it.
+type SlowClients struct {
+	// Ratio is the fraction of the response's limit below which a
+	// client's delivery rate counts as slow. Defaults to 0.1.
+	Ratio float64 `json:"ratio,omitempty"`
+
+	// Grace is how long a client must stay slow before it is reported,
+	// and evicted if Evict is set. Defaults to 30s.
+	Grace caddy.Duration `json:"grace,omitempty"`
+
+	// Evict aborts the transfers of slow clients, including writes that
+	// stall for the whole grace period. Otherwise, slow clients are only
+	// reported.
+	Evict bool `json:"evict,omitempty"`
+}
+
+const (
+	defaultSlowRatio = 0.1
+	defaultSlowGrace = 30 * time.Second
+
+	// slowSample is the period over which delivery rates are measured.
+	slowSample = time.Second
+)
+
+func (sc *SlowClients) provision() error {
+	if sc.Ratio < 0 || sc.Ratio >= 1 {
+		return fmt.Errorf("ratio must be between 0 and 1")
+	}
+	if sc.Grace < 0 {
+		return fmt.Errorf("grace must not be negative")
+	}
+	if sc.Ratio == 0 {
+		sc.Ratio = defaultSlowRatio
+	}
+	if sc.Grace == 0 {
+		sc.Grace = caddy.Duration(defaultSlowGrace)
+	}
+	return nil
+}
+
+// slowTracker measures the delivery rate of a response's client.
+type slowTracker struct {
+	cfg *SlowClients
+	rc  *http.ResponseController // sets write deadlines, nil unless evicting
+
+	sampleStart   time.Time
+	sampleBytes   int64
+	sampleBlocked time.Duration // time spent in writes during the sample
+	slowSince     time.Time     // zero while the client keeps up
+	rate          float64       // delivery rate of the last slow sample
+	reported      bool
+}
+
+func newSlowTracker(cfg *SlowClients, w http.ResponseWriter) *slowTracker {
+	t := &slowTracker{cfg: cfg, sampleStart: time.Now()}
+	if cfg.Evict {
+		t.rc = http.NewResponseController(w)
+	}
+	return t
+}
+
+// beforeWrite bounds the next write by the grace period when evicting,
+// so that a client that stopped reading altogether is cut off too.
+func (t *slowTracker) beforeWrite(now time.Time) {
+	if t.rc != nil {
+		// Not every writer supports deadlines; such writes rely on the
+		// server's write timeout instead
+		_ = t.rc.SetWriteDeadline(now.Add(time.Duration(t.cfg.Grace)))
+	}
+}
+
+// afterWrite records a write of n bytes that took blocked, and reports
+// whether the client has been slow for longer than the grace period.
+func (t *slowTracker) afterWrite(n int, blocked time.Duration, limit float64, now time.Time) bool {
+	t.sampleBytes += int64(n)
+	t.sampleBlocked += blocked
+	if now.Sub(t.sampleStart) < slowSample {
+		return false
+	}
+	rate := math.Inf(1)
+	if t.sampleBlocked > 0 {
+		rate = float64(t.sampleBytes) / t.sampleBlocked.Seconds()
+	}
+	start := t.sampleStart
+	t.sampleStart, t.sampleBytes, t.sampleBlocked = now, 0, 0
+	if limit <= 0 || rate >= t.cfg.Ratio*limit {
+		t.slowSince = time.Time{}
+		return false
+	}
+	if t.slowSince.IsZero() {
+		t.slowSince = start
+	}
+	t.rate = rate
+	return now.Sub(t.slowSince) >= time.Duration(t.cfg.Grace)
+}
+
+// stalled reports whether a write that took blocked and failed was cut
+// off by the grace period's deadline.
+func (t *slowTracker) stalled(blocked time.Duration) bool {
+	return t.rc != nil && blocked >= time.Duration(t.cfg.Grace)
+}
+
+// done clears the write deadline, so that it does not affect writes
+// after the handler returned.
+func (t *slowTracker) done() {
+	if t != nil && t.rc != nil {
+		_ = t.rc.SetWriteDeadline(time.Time{})
+	}
+}
+
+// reportSlowClient logs and announces a client detected as slow.
+func (m Middleware) reportSlowClient(r *http.Request, key string, limit, rate float64) {
+	m.metrics.slowClients.WithLabelValues(m.Name).Inc()
+	m.logger.Warn("client reads throttled response far below its limit",
+		zap.String("uri", r.RequestURI),
+		zap.String("key", key),
+		zap.Float64("limit", limit),
+		zap.Float64("delivery_rate", rate),
+		zap.Bool("evict", m.SlowClients.Evict))
+	if m.events != nil {
+		m.events.Emit(m.ctx, "bandwidth_slow_client", map[string]any{
+			"policy":        m.Name,
+			"key":           key,
+			"uri":           r.RequestURI,
+			"limit":         limit,
+			"delivery_rate": rate,
+			"evicted":       m.SlowClients.Evict,
+		})
+	}
+}
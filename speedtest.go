@@ -0,0 +1,136 @@
+package bandwidth
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(SpeedTest{})
+	httpcaddyfile.RegisterHandlerDirective("bandwidth_test", parseSpeedTestCaddyfile)
+}
+
+// defaultSpeedTestSize is the payload size served when none is configured.
+const defaultSpeedTestSize = 10 << 20
+
+// speedTestBlockSize is the size of the random block repeated to build the
+// payload. Random data keeps the encode handler from compressing it away.
+const speedTestBlockSize = 64 << 10
+
+// SpeedTest is a terminal handler that serves generated data, so shaping
+// configured by the bandwidth handler in front of it can be verified from
+// the outside without placing a real file.
+type SpeedTest struct {
+	// Size is the number of bytes served. Defaults to 10 MiB.
+	Size int64 `json:"size,omitempty"`
+
+	// MaxSize enables the "size" query parameter, letting clients request
+	// up to this many bytes. The parameter is ignored when MaxSize is 0.
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	block []byte
+}
+
+func (SpeedTest) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.bandwidth_test",
+		New: func() caddy.Module { return new(SpeedTest) },
+	}
+}
+
+func (s *SpeedTest) Provision(ctx caddy.Context) error {
+	if s.Size < 0 || s.MaxSize < 0 {
+		return fmt.Errorf("size and max_size must not be negative")
+	}
+	if s.Size == 0 {
+		s.Size = defaultSpeedTestSize
+	}
+	s.block = make([]byte, speedTestBlockSize)
+	if _, err := rand.Read(s.block); err != nil {
+		return fmt.Errorf("generating payload: %v", err)
+	}
+	return nil
+}
+
+func (s SpeedTest) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	size := s.Size
+	if q := r.URL.Query().Get("size"); q != "" && s.MaxSize > 0 {
+		n, err := parseBytes(q)
+		if err != nil || n < 0 {
+			return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid size '%s'", q))
+		}
+		if n > s.MaxSize {
+			return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("size %d exceeds maximum of %d", n, s.MaxSize))
+		}
+		size = n
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	for size > 0 {
+		n := int64(len(s.block))
+		if size < n {
+			n = size
+		}
+		if _, err := w.Write(s.block[:n]); err != nil {
+			return err
+		}
+		size -= n
+	}
+	return nil
+}
+
+func parseSpeedTestCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var s SpeedTest
+
+	for h.Next() {
+		if h.NextArg() {
+			var err error
+			s.Size, err = parseBytes(h.Val())
+			if err != nil {
+				return nil, h.Errf("parsing size value: %v", err)
+			}
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+		}
+		for h.NextBlock(0) {
+			switch h.Val() {
+			case "max_size":
+				if !h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				var err error
+				s.MaxSize, err = parseBytes(h.Val())
+				if err != nil {
+					return nil, h.Errf("parsing max_size value: %v", err)
+				}
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
+			default:
+				return nil, h.Errf("unrecognized parameter '%s'", h.Val())
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*SpeedTest)(nil)
+	_ caddyhttp.MiddlewareHandler = (*SpeedTest)(nil)
+)
@@ -0,0 +1,140 @@
+package bandwidth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.org/x/time/rate"
+)
+
+// handlerStates holds the limiter state of every provisioned handler, so
+// that state survives config reloads as long as the handler's
+// configuration is unchanged.
+var handlerStates = caddy.NewUsagePool()
+
+// handlerState is the limiter state of a handler.
+type handlerState struct {
+	policy     string        // name of the handler's policy, if any
+	shared     *keyState     // limiters shared by all requests of an unkeyed handler
+	keys       *keyRegistry  // nil if the handler is not keyed
+	ranges     *keyRegistry  // nil unless Range requests share buckets
+	conns      *keyRegistry  // nil unless connections are limited
+	streams    *keyRegistry  // nil unless streams share their connection's buckets
+	global     *rate.Limiter // nil unless the handler's total rate is limited
+	weighted   *weightedPool // nil unless keys share global by weight
+	accounting *accountant   // nil if usage is not accounted
+	external   *externalLimits
+	load       *loadMonitor // nil unless limits adapt to load
+}
+
+func (s *handlerState) Destruct() error {
+	if s.load != nil {
+		s.load.close()
+	}
+	if s.external != nil {
+		s.external.close()
+	}
+	if s.accounting != nil {
+		s.accounting.close()
+	}
+	return nil
+}
+
+var (
+	identitiesMu sync.Mutex
+	identities   = make(map[context.Context]map[string]int)
+	pools        = make(map[context.Context]map[string]string) // pool config hashes per config
+)
+
+// handlerIdentity returns a key identifying a handler across config
+// reloads: a hash of its configuration, plus its position among handlers
+// with identical configuration in the same config, so that those don't
+// end up sharing state.
+func handlerIdentity(ctx caddy.Context, config []byte) string {
+	sum := sha256.Sum256(config)
+	id := hex.EncodeToString(sum[:])
+
+	identitiesMu.Lock()
+	defer identitiesMu.Unlock()
+	seen, ok := identities[ctx.Context]
+	if !ok {
+		seen = make(map[string]int)
+		identities[ctx.Context] = seen
+		context.AfterFunc(ctx.Context, func() {
+			identitiesMu.Lock()
+			defer identitiesMu.Unlock()
+			delete(identities, ctx.Context)
+		})
+	}
+	seen[id]++
+	return fmt.Sprintf("%s/%d", id, seen[id])
+}
+
+// poolIdentity returns the key of the state shared by the handlers of a
+// pool: its name plus a hash of the settings shaping the state, so that,
+// like for other handlers, changing them on reload starts afresh. Handlers
+// of a pool in the same config must have identical settings.
+func poolIdentity(ctx caddy.Context, pool string, config []byte) (string, error) {
+	sum := sha256.Sum256(config)
+	id := hex.EncodeToString(sum[:])
+
+	identitiesMu.Lock()
+	defer identitiesMu.Unlock()
+	seen, ok := pools[ctx.Context]
+	if !ok {
+		seen = make(map[string]string)
+		pools[ctx.Context] = seen
+		context.AfterFunc(ctx.Context, func() {
+			identitiesMu.Lock()
+			defer identitiesMu.Unlock()
+			delete(pools, ctx.Context)
+		})
+	}
+	if other, ok := seen[pool]; ok && other != id {
+		return "", fmt.Errorf("handlers of pool '%s' have conflicting settings", pool)
+	}
+	seen[pool] = id
+	return "pool/" + pool + "/" + id, nil
+}
+
+// poolConfig returns the settings that must be identical for the handlers
+// of a pool, see Pool.
+func (m *Middleware) poolConfig() any {
+	return struct {
+		Name               string
+		Limit              float64
+		LimitStr           string
+		UploadLimit        float64
+		Key                string
+		MaxInflight        int
+		MaxStartsPerMinute int
+		MaxStreams         int
+		AverageLimit       float64
+		AverageWindow      caddy.Duration
+		Overage            *Overage
+		Peak               float64
+		Sustained          float64
+		PeakDuration       caddy.Duration
+		ResetFlood         *ResetFlood
+		Sessions           *Sessions
+		WarmStart          bool
+		Ranges             *RangeShaping
+		ConnectionLimit    float64
+		Granularity        string
+		GlobalLimit        float64
+		Weighted           bool
+		Adaptive           *Adaptive
+		ExternalLimits     *ExternalLimits
+		Accounting         *Accounting
+	}{
+		m.Name, m.Limit, m.LimitStr, m.UploadLimit, m.Key,
+		m.MaxInflight, m.MaxStartsPerMinute, m.MaxStreams, m.AverageLimit, m.AverageWindow, m.Overage,
+		m.Peak, m.Sustained, m.PeakDuration,
+		m.ResetFlood, m.Sessions, m.WarmStart, m.Ranges, m.ConnectionLimit, m.Granularity, m.GlobalLimit, m.Weight != "",
+		m.Adaptive, m.ExternalLimits, m.Accounting,
+	}
+}
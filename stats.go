@@ -0,0 +1,243 @@
+package bandwidth
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// transfer is a throttled response in progress, as reported by the stats
+// admin endpoint.
+type transfer struct {
+	id      uint64
+	policy  string
+	key     string
+	uri     string
+	limit   float64
+	started time.Time
+	sent    atomic.Int64
+	size    atomic.Int64  // Content-Length of the response, -1 if unknown
+	token   string        // progress token, empty if none was issued
+	done    chan struct{} // closed when the transfer finishes
+}
+
+// statsShards is the number of shards of transferStats. Transfers are
+// spread over the shards by ID, so that concurrent responses rarely
+// contend for the same lock.
+const statsShards = 64
+
+// transferStats tracks active transfers and cumulative bytes per policy
+// across all handlers in the process.
+type transferStats struct {
+	nextID atomic.Uint64
+	shards [statsShards]statsShard
+}
+
+type statsShard struct {
+	mu        sync.Mutex
+	active    map[uint64]*transfer
+	completed map[string]int64     // bytes sent by finished transfers, per policy
+	tokens    map[string]*transfer // active transfers by progress token
+}
+
+var stats = newTransferStats()
+
+func newTransferStats() *transferStats {
+	ts := new(transferStats)
+	for i := range ts.shards {
+		ts.shards[i] = statsShard{
+			active:    make(map[uint64]*transfer),
+			completed: make(map[string]int64),
+			tokens:    make(map[string]*transfer),
+		}
+	}
+	return ts
+}
+
+// shard returns the shard holding transfer t.
+func (ts *transferStats) shard(t *transfer) *statsShard {
+	return &ts.shards[t.id%statsShards]
+}
+
+// start registers a new transfer. Every call must be paired with a call to
+// finish.
+func (ts *transferStats) start(policy, key, uri string, limit float64) *transfer {
+	t := &transfer{
+		id:      ts.nextID.Add(1),
+		policy:  policy,
+		key:     key,
+		uri:     uri,
+		limit:   limit,
+		started: time.Now(),
+		done:    make(chan struct{}),
+	}
+	t.size.Store(-1)
+	s := ts.shard(t)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active[t.id] = t
+	return t
+}
+
+func (ts *transferStats) finish(t *transfer) {
+	s := ts.shard(t)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.active, t.id)
+	if t.token != "" {
+		delete(s.tokens, t.token)
+	}
+	s.completed[t.policy] += t.sent.Load()
+	close(t.done)
+}
+
+// load returns the total bytes sent by throttled responses so far and the
+// number of active ones.
+func (ts *transferStats) load() (int64, int) {
+	var total int64
+	var active int
+	for i := range ts.shards {
+		s := &ts.shards[i]
+		s.mu.Lock()
+		for _, n := range s.completed {
+			total += n
+		}
+		for _, t := range s.active {
+			total += t.sent.Load()
+		}
+		active += len(s.active)
+		s.mu.Unlock()
+	}
+	return total, active
+}
+
+// issueToken assigns the transfer an unguessable token with which its
+// progress can be followed until it finishes.
+func (ts *transferStats) issueToken(t *transfer) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	s := ts.shard(t)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.token = hex.EncodeToString(b)
+	s.tokens[t.token] = t
+	return t.token, nil
+}
+
+// lookup returns the active transfer issued the given token, or nil.
+func (ts *transferStats) lookup(token string) *transfer {
+	for i := range ts.shards {
+		s := &ts.shards[i]
+		s.mu.Lock()
+		t := s.tokens[token]
+		s.mu.Unlock()
+		if t != nil {
+			return t
+		}
+	}
+	return nil
+}
+
+type transferInfo struct {
+	ID        uint64    `json:"id"`
+	Policy    string    `json:"policy"`
+	Key       string    `json:"key"`
+	URI       string    `json:"uri"`
+	Limit     float64   `json:"limit"`
+	BytesSent int64     `json:"bytes_sent"`
+	Started   time.Time `json:"started"`
+}
+
+type policyStats struct {
+	Active     int   `json:"active"`
+	BytesTotal int64 `json:"bytes_total"`
+}
+
+type keyStats struct {
+	Key       string `json:"key"`
+	Active    int    `json:"active"`
+	BytesSent int64  `json:"bytes_sent"`
+}
+
+type statsSnapshot struct {
+	Transfers []transferInfo          `json:"transfers"`
+	Policies  map[string]*policyStats `json:"policies"`
+	TopKeys   []keyStats              `json:"top_keys"`
+	Quotas    []keyQuota              `json:"quotas"`
+}
+
+// maxTopKeys is the number of keys listed in a snapshot.
+const maxTopKeys = 10
+
+// snapshot returns the current transfers, the cumulative bytes sent per
+// policy, and the keys with the most bytes sent by active transfers.
+// Throughput can be derived from the difference between two snapshots.
+func (ts *transferStats) snapshot() statsSnapshot {
+	snap := statsSnapshot{
+		Transfers: []transferInfo{},
+		Policies:  make(map[string]*policyStats),
+		TopKeys:   []keyStats{},
+		Quotas:    []keyQuota{},
+	}
+	keys := make(map[string]*keyStats)
+	for i := range ts.shards {
+		ts.shards[i].collect(&snap, keys)
+	}
+	slices.SortFunc(snap.Transfers, func(a, b transferInfo) int { return cmp.Compare(a.ID, b.ID) })
+	for _, ks := range keys {
+		snap.TopKeys = append(snap.TopKeys, *ks)
+	}
+	slices.SortFunc(snap.TopKeys, func(a, b keyStats) int { return cmp.Compare(b.BytesSent, a.BytesSent) })
+	if len(snap.TopKeys) > maxTopKeys {
+		snap.TopKeys = snap.TopKeys[:maxTopKeys]
+	}
+	return snap
+}
+
+// collect adds the transfers and cumulative bytes of the shard to snap,
+// and the bytes of its active transfers to keys.
+func (s *statsShard) collect(snap *statsSnapshot, keys map[string]*keyStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	policy := func(name string) *policyStats {
+		ps, ok := snap.Policies[name]
+		if !ok {
+			ps = new(policyStats)
+			snap.Policies[name] = ps
+		}
+		return ps
+	}
+	for name, total := range s.completed {
+		policy(name).BytesTotal += total
+	}
+	for _, t := range s.active {
+		sent := t.sent.Load()
+		snap.Transfers = append(snap.Transfers, transferInfo{
+			ID:        t.id,
+			Policy:    t.policy,
+			Key:       t.key,
+			URI:       t.uri,
+			Limit:     t.limit,
+			BytesSent: sent,
+			Started:   t.started,
+		})
+		ps := policy(t.policy)
+		ps.Active++
+		ps.BytesTotal += sent
+		if t.key != "" {
+			ks, ok := keys[t.key]
+			if !ok {
+				ks = &keyStats{Key: t.key}
+				keys[t.key] = ks
+			}
+			ks.Active++
+			ks.BytesSent += sent
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package bandwidth
+
+import (
+	"testing"
+)
+
+func TestTransferStatsShards(t *testing.T) {
+	ts := newTransferStats()
+	var transfers []*transfer
+	for i := range 2 * statsShards {
+		tr := ts.start("p", "k", "/", 1000)
+		tr.sent.Store(int64(i))
+		transfers = append(transfers, tr)
+	}
+	token, err := ts.issueToken(transfers[7])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.lookup(token) != transfers[7] {
+		t.Error("token does not find its transfer")
+	}
+	for _, tr := range transfers[:statsShards] {
+		ts.finish(tr)
+	}
+	if ts.lookup(token) != nil {
+		t.Error("token still finds a finished transfer")
+	}
+
+	// Totals add up across the shards, finished transfers included
+	want := int64(2*statsShards) * (2*statsShards - 1) / 2
+	total, active := ts.load()
+	if total != want || active != statsShards {
+		t.Errorf("got %d bytes of %d active transfers, want %d of %d", total, active, want, statsShards)
+	}
+	snap := ts.snapshot()
+	if ps := snap.Policies["p"]; ps == nil || ps.BytesTotal != want || ps.Active != statsShards {
+		t.Errorf("got policy stats %+v, want %d bytes of %d active transfers", ps, want, statsShards)
+	}
+	if len(snap.Transfers) != statsShards || snap.Transfers[0].ID != transfers[statsShards].id {
+		t.Errorf("got %d transfers, want %d in order of ID", len(snap.Transfers), statsShards)
+	}
+}
@@ -0,0 +1,40 @@
+package bandwidth
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// validateStatusLimits checks that every status limit is keyed by a status
+// code, e.g. "404", or class, e.g. "3xx", and is not negative.
+func validateStatusLimits(limits map[string]float64) error {
+	for status, limit := range limits {
+		if !validStatus(status) {
+			return fmt.Errorf("invalid status code or class '%s'", status)
+		}
+		if limit < 0 {
+			return fmt.Errorf("limit for status %s must not be negative", status)
+		}
+	}
+	return nil
+}
+
+func validStatus(s string) bool {
+	if len(s) != 3 || s[0] < '1' || s[0] > '5' {
+		return false
+	}
+	if s[1:] == "xx" {
+		return true
+	}
+	return s[1] >= '0' && s[1] <= '9' && s[2] >= '0' && s[2] <= '9'
+}
+
+// statusLimit returns the limit for responses with the given status, by
+// exact code first and by class otherwise.
+func statusLimit(limits map[string]float64, status int) (float64, bool) {
+	if limit, ok := limits[strconv.Itoa(status)]; ok {
+		return limit, true
+	}
+	limit, ok := limits[strconv.Itoa(status/100)+"xx"]
+	return limit, ok
+}
@@ -0,0 +1,362 @@
+package bandwidth
+
+import (
+	"cmp"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(StatusPage{})
+	httpcaddyfile.RegisterHandlerDirective("bandwidth_status", parseStatusPageCaddyfile)
+}
+
+// StatusPage is a terminal handler rendering an overview of the current
+// shaping state as JSON or HTML: policies and keys with their configured
+// rates, live throughput, active streams and consumption of their average
+// limit. It is a quick operational dashboard without Prometheus or access
+// to the admin API, so it should be protected like any other internal
+// page, e.g. with basic_auth.
+type StatusPage struct {
+	// Format is "json", "html", or empty to negotiate by the Accept header
+	// or the "format" query parameter.
+	Format string `json:"format,omitempty"`
+
+	// MaxKeys is how many keys are listed, busiest first. Defaults to 100.
+	MaxKeys int `json:"max_keys,omitempty"`
+}
+
+const defaultStatusMaxKeys = 100
+
+func (StatusPage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.bandwidth_status",
+		New: func() caddy.Module { return new(StatusPage) },
+	}
+}
+
+func (s *StatusPage) Provision(ctx caddy.Context) error {
+	switch s.Format {
+	case "", "json", "html":
+	default:
+		return fmt.Errorf("unrecognized format '%s'", s.Format)
+	}
+	if s.MaxKeys < 0 {
+		return fmt.Errorf("max_keys must not be negative")
+	}
+	if s.MaxKeys == 0 {
+		s.MaxKeys = defaultStatusMaxKeys
+	}
+	return nil
+}
+
+// statusReport is the overview rendered by StatusPage.
+type statusReport struct {
+	Time     time.Time      `json:"time"`
+	Policies []policyStatus `json:"policies"`
+	Keys     []keyStatus    `json:"keys"`
+}
+
+type policyStatus struct {
+	// Name is empty for handlers without a name
+	Name string `json:"name"`
+	// Limit and UploadLimit are the current settings of named policies
+	Limit       float64 `json:"limit"`
+	UploadLimit float64 `json:"upload_limit"`
+	Active      int     `json:"active"`
+	// Throughput is the combined rate of active transfers, in bytes per second
+	Throughput float64 `json:"throughput"`
+	BytesTotal int64   `json:"bytes_total"`
+}
+
+type keyStatus struct {
+	Policy string `json:"policy"`
+	Key    string `json:"key"`
+	// Limit is the rate of the key's bucket, 0 if it has none
+	Limit      float64 `json:"limit"`
+	Active     int     `json:"active"`
+	Throughput float64 `json:"throughput"`
+	BytesSent  int64   `json:"bytes_sent"`
+	// Quota is the consumption of the key's average limit, if any
+	Quota *quotaStatus `json:"quota,omitempty"`
+}
+
+type quotaStatus struct {
+	Limit float64 `json:"limit"`
+	// Used is the fraction of the average limit's budget spent, from 0 to 1
+	Used float64 `json:"used"`
+	// Remaining is the number of bytes left in the budget
+	Remaining int64 `json:"remaining"`
+	// Overdrawn is the number of bytes by which the key overdrew its
+	// budget under Overage, still to be paid back
+	Overdrawn int64 `json:"overdrawn,omitempty"`
+	// Over and Blocked report whether the key is over its quota and
+	// whether it is blocked for having spent its grace, see Overage
+	Over    bool `json:"over,omitempty"`
+	Blocked bool `json:"blocked,omitempty"`
+}
+
+// quotaStatusOf returns the consumption of the key's average limit, or
+// nil if it has none.
+func quotaStatusOf(ks *keyState, now time.Time) *quotaStatus {
+	ks.mu.Lock()
+	avg, q := ks.avgLimiter, ks.quota
+	ks.mu.Unlock()
+	if avg == nil {
+		return nil
+	}
+	burst := float64(avg.Burst())
+	tokens := avg.TokensAt(now)
+	status := &quotaStatus{
+		Limit:     float64(avg.Limit()),
+		Used:      min(max(1-tokens/burst, 0), 1),
+		Remaining: int64(max(tokens, 0)),
+		Overdrawn: int64(max(-tokens, 0)),
+	}
+	// Like quota.state, the flags only last until the budget has refilled
+	if q != nil && tokens < burst {
+		q.mu.Lock()
+		status.Over, status.Blocked = q.over, q.blocked
+		q.mu.Unlock()
+	}
+	return status
+}
+
+// keyQuota is the quota status of a key, as listed by the stats admin
+// endpoint.
+type keyQuota struct {
+	Policy string `json:"policy"`
+	Key    string `json:"key"`
+	quotaStatus
+}
+
+// quotaStatuses returns the quota status of the keys of every handler
+// with an average limit, including idle ones that are retained, listing
+// at most maxKeys keys with the largest share of their budget spent.
+func quotaStatuses(maxKeys int) []keyQuota {
+	now := clk.Now()
+	quotas := []keyQuota{}
+	handlerStates.Range(func(_, value any) bool {
+		state := value.(*handlerState)
+		if state.keys == nil {
+			return true
+		}
+		state.keys.mu.Lock()
+		defer state.keys.mu.Unlock()
+		for key, ks := range state.keys.states {
+			if status := quotaStatusOf(ks, now); status != nil {
+				quotas = append(quotas, keyQuota{Policy: state.policy, Key: key, quotaStatus: *status})
+			}
+		}
+		return true
+	})
+	slices.SortFunc(quotas, func(a, b keyQuota) int {
+		return cmp.Or(cmp.Compare(b.Used, a.Used), cmp.Compare(a.Policy, b.Policy), cmp.Compare(a.Key, b.Key))
+	})
+	if len(quotas) > maxKeys {
+		quotas = quotas[:maxKeys]
+	}
+	return quotas
+}
+
+// statusOf builds the overview from the transfer stats and the limiter
+// state of every handler, listing at most maxKeys keys.
+func statusOf(maxKeys int) statusReport {
+	now := time.Now()
+	report := statusReport{Time: now, Policies: []policyStatus{}, Keys: []keyStatus{}}
+
+	type keyID struct{ policy, key string }
+	keys := make(map[keyID]*keyStatus)
+	keyFor := func(policy, key string) *keyStatus {
+		ks, ok := keys[keyID{policy, key}]
+		if !ok {
+			ks = &keyStatus{Policy: policy, Key: key}
+			keys[keyID{policy, key}] = ks
+		}
+		return ks
+	}
+
+	snap := stats.snapshot()
+	throughput := make(map[string]float64)
+	for _, t := range snap.Transfers {
+		var rate float64
+		if elapsed := now.Sub(t.Started).Seconds(); elapsed > 0 {
+			rate = float64(t.BytesSent) / elapsed
+		}
+		throughput[t.Policy] += rate
+		if t.Key != "" {
+			ks := keyFor(t.Policy, t.Key)
+			ks.Active++
+			ks.Throughput += rate
+			ks.BytesSent += t.BytesSent
+		}
+	}
+	settings := policies.all()
+	for name, ps := range snap.Policies {
+		status := policyStatus{Name: name, Active: ps.Active, Throughput: throughput[name], BytesTotal: ps.BytesTotal}
+		if s, ok := settings[name]; ok {
+			status.Limit, status.UploadLimit = s.Limit, s.UploadLimit
+		}
+		report.Policies = append(report.Policies, status)
+	}
+	for name, s := range settings {
+		if _, ok := snap.Policies[name]; !ok {
+			report.Policies = append(report.Policies, policyStatus{Name: name, Limit: s.Limit, UploadLimit: s.UploadLimit})
+		}
+	}
+	slices.SortFunc(report.Policies, func(a, b policyStatus) int { return cmp.Compare(a.Name, b.Name) })
+
+	// Add the buckets of keys, including idle ones that are retained
+	handlerStates.Range(func(_, value any) bool {
+		state := value.(*handlerState)
+		if state.keys == nil {
+			return true
+		}
+		state.keys.mu.Lock()
+		defer state.keys.mu.Unlock()
+		for key, ks := range state.keys.states {
+			ks.mu.Lock()
+			lim := ks.limiter
+			ks.mu.Unlock()
+			quota := quotaStatusOf(ks, clk.Now())
+			if lim == nil && quota == nil {
+				continue
+			}
+			status := keyFor(state.policy, key)
+			if lim != nil {
+				status.Limit = float64(lim.Limit())
+			}
+			status.Quota = quota
+		}
+		return true
+	})
+	for _, ks := range keys {
+		report.Keys = append(report.Keys, *ks)
+	}
+	slices.SortFunc(report.Keys, func(a, b keyStatus) int {
+		return cmp.Or(cmp.Compare(b.Throughput, a.Throughput), cmp.Compare(a.Policy, b.Policy), cmp.Compare(a.Key, b.Key))
+	})
+	if len(report.Keys) > maxKeys {
+		report.Keys = report.Keys[:maxKeys]
+	}
+	return report
+}
+
+//go:embed statuspage.html
+var statusPageHTML string
+
+var statusPageTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"limit": func(v float64) string {
+		if v <= 0 {
+			return "unlimited"
+		}
+		return humanBytes(v) + "/s"
+	},
+	"throughput": func(v float64) string { return humanBytes(v) + "/s" },
+	"bytes":      func(v int64) string { return humanBytes(float64(v)) },
+	"percent":    func(v float64) string { return fmt.Sprintf("%.0f%%", v*100) },
+}).Parse(statusPageHTML))
+
+// humanBytes formats n bytes with decimal units, like the dashboard.
+func humanBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1000 && i < len(units)-1 {
+		n /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+func (s StatusPage) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+	report := statusOf(s.MaxKeys)
+	w.Header().Set("Cache-Control", "no-store")
+	if s.format(r) == "json" {
+		return writeJSON(w, report)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	return statusPageTemplate.Execute(w, report)
+}
+
+// format returns the format to render the page in for r.
+func (s StatusPage) format(r *http.Request) string {
+	if s.Format != "" {
+		return s.Format
+	}
+	switch r.URL.Query().Get("format") {
+	case "json":
+		return "json"
+	case "html":
+		return "html"
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return "html"
+	}
+	return "json"
+}
+
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	bandwidth_status [json|html] {
+//	    max_keys <n>
+//	}
+func (s *StatusPage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			s.Format = d.Val()
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "max_keys":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("parsing max_keys value: %v", err)
+				}
+				s.MaxKeys = n
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			default:
+				return d.Errf("unrecognized parameter '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+func parseStatusPageCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var s StatusPage
+	err := s.UnmarshalCaddyfile(h.Dispenser)
+	return s, err
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*StatusPage)(nil)
+	_ caddyhttp.MiddlewareHandler = (*StatusPage)(nil)
+	_ caddyfile.Unmarshaler       = (*StatusPage)(nil)
+)
@@ -0,0 +1,52 @@
+package bandwidth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// placeholderBearerToken is set to the bearer token of the request's
+// Authorization header, if any, so that API clients can be keyed by
+// token with key {http.bandwidth.bearer_token}.
+const placeholderBearerToken = "http.bandwidth.bearer_token"
+
+// bearerToken returns the token of a "Bearer" Authorization header, or "".
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// setBearerToken sets the bearer token placeholder of a request.
+func setBearerToken(repl *caddy.Replacer, r *http.Request) {
+	if token := bearerToken(r); token != "" {
+		repl.Set(placeholderBearerToken, token)
+	}
+}
+
+// hashKey returns the digest standing in for key if keys are hashed, so
+// that secrets used as keys, such as API tokens, are never stored or
+// logged in plaintext: the first 128 bits of their SHA-256 hash, or of
+// their HMAC-SHA256 if a secret is set, hex-encoded.
+func (m Middleware) hashKey(key string) string {
+	if !m.HashKeys || key == "" {
+		return key
+	}
+	var sum []byte
+	if len(m.hashSecret) > 0 {
+		mac := hmac.New(sha256.New, m.hashSecret)
+		mac.Write([]byte(key))
+		sum = mac.Sum(nil)
+	} else {
+		s := sha256.Sum256([]byte(key))
+		sum = s[:]
+	}
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,39 @@
+package bandwidth
+
+import (
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// delayThreshold is the time a response must have spent waiting for
+// tokens to count as delayed by throttling, rather than by the overhead of
+// checking the limiter.
+const delayThreshold = time.Millisecond
+
+// annotateSpan attaches the outcome of throttling to the request's span, if
+// the tracing handler is recording one, so that slow traces can be told
+// apart from slow backends.
+func annotateSpan(r *http.Request, lw *limitedResponseWriter, body *limitedBody, outcome string) {
+	span := trace.SpanFromContext(r.Context())
+	if !span.IsRecording() {
+		return
+	}
+	waited := lw.waited
+	attrs := []attribute.KeyValue{
+		attribute.Float64("bandwidth.limit", lw.limit),
+		attribute.Int64("bandwidth.bytes_written", lw.written),
+		attribute.Float64("bandwidth.wait_seconds", lw.waited.Seconds()),
+		attribute.String("bandwidth.outcome", outcome),
+	}
+	if body != nil {
+		waited += body.waited
+		attrs = append(attrs,
+			attribute.Int64("bandwidth.bytes_read", body.read),
+			attribute.Float64("bandwidth.upload_wait_seconds", body.waited.Seconds()))
+	}
+	attrs = append(attrs, attribute.Bool("bandwidth.delayed", waited >= delayThreshold))
+	span.SetAttributes(attrs...)
+}
@@ -0,0 +1,76 @@
+package bandwidth
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// SummaryTrailers appends HTTP trailers to throttled responses that
+// summarize how they were shaped, so that client-side performance tooling
+// can tell shaping delay from network or server slowness. Trailers are
+// sent on HTTP/2 and HTTP/3 responses and on HTTP/1.1 responses without a
+// Content-Length, which are chunked.
+type SummaryTrailers struct {
+	// ServerTiming adds a Server-Timing trailer with the time spent
+	// waiting for tokens as the "throttle" metric, and the duration and
+	// delivery rate of the whole response as the "delivery" metric.
+	ServerTiming bool `json:"server_timing,omitempty"`
+
+	// Fields are further trailers by name. Their values may contain
+	// placeholders, which are evaluated once the response is finished,
+	// e.g. {http.bandwidth.wait_ms} or {http.bandwidth.rate}.
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+func (st *SummaryTrailers) provision() error {
+	if !st.ServerTiming && len(st.Fields) == 0 {
+		return fmt.Errorf("server_timing or a field is required")
+	}
+	for name := range st.Fields {
+		if !validFieldName(name) {
+			return fmt.Errorf("invalid trailer name '%s'", name)
+		}
+	}
+	return nil
+}
+
+// validFieldName reports whether name is a valid header field name.
+func validFieldName(name string) bool {
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || c == ':' {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// set adds the trailers to h once the response is finished.
+func (st *SummaryTrailers) set(h http.Header, repl *caddy.Replacer, lw *limitedResponseWriter, elapsed time.Duration) {
+	if st.ServerTiming {
+		h.Add(http.TrailerPrefix+"Server-Timing", serverTiming(lw.waited, elapsed, deliveryRate(lw.written, elapsed)))
+	}
+	for name, value := range st.Fields {
+		h.Set(http.TrailerPrefix+name, repl.ReplaceAll(value, ""))
+	}
+}
+
+// serverTiming formats the Server-Timing metrics of a throttled response,
+// with durations in milliseconds.
+func serverTiming(waited, elapsed time.Duration, rate float64) string {
+	return fmt.Sprintf(`throttle;dur=%.1f, delivery;dur=%.1f;desc="%s B/s"`,
+		float64(waited)/float64(time.Millisecond),
+		float64(elapsed)/float64(time.Millisecond),
+		formatRate(float64(int64(rate))))
+}
+
+// deliveryRate returns the average rate at which written bytes were
+// delivered over elapsed, in bytes per second.
+func deliveryRate(written int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(written) / elapsed.Seconds()
+}
@@ -0,0 +1,72 @@
+package bandwidth
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// defaultOverrideHeader is the request header trusted proxies set to
+// override the limit of a request.
+const defaultOverrideHeader = "X-Override-Bandwidth"
+
+// parseTrustedProxies parses IP addresses and CIDR ranges, expanding the
+// "private_ranges" shortcut like Caddy's own trusted_proxies.
+func parseTrustedProxies(exprs []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, expr := range exprs {
+		if expr == "private_ranges" {
+			for _, cidr := range caddyhttp.PrivateRangesCIDR() {
+				prefix, err := caddyhttp.CIDRExpressionToPrefix(cidr)
+				if err != nil {
+					return nil, err
+				}
+				prefixes = append(prefixes, prefix)
+			}
+			continue
+		}
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(expr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// fromTrustedProxy reports whether the request's immediate peer is within
+// one of the trusted ranges.
+func fromTrustedProxy(r *http.Request, trusted []netip.Prefix) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	return slices.ContainsFunc(trusted, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+// headerOverride returns the limit a trusted proxy set for the request, if
+// any. "unlimited", "off" or 0 lift the limit. The header is removed from
+// the request, so that it does not reach upstreams.
+func (m Middleware) headerOverride(r *http.Request) (limit float64, ok bool, err error) {
+	if len(m.trustedProxies) == 0 {
+		return 0, false, nil
+	}
+	v := r.Header.Get(m.OverrideHeader)
+	r.Header.Del(m.OverrideHeader)
+	if v == "" || !fromTrustedProxy(r, m.trustedProxies) {
+		return 0, false, nil
+	}
+	limit, err = parseLimit(v)
+	if err != nil {
+		return 0, false, err
+	}
+	return limit, true, nil
+}
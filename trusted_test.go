@@ -0,0 +1,37 @@
+package bandwidth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeaderOverrideStripped(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := Middleware{OverrideHeader: defaultOverrideHeader, trustedProxies: trusted}
+	for _, tt := range []struct {
+		remote string
+		want   bool
+	}{
+		{remote: "10.1.2.3:1234", want: true},
+		{remote: "192.0.2.7:1234"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remote
+		r.Header.Set(defaultOverrideHeader, "5MB")
+		limit, ok, err := m.headerOverride(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tt.want || ok && limit != 5e6 {
+			t.Errorf("%s: got override %v, %v, want %v", tt.remote, limit, ok, tt.want)
+		}
+		// Neither kind of peer may pass the header on to upstreams
+		if v := r.Header.Get(defaultOverrideHeader); v != "" {
+			t.Errorf("%s: override header still on the request: %q", tt.remote, v)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package bandwidth
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/dustin/go-humanize"
+)
+
+// parseBytes parses a byte count with an optional unit suffix, such as
+// "512KB", "5MiB" or a plain "100000". Rates are given in the same way and
+// are interpreted as bytes per second.
+func parseBytes(s string) (int64, error) {
+	n, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxInt64 {
+		return 0, fmt.Errorf("%s is too large", s)
+	}
+	return int64(n), nil
+}
+
+// parseRate parses a rate in bytes per second. Like parseBytes, it accepts
+// unit suffixes, and plain numbers may be fractional, such as "0.5" for
+// one byte every two seconds.
+func parseRate(s string) (float64, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		if f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+			return 0, fmt.Errorf("invalid rate '%s'", s)
+		}
+		return f, nil
+	}
+	n, err := parseBytes(s)
+	if err != nil {
+		return 0, err
+	}
+	return float64(n), nil
+}
+
+// unlimitedKeyword reports whether s is a keyword lifting a limit.
+func unlimitedKeyword(s string) bool {
+	return s == "unlimited" || s == "off"
+}
+
+// parseLimit is like parseRate, but also accepts "unlimited" or "off",
+// which lift the limit and are returned as 0.
+func parseLimit(s string) (float64, error) {
+	if unlimitedKeyword(s) {
+		return 0, nil
+	}
+	return parseRate(s)
+}
+
+// formatRate formats a rate in bytes per second without an exponent.
+func formatRate(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
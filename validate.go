@@ -0,0 +1,128 @@
+package bandwidth
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Validate rejects configs that would provision fine but silently shape
+// nothing, or not the way they read, so that mistakes surface when the
+// config is loaded rather than as unthrottled traffic. A valid handler
+// registers its named policy last.
+func (m *Middleware) Validate() error {
+	if m.Limit < 0 {
+		return fmt.Errorf("limit must not be negative; use 0 or 'unlimited' to leave responses unthrottled")
+	}
+	if m.DefaultLimit < 0 {
+		return fmt.Errorf("default_limit must not be negative")
+	}
+	if !m.limited() {
+		return fmt.Errorf("no limit configured: set limit (or limit_str in JSON), a name to set it at runtime, " +
+			"or one of the per-path, host, method or key limits; to serve responses unthrottled, use 'limit unlimited' " +
+			"(or unlimited in JSON) or remove the handler")
+	}
+	// The bucket holds a second worth of tokens, so longer intervals
+	// would only ever get chunks cut to the bucket's burst
+	if m.Algorithm == algorithmLeakyBucket && time.Duration(m.PacingInterval) > time.Second {
+		return fmt.Errorf("pacing_interval of %s exceeds the bucket's burst of one second worth of the limit; use at most 1s",
+			time.Duration(m.PacingInterval))
+	}
+	// Writes take chunks of up to the bucket's burst and then wait for the
+	// next chunk to refill, so a shorter wait would fail every throttled
+	// response once its first burst is spent
+	if refill := m.chunkRefill(); m.WaitTimeout > 0 && time.Duration(m.WaitTimeout) < refill {
+		return fmt.Errorf("wait_timeout of %s is shorter than the %s the bucket takes to refill a chunk of a throttled response; "+
+			"use at least %s, or the leaky_bucket algorithm for smaller chunks", time.Duration(m.WaitTimeout), refill, refill)
+	}
+	for name, s := range m.placeholderFields() {
+		if err := checkPlaceholders(s); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	m.registerPolicy()
+	return nil
+}
+
+// chunkRefill returns how long the bucket takes to refill the chunk of a
+// throttled write: its burst of a second worth of the limit, or with the
+// leaky bucket, of one pacing interval.
+func (m *Middleware) chunkRefill() time.Duration {
+	if m.Algorithm != algorithmLeakyBucket {
+		return time.Second
+	}
+	if m.PacingInterval == 0 {
+		return defaultPacingInterval
+	}
+	return time.Duration(m.PacingInterval)
+}
+
+// limited reports whether the handler configures anything that shapes,
+// limits or records traffic, or is explicitly unthrottled.
+func (m *Middleware) limited() bool {
+	return m.Limit > 0 || m.LimitStr != "" || m.Name != "" || m.Unlimited || m.Accounting != nil ||
+		m.ExternalLimits != nil || len(m.ClientCerts) > 0 || len(m.Paths) > 0 ||
+		len(m.Extensions) > 0 || len(m.Hosts) > 0 || m.Geo != nil || len(m.Methods) > 0 ||
+		len(m.SizeBands) > 0 || len(m.StatusLimits) > 0 || m.PreviousLimit > 0 ||
+		m.AverageLimit > 0 || m.Peak > 0 || m.ConnectionLimit > 0 || m.GlobalLimit > 0 ||
+		m.UploadLimit > 0 || m.UploadMaxSize > 0 || m.MaxInflight > 0 || m.MaxStreams > 0 ||
+		m.MaxStartsPerMinute > 0 || m.MaxTransferTime > 0 || m.MinEffectiveRate > 0 ||
+		m.Simulate != nil || len(m.TrustedProxies) > 0
+}
+
+// placeholderFields returns the fields that may contain placeholders, by
+// their JSON name.
+func (m *Middleware) placeholderFields() map[string]string {
+	fields := map[string]string{
+		"limit_str": m.LimitStr,
+		"key":       m.Key,
+		"priority":  m.Priority,
+		"weight":    m.Weight,
+	}
+	if m.ExternalLimits != nil {
+		fields["external_limits.key"] = m.ExternalLimits.Key
+	}
+	if m.Accounting != nil {
+		fields["accounting.key"] = m.Accounting.Key
+	}
+	if m.Geo != nil {
+		fields["geo.country"] = m.Geo.Country
+	}
+	if m.Sessions != nil {
+		fields["sessions.id"] = m.Sessions.ID
+	}
+	if m.Ranges != nil {
+		fields["ranges.client"] = m.Ranges.Client
+	}
+	if m.Trailers != nil {
+		for name, value := range m.Trailers.Fields {
+			fields["trailers."+name] = value
+		}
+	}
+	return fields
+}
+
+// checkPlaceholders reports unclosed, unopened or empty placeholders in s,
+// which the replacer would leave as literal text instead of resolving,
+// e.g. "{http.request.header.X-Limit" or "{}". Braces escaped with a
+// backslash are literal.
+func checkPlaceholders(s string) error {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '}':
+			return fmt.Errorf("unexpected '}' at position %d of '%s'", i, s)
+		case '{':
+			end := strings.IndexAny(s[i+1:], "{}")
+			if end < 0 || s[i+1+end] == '{' {
+				return fmt.Errorf("unclosed placeholder at position %d of '%s'", i, s)
+			}
+			if end == 0 {
+				return fmt.Errorf("empty placeholder at position %d of '%s'", i, s)
+			}
+			i += end + 1
+		}
+	}
+	return nil
+}
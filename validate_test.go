@@ -0,0 +1,142 @@
+package bandwidth
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestValidateCaddyfile(t *testing.T) {
+	for _, tt := range []struct {
+		input   string
+		wantErr bool
+	}{
+		{input: `bandwidth {
+			limit 1MB
+		}`},
+		{input: `bandwidth {
+			limit {http.request.header.X-Limit}
+		}`},
+		// Explicitly unthrottled handlers are valid, as documented
+		{input: `bandwidth {
+			limit unlimited
+		}`},
+		{input: `bandwidth {
+			limit off
+		}`},
+		{input: `bandwidth {
+			limit 0
+		}`},
+		// So are handlers that only record traffic
+		{input: `bandwidth {
+			accounting {
+				include_exempt
+			}
+		}`},
+		{input: `bandwidth {
+			trailers
+		}`, wantErr: true},
+		{input: `bandwidth {
+			limit -1
+		}`, wantErr: true},
+	} {
+		var m Middleware
+		if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input)); err != nil {
+			if !tt.wantErr {
+				t.Errorf("%s: parsing: %v", tt.input, err)
+			}
+			continue
+		}
+		err := m.Validate()
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: validated, want an error", tt.input)
+		} else if !tt.wantErr && err != nil {
+			t.Errorf("%s: %v", tt.input, err)
+		}
+	}
+}
+
+func TestValidateJSON(t *testing.T) {
+	for _, tt := range []struct {
+		config  string
+		wantErr bool
+	}{
+		{config: `{"limit": 1000}`},
+		{config: `{"limit_str": "unlimited"}`},
+		{config: `{"limit_str": "off"}`},
+		{config: `{"limit_str": "0"}`},
+		{config: `{"unlimited": true}`},
+		// A zero limit looks just like a forgotten one
+		{config: `{"limit": 0}`, wantErr: true},
+		{config: `{}`, wantErr: true},
+	} {
+		var m Middleware
+		if err := json.Unmarshal([]byte(tt.config), &m); err != nil {
+			t.Fatalf("%s: %v", tt.config, err)
+		}
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		err := m.Provision(ctx)
+		if err == nil {
+			err = m.Validate()
+			m.Cleanup()
+		}
+		cancel()
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: validated, want an error", tt.config)
+		} else if !tt.wantErr && err != nil {
+			t.Errorf("%s: %v", tt.config, err)
+		}
+	}
+}
+
+func TestValidateChunkSize(t *testing.T) {
+	for _, tt := range []struct {
+		input   string
+		wantErr bool
+	}{
+		{input: `bandwidth {
+			limit 1MB
+			wait_timeout 1s
+		}`},
+		{input: `bandwidth {
+			limit 1MB
+			algorithm leaky_bucket 50ms
+			wait_timeout 100ms
+		}`},
+		{input: `bandwidth {
+			limit 1MB
+			algorithm leaky_bucket
+			wait_timeout 20ms
+		}`},
+		// The token bucket's chunks are a second worth of the limit
+		{input: `bandwidth {
+			limit 1MB
+			wait_timeout 500ms
+		}`, wantErr: true},
+		{input: `bandwidth {
+			limit 1MB
+			algorithm leaky_bucket 200ms
+			wait_timeout 100ms
+		}`, wantErr: true},
+		// The bucket only holds a second worth of the limit
+		{input: `bandwidth {
+			limit 1MB
+			algorithm leaky_bucket 2s
+		}`, wantErr: true},
+	} {
+		var m Middleware
+		if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input)); err != nil {
+			t.Fatalf("%s: parsing: %v", tt.input, err)
+		}
+		err := m.Validate()
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: validated, want an error", tt.input)
+		} else if !tt.wantErr && err != nil {
+			t.Errorf("%s: %v", tt.input, err)
+		}
+	}
+}
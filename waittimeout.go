@@ -0,0 +1,73 @@
+package bandwidth
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// WaitTimeoutError is the error of a throttled response whose chunk could
+// not get tokens within the wait timeout, e.g. because a shared pool is
+// starved. It is served with status 503, and the response's outcome is
+// "wait_timeout", so that handle_errors routes can tell it from other
+// failures.
+type WaitTimeoutError struct {
+	// Timeout is the wait timeout that was exceeded.
+	Timeout time.Duration
+	// Written is the number of bytes sent before the wait timed out.
+	Written int64
+}
+
+func (e *WaitTimeoutError) Error() string {
+	if e.Written == 0 {
+		return fmt.Sprintf("throttled response could not get tokens within the wait timeout of %s", e.Timeout)
+	}
+	return fmt.Sprintf("throttled transfer aborted after waiting for tokens longer than %s with %d bytes sent", e.Timeout, e.Written)
+}
+
+// waitContext bounds a wait for tokens by the wait timeout. The limiters
+// fail a wait right away if it cannot finish in time, so that starved
+// transfers fail fast.
+func (l *limitedResponseWriter) waitContext() (context.Context, context.CancelFunc) {
+	if l.waitTimeout <= 0 {
+		return l.ctx, func() {}
+	}
+	return context.WithTimeout(l.ctx, l.waitTimeout)
+}
+
+// waitTimedOut reports whether a wait bounded by ctx failed because of the
+// wait timeout, rather than because the client went away or the budget
+// ran out.
+func (l *limitedResponseWriter) waitTimedOut(ctx context.Context) bool {
+	if l.waitTimeout <= 0 || l.ctx.Err() != nil {
+		return false
+	}
+	deadline, _ := ctx.Deadline()
+	outer, ok := l.ctx.Deadline()
+	return !ok || deadline.Before(outer)
+}
+
+// checkStarved rejects the response up front if its buckets are so far in
+// debt that not even its first byte could be sent within the wait
+// timeout, so that an error can still be served instead.
+func (l *limitedResponseWriter) checkStarved() error {
+	if l.waitTimeout <= 0 {
+		return nil
+	}
+	now := clk.Now()
+	lims := append([]*rate.Limiter{l.limiter, l.avgLimiter, l.sustained}, l.tiers...)
+	for _, lim := range lims {
+		if lim == nil || lim.Limit() <= 0 {
+			continue
+		}
+		if tokens := lim.TokensAt(now); tokens < 1 {
+			delay := time.Duration((1 - tokens) / float64(lim.Limit()) * float64(time.Second))
+			if delay > l.waitTimeout {
+				return &WaitTimeoutError{Timeout: l.waitTimeout}
+			}
+		}
+	}
+	return nil
+}
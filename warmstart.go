@@ -0,0 +1,57 @@
+package bandwidth
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// demandStore keeps the rate at which each key was observed to consume
+// bandwidth during the most recent accounting interval, per policy. It
+// outlives handler state, so that buckets created after a config reload
+// can start out as full as the key's recent demand left them.
+type demandStore struct {
+	mu    sync.Mutex
+	rates map[string]map[string]float64 // bytes per second, by policy and key
+}
+
+var demand = &demandStore{rates: make(map[string]map[string]float64)}
+
+// observe replaces the demand of policy with the throttled usage in
+// records, which cover the interval from start to end.
+func (ds *demandStore) observe(policy string, records []accountingRecord, start, end time.Time) {
+	secs := end.Sub(start).Seconds()
+	if secs <= 0 {
+		return
+	}
+	rates := make(map[string]float64, len(records))
+	for _, r := range records {
+		if !r.Exempt {
+			rates[r.Key] = float64(r.BytesSent) / secs
+		}
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.rates[policy] = rates
+}
+
+// rate returns the recent demand of key under policy, in bytes per second.
+func (ds *demandStore) rate(policy, key string) float64 {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.rates[policy][key]
+}
+
+// drain takes tokens out of a freshly created, full limiter in proportion
+// to how much of its rate the key recently used: a key that kept up with
+// the limit starts with an empty bucket, an idle one with a full bucket.
+func drain(lim *rate.Limiter, demand float64) {
+	if lim == nil || demand <= 0 {
+		return
+	}
+	frac := min(demand/float64(lim.Limit()), 1)
+	if n := int(float64(lim.Burst()) * frac); n > 0 {
+		lim.ReserveN(clk.Now(), n)
+	}
+}
@@ -0,0 +1,96 @@
+package bandwidth
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// parseWeight parses the weight of a key, see Middleware.Weight.
+func parseWeight(s string) (float64, error) {
+	if s == "" {
+		return 1, nil
+	}
+	w, err := strconv.ParseFloat(s, 64)
+	if err != nil || w <= 0 {
+		return 0, fmt.Errorf("weight must be a positive number, got '%s'", s)
+	}
+	return w, nil
+}
+
+// weightedPool divides the global bucket between the keys with responses
+// in flight in proportion to their weights. Each key gets a bucket of its
+// own at its share of the global rate, which its responses wait on
+// together with the global bucket while the latter is short of tokens.
+// While the global bucket keeps up, shares are only charged, so that
+// capacity that some keys leave unused goes to the others.
+type weightedPool struct {
+	mu     sync.Mutex
+	global *rate.Limiter
+	keys   map[string]*weightedKey
+	total  float64 // sum of the weights of keys
+}
+
+type weightedKey struct {
+	weight float64
+	share  *rate.Limiter
+	refs   int
+}
+
+func newWeightedPool(global *rate.Limiter) *weightedPool {
+	return &weightedPool{global: global, keys: make(map[string]*weightedKey)}
+}
+
+// join adds a response of key with the given weight to the pool and
+// returns the key's share. The key's weight is that of its latest
+// response. Every call must be paired with a call to leave.
+func (p *weightedPool) join(key string, weight float64) *rate.Limiter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	wk, ok := p.keys[key]
+	if !ok {
+		// Shares have the burst of the global bucket, so that chunks
+		// sized for it fit whatever the share
+		wk = &weightedKey{share: rate.NewLimiter(0, p.global.Burst())}
+		p.keys[key] = wk
+	}
+	wk.refs++
+	p.total += weight - wk.weight
+	wk.weight = weight
+	p.rebalance()
+	return wk.share
+}
+
+// leave drops a response added by join.
+func (p *weightedPool) leave(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	wk, ok := p.keys[key]
+	if !ok {
+		return
+	}
+	wk.refs--
+	if wk.refs <= 0 {
+		delete(p.keys, key)
+		p.total -= wk.weight
+		p.rebalance()
+	}
+}
+
+// rebalance sets the rate of every share to its part of the global rate.
+// p.mu must be held.
+func (p *weightedPool) rebalance() {
+	now := clk.Now()
+	limit := float64(p.global.Limit())
+	for _, wk := range p.keys {
+		wk.share.SetLimitAt(now, rate.Limit(limit*wk.weight/p.total))
+	}
+}
+
+// contended reports whether drawing n tokens from the global bucket would
+// have to wait, in which case responses wait on their shares too.
+func (p *weightedPool) contended(n int) bool {
+	return p.global.TokensAt(clk.Now()) < float64(n)
+}
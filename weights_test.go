@@ -0,0 +1,105 @@
+package bandwidth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestWeightCaddyfile(t *testing.T) {
+	var m Middleware
+	err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`bandwidth {
+		key {http.request.header.X-User}
+		global_limit 1MB
+		weight {http.request.header.X-Weight}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Weight != "{http.request.header.X-Weight}" || m.GlobalLimit != 1e6 {
+		t.Errorf("got weight %q and global_limit %v", m.Weight, m.GlobalLimit)
+	}
+
+	for _, input := range []string{
+		`bandwidth {
+			weight
+		}`,
+		`bandwidth {
+			weight 1 2
+		}`,
+	} {
+		var m Middleware
+		if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("%s: parsed, want an error", input)
+		}
+	}
+}
+
+func TestWeightProvision(t *testing.T) {
+	for _, tt := range []struct {
+		config  string
+		wantErr bool
+	}{
+		{config: `{"key": "{http.request.header.X-User}", "global_limit": 1000, "weight": "4"}`},
+		{config: `{"key": "{http.request.header.X-User}", "global_limit": 1000, "weight": "{http.request.header.X-Weight}"}`},
+		// Weights divide the global limit between keys
+		{config: `{"global_limit": 1000, "weight": "4"}`, wantErr: true},
+		{config: `{"key": "{http.request.header.X-User}", "limit": 1000, "weight": "4"}`, wantErr: true},
+		{config: `{"key": "{http.request.header.X-User}", "global_limit": 1000, "weight": "-1"}`, wantErr: true},
+		{config: `{"key": "{http.request.header.X-User}", "global_limit": 1000, "weight": "heavy"}`, wantErr: true},
+	} {
+		m, err := loadHandler(t, tt.config)
+		if err == nil {
+			m.Cleanup()
+		}
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: loaded, want an error", tt.config)
+		} else if !tt.wantErr && err != nil {
+			t.Errorf("%s: %v", tt.config, err)
+		}
+	}
+}
+
+func TestWeightedPoolShares(t *testing.T) {
+	useVirtualClock(t)
+	p := newWeightedPool(newLimiter(1000))
+	premium := p.join("premium", 3)
+	free := p.join("free", 1)
+	if premium.Limit() != 750 || free.Limit() != 250 {
+		t.Errorf("got shares of %v and %v, want 750 and 250", premium.Limit(), free.Limit())
+	}
+
+	// A key's weight is that of its latest response, and it keeps its
+	// share until its last response leaves
+	p.join("free", 2)
+	if premium.Limit() != 600 || free.Limit() != 400 {
+		t.Errorf("got shares of %v and %v, want 600 and 400", premium.Limit(), free.Limit())
+	}
+	p.leave("free")
+	p.leave("free")
+	if premium.Limit() != 1000 {
+		t.Errorf("got a share of %v for the only key, want all of 1000", premium.Limit())
+	}
+}
+
+func TestWeightThrottling(t *testing.T) {
+	vc := useVirtualClock(t)
+	m, err := loadHandler(t, `{"key": "{http.request.header.X-User}", "global_limit": 1000,
+		"weight": "{http.request.header.X-Weight}"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Cleanup()
+
+	// A key alone in the pool gets all of it, whatever its weight, once
+	// the burst is spent
+	serve(t, vc, m, requestBy("alice"), 1000)
+	for _, weight := range []string{"1", "4", "invalid"} {
+		r := requestBy("alice")
+		r.Header.Set("X-Weight", weight)
+		if _, got := serve(t, vc, m, r, 2000); got != 2*time.Second {
+			t.Errorf("weight %s: took %s, want 2s", weight, got)
+		}
+	}
+}
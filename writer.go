@@ -0,0 +1,613 @@
+package bandwidth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
+)
+
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	limiter       *rate.Limiter // nil if the response is not rate limited
+	sched         *scheduler    // orders access to a shared limiter, if set
+	priority      int           // priority class for sched
+	uploadLimiter *rate.Limiter // paces reads from hijacked connections
+	limit         float64       // effective limit, for logging
+	bands         []SizeBand
+	statusLimits  map[string]float64
+	minSize       int64               // responses smaller than this are not throttled
+	unthrottled   int64               // number of leading bytes written without pacing
+	headStart     int64               // number of leading bytes written without waiting, see charge
+	inflight      *semaphore.Weighted // nil if in-flight bytes are not capped
+	maxInflight   int
+	r             *http.Request
+	transfer      *transfer
+	ramp          *ramper         // nil if the transfer does not ramp up
+	rampLimiter   *rate.Limiter   // current ramp limiter, nil once ramped up
+	avgLimiter    *rate.Limiter   // long-run average limiter of the key, if any
+	overage       *Overage        // how the key may overdraw avgLimiter, if at all
+	quota         *quota          // the key's overage state, if overage is set
+	key           string          // the request's key, if keyed
+	sustained     *rate.Limiter   // sustained bucket of peak shaping, if any
+	tiers         []*rate.Limiter // connection and global limiters, if any
+	weighted      *weightedPool   // divides the global limiter by weight, if any
+	share         *rate.Limiter   // the key's share of weighted, if any
+	nested        []*rate.Limiter // buckets of composed nested handlers, see compose
+	saturation    *saturation     // starvation of the key, if tracked
+	simulate      *Simulate       // nil unless simulating network latency
+	slow          *slowTracker    // nil unless slow clients are detected
+	onSlow        func(rate float64)
+
+	// Leaky bucket pacing, see Middleware.Algorithm
+	pacingInterval time.Duration  // 0 unless pacing evenly
+	pacer          *rate.Limiter  // spreads writes evenly at limit, if set
+	trace          *decisionTrace // nil if the decision is not traced
+
+	// Time budget for the transfer, see Middleware.MaxTransferTime and
+	// Middleware.MinEffectiveRate
+	maxTransferTime time.Duration
+	minRate         float64
+	ctx             context.Context // request context, bounded by the budget
+	cancel          context.CancelFunc
+	budgetErr       error         // set if the budget or wait timeout was exceeded
+	waitTimeout     time.Duration // bounds each wait for tokens, see Middleware.WaitTimeout
+
+	credit int // tokens reserved ahead of writes, see batchSize
+
+	// Content metering of encoded responses, see Middleware.Measure
+	measureContent bool
+	content        *contentMeter // nil unless the response is encoded
+	scale          float64       // content bytes per written byte in the current write
+
+	written int64         // bytes successfully written to the client
+	waited  time.Duration // total time spent waiting for tokens
+	aborted bool          // whether a wait was interrupted before completion
+
+	// Why the transfer ended early, see abort
+	abortedBy string
+	stopped   <-chan struct{} // closed when the config serving the request stops
+	status    int             // final status code
+
+	// Pacing counters, see metrics
+	chunks  int64 // chunks written
+	waits   int64 // chunks that had to wait for tokens
+	wakeups int64 // times the request blocked and was woken up again
+
+	wroteHeader bool
+}
+
+func (l *limitedResponseWriter) WriteHeader(status int) {
+	// Informational responses may be written several times before the
+	// final header, so only the final one selects the band
+	if !l.wroteHeader && status >= 200 {
+		l.wroteHeader = true
+		l.status = status
+		if size, err := strconv.ParseInt(l.Header().Get("Content-Length"), 10, 64); err == nil && l.transfer != nil {
+			l.transfer.size.Store(size)
+		}
+		if !l.applyStatusLimit(status) {
+			l.applySizeBand()
+		}
+		l.applyMinSize()
+		if l.measureContent && (l.limiter != nil || l.avgLimiter != nil || l.sustained != nil || len(l.tiers) > 0) {
+			l.content = newContentMeter(l.Header().Get("Content-Encoding"))
+		}
+		l.trace.emit(l.Header(), l.limit)
+		err := l.startBudget()
+		if err == nil {
+			err = l.checkStarved()
+		}
+		if err != nil {
+			// Drop the handler's response so that an error can be
+			// served instead
+			l.budgetErr = err
+			for _, field := range []string{"Content-Length", "Content-Type", "Content-Encoding", "Content-Range"} {
+				l.Header().Del(field)
+			}
+		}
+	}
+	if l.budgetErr != nil {
+		return
+	}
+	l.ResponseWriter.WriteHeader(status)
+}
+
+// applyStatusLimit replaces the limiter with one for the limit configured
+// for the response's status, if any, and reports whether it did.
+func (l *limitedResponseWriter) applyStatusLimit(status int) bool {
+	limit, ok := statusLimit(l.statusLimits, status)
+	if !ok {
+		return false
+	}
+	l.trace.add("status_limits", "%s for status %d", formatLimit(limit), status)
+	l.limiter, l.sched = nil, nil
+	if limit > 0 {
+		l.limiter = newLimiter(limit)
+	} else {
+		l.avgLimiter, l.quota, l.sustained, l.tiers, l.share = nil, nil, nil, nil, nil
+	}
+	l.limit = tieredLimit(limit, l.tiers)
+	return true
+}
+
+// applySizeBand replaces the limiter with one for the size band matching
+// the response's Content-Length, if any.
+func (l *limitedResponseWriter) applySizeBand() {
+	if len(l.bands) == 0 {
+		return
+	}
+	size, err := strconv.ParseInt(l.Header().Get("Content-Length"), 10, 64)
+	if err != nil {
+		return
+	}
+	band, ok := matchBand(l.bands, size)
+	if !ok {
+		l.trace.add("size_bands", "no match for %d bytes", size)
+		return
+	}
+	l.trace.add("size_bands", "%s for %d bytes", formatLimit(band.Limit), size)
+	l.limit = tieredLimit(band.Limit, l.tiers)
+	l.limiter, l.sched = nil, nil
+	if band.Limit > 0 {
+		l.limiter = newLimiter(band.Limit)
+	}
+}
+
+// applyMinSize lifts the limit for responses smaller than the minimum
+// size. If the length is unknown, the first minSize bytes are written
+// unthrottled and pacing engages after that.
+func (l *limitedResponseWriter) applyMinSize() {
+	if l.minSize <= 0 {
+		return
+	}
+	size, err := strconv.ParseInt(l.Header().Get("Content-Length"), 10, 64)
+	if err != nil {
+		l.trace.add("min_size", "first %d bytes unthrottled", l.minSize)
+		l.unthrottled = max(l.unthrottled, l.minSize)
+		return
+	}
+	if size < l.minSize {
+		l.trace.add("min_size", "exempt at %d bytes", size)
+		l.limiter, l.avgLimiter, l.quota, l.sustained, l.tiers, l.sched, l.limit = nil, nil, nil, nil, nil, nil, 0
+		l.share = nil
+	}
+}
+
+// startBudget bounds the transfer by its time budget, rejecting it up
+// front if its Content-Length cannot be delivered in time at the limit.
+func (l *limitedResponseWriter) startBudget() error {
+	budget := l.maxTransferTime
+	size, err := strconv.ParseInt(l.Header().Get("Content-Length"), 10, 64)
+	known := err == nil && size > 0
+	if known && l.minRate > 0 {
+		if b := bytesDuration(size, l.minRate); budget == 0 || b < budget {
+			budget = b
+		}
+	}
+	if budget <= 0 {
+		return nil
+	}
+	if known && l.limit > 0 {
+		if expected := bytesDuration(size, l.limit); expected > budget {
+			return fmt.Errorf("transfer of %d bytes at %s B/s would take %s, exceeding its budget of %s",
+				size, formatRate(l.limit), expected.Round(time.Second), budget.Round(time.Second))
+		}
+	}
+	l.ctx, l.cancel = context.WithTimeout(l.r.Context(), budget)
+	return nil
+}
+
+// bytesDuration returns how long it takes to transfer size bytes at rate
+// bytes per second.
+func bytesDuration(size int64, rate float64) time.Duration {
+	return time.Duration(float64(size) / float64(rate) * float64(time.Second))
+}
+
+func (l *limitedResponseWriter) Write(p []byte) (int, error) {
+	if !l.wroteHeader {
+		l.WriteHeader(http.StatusOK)
+	}
+	if l.budgetErr != nil {
+		return 0, l.budgetErr
+	}
+	if l.content != nil {
+		l.content.feed(p)
+		l.scale = l.content.ratio()
+	}
+	total := 0
+	for len(p) > 0 {
+		if l.cancel != nil && l.ctx.Err() != nil {
+			l.budgetErr = fmt.Errorf("transfer aborted after exceeding its time budget with %d bytes sent", l.written)
+			return total, l.budgetErr
+		}
+		// Determine chunk size based on limiter burst (minimum 1)
+		// and the in-flight cap
+		chunk := len(p)
+		paced := l.written >= l.unthrottled
+		charged := paced && l.written < l.headStart
+		if !paced {
+			chunk = min(chunk, int(l.unthrottled-l.written))
+		} else if charged {
+			chunk = min(chunk, int(l.headStart-l.written))
+			for _, lim := range l.chargeable() {
+				chunk = min(chunk, l.wireBytes(max(lim.Burst(), 1)))
+			}
+		} else {
+			chunk = l.pacedChunk(chunk)
+		}
+		if l.inflight != nil {
+			chunk = min(chunk, l.maxInflight)
+		}
+		// Wait for permission to send this chunk
+		start := clk.Now()
+		ctx, cancel := l.waitContext()
+		err := l.acquire(ctx, chunk, paced && !charged)
+		cancel()
+		l.waited += clk.Now().Sub(start)
+		if err != nil && l.waitTimedOut(ctx) {
+			l.aborted = true
+			l.budgetErr = &WaitTimeoutError{Timeout: l.waitTimeout, Written: l.written}
+			return total, l.budgetErr
+		}
+		if qe, ok := err.(*QuotaExceededError); ok {
+			l.aborted = true
+			l.budgetErr = qe
+			return total, l.budgetErr
+		}
+		if err == nil && charged {
+			l.charge(l.cost(chunk))
+		}
+		if err != nil {
+			l.aborted = true
+			// If the client is still there, the wait failed because it
+			// would not finish within the budget
+			if l.cancel != nil && l.r.Context().Err() == nil {
+				l.budgetErr = fmt.Errorf("transfer aborted after exceeding its time budget with %d bytes sent", l.written)
+				return total, l.budgetErr
+			}
+			return total, l.abort(err)
+		}
+		// Write the chunk
+		var writeStart time.Time
+		if l.slow != nil {
+			writeStart = time.Now()
+			l.slow.beforeWrite(writeStart)
+		}
+		n, err := l.ResponseWriter.Write(p[:chunk])
+		if l.inflight != nil {
+			l.inflight.Release(int64(chunk))
+		}
+		total += n
+		l.written += int64(n)
+		l.transfer.sent.Add(int64(n))
+		if l.slow != nil {
+			if slowErr := l.checkSlow(n, writeStart, err); slowErr != nil {
+				return total, slowErr
+			}
+		}
+		if err != nil {
+			return total, l.abort(err)
+		}
+		// Advance the buffer
+		p = p[chunk:]
+	}
+	return total, nil
+}
+
+// acquireConn blocks until up to n bytes may be written to a hijacked
+// connection and returns how many, which must be handed back with
+// releaseConn once written.
+func (l *limitedResponseWriter) acquireConn(ctx context.Context, n int) (int, error) {
+	chunk := l.pacedChunk(n)
+	if l.inflight != nil {
+		chunk = min(chunk, l.maxInflight)
+	}
+	if err := l.acquire(ctx, chunk, true); err != nil {
+		return 0, err
+	}
+	return chunk, nil
+}
+
+// releaseConn releases the in-flight reservation of a chunk written to a
+// hijacked connection.
+func (l *limitedResponseWriter) releaseConn(chunk int) {
+	if l.inflight != nil {
+		l.inflight.Release(int64(chunk))
+	}
+}
+
+// pacedChunk returns how much of chunk bytes can be paced at once: no
+// more than any of the buckets can grant.
+func (l *limitedResponseWriter) pacedChunk(chunk int) int {
+	if l.limiter != nil {
+		chunk = min(chunk, l.wireBytes(max(l.limiter.Burst(), 1)))
+	}
+	l.rampLimiter = l.ramp.update(l.limit)
+	if l.rampLimiter != nil {
+		chunk = min(chunk, l.wireBytes(l.rampLimiter.Burst()))
+	}
+	if l.avgLimiter != nil {
+		chunk = min(chunk, l.wireBytes(max(l.avgLimiter.Burst(), 1)))
+	}
+	if l.quota != nil {
+		chunk = min(chunk, l.wireBytes(max(l.quota.limiter.Burst(), 1)))
+		// so that chunks fit into the grace
+		if l.overage.Grace > 0 {
+			chunk = min(chunk, l.wireBytes(int(min(l.overage.Grace, math.MaxInt32))))
+		}
+	}
+	if l.sustained != nil {
+		chunk = min(chunk, l.wireBytes(l.sustained.Burst()))
+	}
+	for _, t := range l.tiers {
+		chunk = min(chunk, l.wireBytes(t.Burst()))
+	}
+	for _, lim := range l.nested {
+		chunk = min(chunk, l.wireBytes(max(lim.Burst(), 1)))
+	}
+	if l.pacingInterval > 0 {
+		l.pacer = pacerFor(l.pacer, l.limit, l.pacingInterval)
+		if l.pacer != nil {
+			chunk = min(chunk, l.wireBytes(l.pacer.Burst()))
+		}
+	}
+	return chunk
+}
+
+// errSlowClient is the error of transfers evicted for reading too slowly.
+var errSlowClient = fmt.Errorf("client reads far below the limit")
+
+// checkSlow records a write of n bytes that started at start and failed
+// with err, if it did, reporting the client once it has been slow for the
+// grace period and returning an error if it is evicted.
+func (l *limitedResponseWriter) checkSlow(n int, start time.Time, err error) error {
+	now := time.Now()
+	blocked := now.Sub(start)
+	if err != nil {
+		if !l.slow.stalled(blocked) {
+			return nil
+		}
+		l.slow.rate = float64(n) / blocked.Seconds()
+	} else if !l.slow.afterWrite(n, blocked, l.limit, now) {
+		return nil
+	}
+	if !l.slow.reported {
+		l.slow.reported = true
+		l.onSlow(l.slow.rate)
+	}
+	if !l.slow.cfg.Evict {
+		return nil
+	}
+	l.abortedBy = outcomeSlowClient
+	if err == nil {
+		err = errSlowClient
+	}
+	return l.abort(err)
+}
+
+// Hijack hijacks the underlying connection and wraps it so that writes
+// stay paced by the same buckets and scheduler as the response, and reads
+// by the upload limit if any, e.g. for WebSocket connections.
+func (l *limitedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(l.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	lc := &limitedConn{
+		Conn:        conn,
+		ctx:         l.r.Context(),
+		readLimiter: l.uploadLimiter,
+		w:           l,
+	}
+
+	// Data the server already buffered was received before the hijack, so
+	// hand it out as-is and pace everything after it
+	buffered, _ := brw.Reader.Peek(brw.Reader.Buffered())
+	rd := io.MultiReader(bytes.NewReader(bytes.Clone(buffered)), lc)
+	return lc, bufio.NewReadWriter(bufio.NewReader(rd), bufio.NewWriter(lc)), nil
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (l *limitedResponseWriter) Unwrap() http.ResponseWriter {
+	return l.ResponseWriter
+}
+
+// acquire blocks until chunk bytes may be sent, reserving them from the
+// in-flight budget, waiting out any simulated latency and, if paced,
+// reserving them from the limiter. Waits for the budget, the simulated
+// latency and tokens are bounded by ctx. The caller must release the in-flight reservation once
+// the chunk is written.
+func (l *limitedResponseWriter) acquire(ctx context.Context, chunk int, paced bool) error {
+	l.chunks++
+	if l.inflight != nil && !l.inflight.TryAcquire(int64(chunk)) {
+		l.wakeups++
+		if err := l.inflight.Acquire(ctx, int64(chunk)); err != nil {
+			return err
+		}
+	}
+	if l.simulate != nil {
+		l.wakeups++
+		if err := l.simulate.sleep(ctx); err != nil {
+			if l.inflight != nil {
+				l.inflight.Release(int64(chunk))
+			}
+			return err
+		}
+	}
+	if !paced {
+		return nil
+	}
+	cost := l.cost(chunk)
+	if l.credit >= cost {
+		l.credit -= cost
+		return nil
+	}
+	var lims []*rate.Limiter
+	for _, lim := range []*rate.Limiter{l.rampLimiter, l.pacer, l.limiter, l.avgLimiter, l.sustained} {
+		if lim != nil {
+			lims = append(lims, lim)
+		}
+	}
+	// Tokens are taken from every tier at once, see waitAll
+	lims = append(lims, l.tiers...)
+	lims = append(lims, l.nested...)
+	n := l.batchSize(cost-l.credit, lims)
+	var overdrawn func()
+	if l.quota != nil && l.avgLimiter != nil {
+		// Beyond its quota, the key is paced by its overage policy
+		var err error
+		if lims, overdrawn, err = l.overdraw(lims, n); err != nil {
+			if l.inflight != nil {
+				l.inflight.Release(int64(chunk))
+			}
+			return err
+		}
+		if overdrawn != nil {
+			n = max(min(n, l.quota.limiter.Burst()), cost-l.credit)
+		}
+	}
+	if l.share != nil {
+		// Shares only hold keys back while the global bucket is short of
+		// tokens, see Weight
+		if l.weighted.contended(n) {
+			lims = append(lims, l.share)
+		} else {
+			l.share.AllowN(clk.Now(), n)
+		}
+	}
+	if l.saturation != nil {
+		l.saturation.waiters.Add(1)
+		defer l.saturation.waiters.Add(-1)
+	}
+	wait := func() error {
+		start := clk.Now()
+		slept, err := waitAll(ctx, n, lims...)
+		if l.saturation != nil && err == nil {
+			l.saturation.observe(start, slept)
+		}
+		if slept {
+			l.waits++
+			l.wakeups++
+		}
+		return err
+	}
+	var err error
+	if l.limiter != nil && l.sched != nil {
+		var queued bool
+		queued, err = l.sched.do(ctx, l.priority, wait)
+		if queued {
+			l.wakeups++
+		}
+	} else {
+		err = wait()
+	}
+	if err != nil {
+		if l.inflight != nil {
+			l.inflight.Release(int64(chunk))
+		}
+		return err
+	}
+	if overdrawn != nil {
+		overdrawn()
+	}
+	l.credit += n - cost
+	return nil
+}
+
+// cost returns the tokens that n written bytes are charged: their size,
+// or their estimated decoded size when metering content.
+func (l *limitedResponseWriter) cost(n int) int {
+	if l.scale <= 1 {
+		return n
+	}
+	return max(int(float64(n)*l.scale), 1)
+}
+
+// wireBytes returns how many bytes may be written for n tokens, the
+// inverse of cost.
+func (l *limitedResponseWriter) wireBytes(n int) int {
+	if l.scale <= 1 {
+		return n
+	}
+	return max(int(float64(n)/l.scale), 1)
+}
+
+// chargeable returns the buckets that bytes written during the head start
+// are charged to.
+func (l *limitedResponseWriter) chargeable() []*rate.Limiter {
+	var lims []*rate.Limiter
+	for _, lim := range []*rate.Limiter{l.limiter, l.avgLimiter, l.sustained} {
+		if lim != nil {
+			lims = append(lims, lim)
+		}
+	}
+	lims = append(lims, l.tiers...)
+	return append(lims, l.nested...)
+}
+
+// charge takes n tokens from the buckets without waiting for them, so
+// that bytes written during the head start are paid back by later writes
+// of the response, or of others sharing the buckets.
+func (l *limitedResponseWriter) charge(n int) {
+	now := clk.Now()
+	for _, lim := range l.chargeable() {
+		lim.ReserveN(now, n)
+	}
+}
+
+// reserveAhead is how far ahead of its writes a fast transfer reserves
+// tokens, see batchSize.
+const reserveAhead = 10 * time.Millisecond
+
+// batchSize returns how many tokens to reserve for a chunk that needs
+// need more than the writer holds. While the buckets are stocked, it
+// reserves up to reserveAhead worth of the limit in one go, so that fast
+// transfers written in small blocks neither take the limiters' locks nor
+// sleep on every write. Once tokens get scarce, it reserves just what is
+// needed, so that pacing stays fine-grained. At most reserveAhead worth
+// of tokens is left unused when a transfer ends.
+func (l *limitedResponseWriter) batchSize(need int, lims []*rate.Limiter) int {
+	// Ramping and leaky bucket pacing rely on small, evenly spaced chunks
+	if l.rampLimiter != nil || l.pacer != nil {
+		return need
+	}
+	batch := int(min(l.limit*reserveAhead.Seconds(), math.MaxInt32))
+	if batch <= need {
+		return need
+	}
+	now := clk.Now()
+	for _, lim := range lims {
+		batch = min(batch, lim.Burst(), int(max(lim.TokensAt(now), 0)))
+	}
+	return max(batch, need)
+}
+
+// countingWriter counts the bytes written in a response that is not
+// throttled.
+type countingWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	written int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriterWrapper.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+func (c *countingWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := c.ResponseWriterWrapper.ReadFrom(r)
+	c.written += n
+	return n, err
+}
@@ -0,0 +1,121 @@
+package bandwidth
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// discardWriter is a ResponseWriter that drops the body, so that
+// benchmarks measure the cost of pacing rather than of buffering.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardWriter) WriteHeader(int)             {}
+
+func newBenchWriter(lim *rate.Limiter) *limitedResponseWriter {
+	return &limitedResponseWriter{
+		ResponseWriter: &discardWriter{header: make(http.Header)},
+		limiter:        lim,
+		limit:          float64(lim.Limit()),
+		r:              httptest.NewRequest(http.MethodGet, "/", nil),
+		ctx:            context.Background(),
+		transfer:       &transfer{},
+	}
+}
+
+// BenchmarkWrite writes blocks through a limited writer, as a proxy or
+// file server copying a body would. At rates the benchmark cannot reach,
+// it measures the overhead of pacing per block.
+func BenchmarkWrite(b *testing.B) {
+	for _, limit := range []float64{10e6, 100e6, 1e9, 100e9} {
+		for _, size := range []int{4 << 10, 32 << 10} {
+			b.Run(fmt.Sprintf("limit=%s/block=%d", formatRate(limit), size), func(b *testing.B) {
+				lim := newLimiter(limit)
+				// Start with an empty bucket, as a long-running transfer would
+				lim.AllowN(time.Now(), lim.Burst())
+				lw := newBenchWriter(lim)
+				block := make([]byte, size)
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for range b.N {
+					if _, err := lw.Write(block); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+				b.ReportMetric(float64(lw.waits)/float64(b.N), "waits/op")
+			})
+		}
+	}
+}
+
+// BenchmarkWriteShared writes blocks from concurrent responses sharing
+// one limiter, which contend for its lock.
+func BenchmarkWriteShared(b *testing.B) {
+	lim := newLimiter(100e9)
+	block := make([]byte, 32<<10)
+	b.SetBytes(int64(len(block)))
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		lw := newBenchWriter(lim)
+		for pb.Next() {
+			if _, err := lw.Write(block); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// hijackableWriter is a ResponseWriter whose connection can be hijacked.
+type hijackableWriter struct {
+	discardWriter
+	conn net.Conn
+}
+
+func (h *hijackableWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return h.conn, bufio.NewReadWriter(bufio.NewReader(h.conn), bufio.NewWriter(h.conn)), nil
+}
+
+func TestHijackTierOnly(t *testing.T) {
+	vc := useVirtualClock(t)
+	server, client := net.Pipe()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+
+	// Only a global tier applies, no limiter of the response's own
+	lw := &limitedResponseWriter{
+		ResponseWriter: &hijackableWriter{discardWriter: discardWriter{header: make(http.Header)}, conn: server},
+		tiers:          []*rate.Limiter{newLimiter(1000)},
+		r:              httptest.NewRequest(http.MethodGet, "/", nil),
+		ctx:            context.Background(),
+		transfer:       &transfer{},
+	}
+	conn, _, err := lw.Hijack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The first second's worth is sent from the bucket
+	got := vc.elapsed(func() {
+		if _, err := conn.Write(make([]byte, 3000)); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if want := 2 * time.Second; got != want {
+		t.Errorf("writing to the hijacked connection took %s, want %s", got, want)
+	}
+}